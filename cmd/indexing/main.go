@@ -1,20 +1,54 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"poetry/config"
 	"poetry/db"
+	"syscall"
 )
 
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("You must pass dataset and index name arguments")
+	cfg := config.GetConfig()
+	if err := cfg.RequireElasticsearch(); err != nil {
+		log.Fatal(err)
+	}
+
+	deleteOld := flag.Bool("delete-old", false, "delete the dataset's previous index after the alias is swapped")
+	numWorkers := flag.Int("workers", cfg.Indexing.Workers, "number of concurrent bulk writers")
+	maxRetries := flag.Int("retries", cfg.Indexing.Retries, "times to resend documents rejected with 429 or 5xx")
+	syncMode := flag.Bool("sync", false, "keep running and index poem changes from the MongoDB change stream")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <dataset> [alias]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -sync [alias]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *syncMode {
+		alias := db.PoemsAlias
+		if flag.NArg() > 0 {
+			alias = flag.Arg(0)
+		}
+		runSync(alias)
 		return
 	}
 
-	dataset := os.Args[1]
-	indexName := os.Args[2]
+	if flag.NArg() < 1 {
+		fmt.Println("You must pass a dataset argument")
+		flag.Usage()
+		return
+	}
+
+	dataset := flag.Arg(0)
+	alias := db.PoemsAlias
+	if flag.NArg() > 1 {
+		alias = flag.Arg(1)
+	}
 
 	mongoDBConnection, err := db.NewMongoDBConnection()
 	if err != nil {
@@ -25,8 +59,52 @@ func main() {
 	if err != nil {
 		log.Fatalf("Elasticsearch error while attempting to index data: %s", err)
 	}
-	err = db.ReindexData(mongoDBConnection.Client, esClient, dataset, indexName, 4)
+
+	result, err := db.ReindexData(mongoDBConnection, esClient, dataset, db.ReindexOptions{
+		Alias: alias,
+		Bulk: db.BulkOptions{
+			Workers:    *numWorkers,
+			MaxRetries: maxRetries,
+			FlushBytes: cfg.Indexing.FlushBytes,
+		},
+		DeleteOld: *deleteOld,
+	})
+	printSummary(result)
 	if err != nil {
 		log.Fatalf("Failed indexing data: %s", err)
 	}
+
+	fmt.Printf("Dataset %s indexed into %s, alias %s updated\n", dataset, result.Index, alias)
+}
+
+func printSummary(result db.ReindexResult) {
+	fmt.Printf("Indexed: %d, failed: %d, retried: %d\n", result.Indexed, result.Failed, result.Retried)
+	for _, failure := range result.Failures {
+		fmt.Printf("  %s (status %d): %s\n", failure.ID, failure.Status, failure.Reason)
+	}
+	if shown := int64(len(result.Failures)); result.Failed > shown {
+		fmt.Printf("  ... and %d more\n", result.Failed-shown)
+	}
+}
+
+// runSync indexes poem changes into alias until the process is interrupted.
+func runSync(alias string) {
+	mongoDBConnection, err := db.NewMongoDBConnection()
+	if err != nil {
+		log.Fatalf("Mongo connection error while starting change sync: %s", err)
+	}
+	defer mongoDBConnection.Disconnect()
+
+	esClient, err := db.ConnectElasticsearch()
+	if err != nil {
+		log.Fatalf("Elasticsearch error while starting change sync: %s", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := db.SyncChanges(ctx, mongoDBConnection, esClient, alias); err != nil {
+		log.Fatalf("Change sync stopped: %s", err)
+	}
+	fmt.Println("Change sync stopped")
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// builtinDescriptors describe the Kaggle corpora listed in data.txt.
+//
+//go:embed datasets/*.yaml
+var builtinDescriptors embed.FS
+
+// Descriptor declares how to turn a dataset file into poems, so adding a
+// corpus needs a YAML or JSON file rather than an importer function.
+type Descriptor struct {
+	// Name selects the descriptor on the command line.
+	Name string `yaml:"name"`
+	// Dataset is stored on every poem to tell corpora apart.
+	Dataset string `yaml:"dataset"`
+	// Path is relative to the data directory and may be a glob.
+	Path   string `yaml:"path"`
+	Format string `yaml:"format"`
+	// Language is used for records without a language column.
+	Language string `yaml:"language"`
+	// ID is the column holding the poem's ID within the dataset.
+	ID     string   `yaml:"id"`
+	Fields Fields   `yaml:"fields"`
+	Tags   TagsRule `yaml:"tags"`
+	// Trim lists the fields whose surrounding whitespace is removed: id,
+	// title, poem, poet, language or tags.
+	Trim []string `yaml:"trim"`
+	// LazyQuotes accepts quotes inside unquoted CSV fields and stray quotes
+	// in quoted ones; VariableFields accepts rows with more or fewer fields
+	// than the header, missing ones being empty.
+	LazyQuotes     bool `yaml:"lazy_quotes"`
+	VariableFields bool `yaml:"variable_fields"`
+}
+
+// Fields maps poem fields to columns. A CSV column is a header name or a
+// zero-based index; a JSON column is an object key.
+type Fields struct {
+	Title    string `yaml:"title"`
+	Poem     string `yaml:"poem"`
+	Poet     string `yaml:"poet"`
+	Language string `yaml:"language"`
+}
+
+// TagsRule reads tags from Column. A JSON array is used as is, text is cut
+// at Separator or split into the matches of Pattern. Without either the
+// whole value is one tag.
+type TagsRule struct {
+	Column    string `yaml:"column"`
+	Separator string `yaml:"separator"`
+	Pattern   string `yaml:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+const (
+	formatCSV   = "csv"
+	formatJSON  = "json"
+	formatJSONL = "jsonl"
+)
+
+// trimmableFields are the fields a descriptor may trim.
+var trimmableFields = []string{"id", "title", "poem", "poet", "language", "tags"}
+
+// trims reports whether the descriptor trims field.
+func (d *Descriptor) trims(field string) bool {
+	return slices.Contains(d.Trim, field)
+}
+
+// split returns the tags in value.
+func (r *TagsRule) split(value string, trim bool) []string {
+	var tags []string
+	switch {
+	case r.pattern != nil:
+		tags = r.pattern.FindAllString(value, -1)
+	case r.Separator != "":
+		tags = strings.Split(value, r.Separator)
+	case value != "":
+		tags = []string{value}
+	}
+
+	kept := tags[:0]
+	for _, tag := range tags {
+		if trim {
+			tag = strings.TrimSpace(tag)
+		}
+		if tag != "" {
+			kept = append(kept, tag)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+// validate checks the descriptor and compiles its tag pattern.
+func (d *Descriptor) validate() error {
+	var problems []string
+	if d.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	if d.Dataset == "" {
+		problems = append(problems, "dataset is required")
+	}
+	if d.Path == "" {
+		problems = append(problems, "path is required")
+	}
+	switch d.Format {
+	case formatCSV, formatJSON, formatJSONL:
+	default:
+		problems = append(problems, fmt.Sprintf("format %q must be csv, json or jsonl", d.Format))
+	}
+	if d.Format != formatCSV && (d.LazyQuotes || d.VariableFields) {
+		problems = append(problems, "lazy_quotes and variable_fields only apply to csv")
+	}
+	if d.Fields.Poem == "" {
+		problems = append(problems, "fields.poem is required")
+	}
+	if d.Language == "" && d.Fields.Language == "" {
+		problems = append(problems, "language or fields.language is required")
+	}
+	for _, field := range d.Trim {
+		if !slices.Contains(trimmableFields, field) {
+			problems = append(problems, fmt.Sprintf("trim field %q must be one of %s", field, strings.Join(trimmableFields, ", ")))
+		}
+	}
+	if d.Tags.Separator != "" && d.Tags.Pattern != "" {
+		problems = append(problems, "tags take a separator or a pattern, not both")
+	}
+	if d.Tags.Pattern != "" {
+		pattern, err := regexp.Compile(d.Tags.Pattern)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("tags.pattern: %v", err))
+		}
+		d.Tags.pattern = pattern
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid dataset descriptor %s: %s", d.Name, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseDescriptor reads a YAML or JSON descriptor. Unknown keys are errors
+// so a misspelt field is not silently left empty.
+func parseDescriptor(r io.Reader) (*Descriptor, error) {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+
+	var descriptor Descriptor
+	if err := decoder.Decode(&descriptor); err != nil {
+		return nil, fmt.Errorf("failed to parse dataset descriptor: %v", err)
+	}
+	if err := descriptor.validate(); err != nil {
+		return nil, err
+	}
+	return &descriptor, nil
+}
+
+// loadDescriptorFile reads the descriptor at path.
+func loadDescriptorFile(path string) (*Descriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dataset descriptor: %v", err)
+	}
+	defer f.Close()
+
+	descriptor, err := parseDescriptor(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return descriptor, nil
+}
+
+// loadDescriptors returns the built-in descriptors and those in dir, by
+// name. A descriptor in dir replaces a built-in one of the same name.
+func loadDescriptors(dir string) (map[string]*Descriptor, error) {
+	descriptors := make(map[string]*Descriptor)
+
+	builtin, err := fs.Glob(builtinDescriptors, "datasets/*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range builtin {
+		f, err := builtinDescriptors.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		descriptor, err := parseDescriptor(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		descriptors[descriptor.Name] = descriptor
+	}
+
+	if dir == "" {
+		return descriptors, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list dataset descriptors: %v", err)
+	}
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		descriptor, err := loadDescriptorFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		descriptors[descriptor.Name] = descriptor
+	}
+	return descriptors, nil
+}
+
+func sortedNames[T any](m map[string]T) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
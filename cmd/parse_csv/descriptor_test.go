@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDescriptor(t *testing.T) {
+	const valid = `
+name: odes
+dataset: kaggle-odes
+path: odes/*.csv
+format: csv
+language: english
+fields:
+  title: Title
+  poem: Text
+tags:
+  column: Tags
+  pattern: "[^,]+,[^,]+"
+trim: [title, poem]
+`
+	descriptor, err := parseDescriptor(strings.NewReader(valid))
+	require.NoError(t, err)
+	assert.Equal(t, "odes", descriptor.Name)
+	assert.Equal(t, Fields{Title: "Title", Poem: "Text"}, descriptor.Fields)
+	assert.Equal(t, []string{"title", "poem"}, descriptor.Trim)
+	assert.NotNil(t, descriptor.Tags.pattern, "the tag pattern is compiled")
+
+	tests := []struct {
+		name       string
+		descriptor string
+		problem    string
+	}{
+		{"bad yaml", "name: [odes", "failed to parse"},
+		{"unknown key", valid + "titel: Title\n", "field titel not found"},
+		{"missing columns", "name: odes\nformat: csv\n", "dataset is required; path is required; fields.poem is required; language or fields.language is required"},
+		{"unknown format", strings.Replace(valid, "format: csv", "format: xml", 1), `format "xml" must be csv, json or jsonl`},
+		{"csv options on json", strings.Replace(valid, "format: csv", "format: json\nlazy_quotes: true", 1), "only apply to csv"},
+		{"unknown trim field", strings.Replace(valid, "[title, poem]", "[title, tags, body]", 1), `trim field "body"`},
+		{"separator and pattern", strings.Replace(valid, "  column: Tags", "  column: Tags\n  separator: ;", 1), "not both"},
+		{"bad pattern", strings.Replace(valid, `"[^,]+,[^,]+"`, `"[^,"`, 1), "tags.pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDescriptor(strings.NewReader(tt.descriptor))
+			assert.ErrorContains(t, err, tt.problem)
+		})
+	}
+}
+
+func TestBuiltinDescriptors(t *testing.T) {
+	descriptors, err := loadDescriptors("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"arabic_poetry_dataset", "chinese_one_line", "collection_of_poetry", "poems_data", "poetry_foundation", "russian_poetry_corpus"},
+		sortedNames(descriptors))
+}
+
+func TestTagsRuleSplit(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  TagsRule
+		value string
+		trim  bool
+		tags  []string
+	}{
+		{"whole value", TagsRule{}, "love", false, []string{"love"}},
+		{"empty value", TagsRule{}, "", false, nil},
+		{"separator", TagsRule{Separator: ";"}, "love;;death", false, []string{"love", "death"}},
+		{"separator trimmed", TagsRule{Separator: ";"}, " love ; ;death", true, []string{"love", "death"}},
+		{"separator untrimmed", TagsRule{Separator: ";"}, " love ; ;death", false, []string{" love ", " ", "death"}},
+		{"pattern", TagsRule{Pattern: "[^,]+,[^,]+"}, "Living,Death,Nature,Love", false, []string{"Living,Death", "Nature,Love"}},
+		{"pattern without match", TagsRule{Pattern: "[^,]+,[^,]+"}, "Living", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Descriptor{Name: "odes", Dataset: "odes", Path: "odes.csv", Format: formatCSV, Language: "english", Fields: Fields{Poem: "0"}, Tags: tt.rule}
+			require.NoError(t, d.validate())
+			assert.Equal(t, tt.tags, d.Tags.split(tt.value, tt.trim))
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"poetry/db"
+	"sort"
+)
+
+const (
+	// drySamples is how many poems a dry run prints.
+	drySamples = 3
+	// dryErrors is how many malformed rows a dry run describes.
+	dryErrors = 10
+)
+
+// dryRunReport reads a dataset without saving it and reports what an
+// import would produce.
+type dryRunReport struct {
+	files      []string
+	rows       int64
+	emptyPoem  int64
+	emptyTitle int64
+	emptyPoet  int64
+	malformed  int64
+	errors     []string
+	languages  map[string]int64
+	samples    []db.Poem
+}
+
+func newDryRunReport() *dryRunReport {
+	return &dryRunReport{languages: make(map[string]int64)}
+}
+
+func (r *dryRunReport) StartFile(path string) error {
+	r.files = append(r.files, path)
+	return nil
+}
+
+func (r *dryRunReport) Add(poem db.Poem) error {
+	r.rows++
+	if poem.Poem == "" {
+		r.emptyPoem++
+	}
+	if poem.Title == "" {
+		r.emptyTitle++
+	}
+	if poem.Poet == "" {
+		r.emptyPoet++
+	}
+	r.languages[poem.Language]++
+	if len(r.samples) < drySamples {
+		r.samples = append(r.samples, poem)
+	}
+	return nil
+}
+
+// Malformed counts the row and goes on, so the report covers the whole file.
+func (r *dryRunReport) Malformed(err error) error {
+	r.malformed++
+	if len(r.errors) < dryErrors {
+		r.errors = append(r.errors, fmt.Sprintf("%s: %v", r.files[len(r.files)-1], err))
+	}
+	return nil
+}
+
+func (r *dryRunReport) ExpectBytes(n int64) {}
+
+func (r *dryRunReport) CountBytes(reader io.Reader) io.Reader {
+	return reader
+}
+
+// Close prints the report.
+func (r *dryRunReport) Close(ok bool) error {
+	if !ok {
+		fmt.Println("The dataset could not be read completely, the report covers what was read")
+	}
+	fmt.Printf("Files: %d\n", len(r.files))
+	fmt.Printf("Rows: %d\n", r.rows)
+	fmt.Printf("Empty poem: %d, empty title: %d, empty poet: %d\n", r.emptyPoem, r.emptyTitle, r.emptyPoet)
+	fmt.Printf("Malformed rows: %d\n", r.malformed)
+	for _, message := range r.errors {
+		fmt.Printf("  %s\n", message)
+	}
+	if shown := int64(len(r.errors)); r.malformed > shown {
+		fmt.Printf("  ... and %d more\n", r.malformed-shown)
+	}
+
+	fmt.Println("Languages:")
+	languages := sortedNames(r.languages)
+	sort.SliceStable(languages, func(i, j int) bool {
+		return r.languages[languages[i]] > r.languages[languages[j]]
+	})
+	for _, language := range languages {
+		name := language
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Printf("  %s: %d\n", name, r.languages[language])
+	}
+
+	fmt.Println("Samples:")
+	for _, poem := range r.samples {
+		sample, err := json.MarshalIndent(poem, "  ", "  ")
+		if err != nil {
+			continue
+		}
+		fmt.Printf("  %s\n", sample)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"poetry/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureStdout returns what f prints to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+func TestDryRunImportFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "odes.csv")
+	const data = "id,title,poem,poet,language\n" +
+		"1,Ode,Verse,Keats,English\n" +
+		"2,,Verse two,,english\n" +
+		"3,Bad \"quote\",x,y,english\n" +
+		"4,Haiku,,Basho,Japanese\n"
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+	d := &Descriptor{Name: "odes", Dataset: "kaggle-odes", Path: "odes.csv", Format: formatCSV, ID: "id",
+		Fields: Fields{Title: "title", Poem: "poem", Poet: "poet", Language: "language"}}
+	require.NoError(t, d.validate())
+
+	totals = db.UpsertResult{}
+	report := newDryRunReport()
+	require.NoError(t, importFile(report, d, path))
+
+	assert.Equal(t, []string{path}, report.files)
+	assert.Equal(t, int64(3), report.rows)
+	assert.Equal(t, int64(1), report.emptyPoem)
+	assert.Equal(t, int64(1), report.emptyTitle)
+	assert.Equal(t, int64(1), report.emptyPoet)
+	assert.Equal(t, int64(1), report.malformed)
+	require.Len(t, report.errors, 1)
+	assert.Contains(t, report.errors[0], `bare " in non-quoted-field`)
+	assert.Equal(t, map[string]int64{"english": 2, "japanese": 1}, report.languages)
+	assert.Len(t, report.samples, 3)
+
+	output := captureStdout(t, func() { report.Close(true) })
+	assert.Contains(t, output, "Rows: 3\n")
+	assert.Contains(t, output, "Empty poem: 1, empty title: 1, empty poet: 1\n")
+	assert.Contains(t, output, "Malformed rows: 1\n")
+	assert.Contains(t, output, "Languages:\n  english: 2\n  japanese: 1\n")
+
+	// Nothing was saved, and the data directory holds only the dataset.
+	assert.Equal(t, db.UpsertResult{}, totals)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"poetry/db"
+	"strconv"
+	"strings"
+)
+
+// importSink receives the poems an importer reads: importPipeline saves
+// them, dryRun reports on them.
+type importSink interface {
+	// StartFile announces the file the next poems come from.
+	StartFile(path string) error
+	// Add receives the next poem. Reading stops when it returns an error.
+	Add(poem db.Poem) error
+	// Malformed is told about a row that could not be read. Reading goes on
+	// with the next row unless it returns an error.
+	Malformed(err error) error
+	// ExpectBytes and CountBytes measure progress through the input.
+	ExpectBytes(n int64)
+	CountBytes(r io.Reader) io.Reader
+	// Close ends the import, which failed unless ok, and returns an error
+	// that failed it after reading ended.
+	Close(ok bool) error
+}
+
+// record returns the value of a column of one dataset row, nil when the row
+// does not have it.
+type record func(column string) interface{}
+
+// recordReader reads the rows of a dataset file.
+type recordReader interface {
+	// Next returns the next record, or io.EOF after the last one.
+	Next() (record, error)
+}
+
+// csvRecordReader reads a CSV file whose first row is a header.
+type csvRecordReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+// newCSVRecordReader reads the header and resolves every column the
+// descriptor uses, so a wrong column name fails before any poem is saved.
+func newCSVRecordReader(r io.Reader, d *Descriptor) (*csvRecordReader, error) {
+	reader := csv.NewReader(r)
+	reader.LazyQuotes = d.LazyQuotes
+	if d.VariableFields {
+		reader.FieldsPerRecord = -1
+	}
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, ok := positions[name]; !ok {
+			positions[name] = i
+		}
+	}
+
+	columns := make(map[string]int)
+	for _, column := range d.columns() {
+		if index, err := strconv.Atoi(column); err == nil && index >= 0 {
+			columns[column] = index
+			continue
+		}
+		index, ok := positions[strings.ToLower(column)]
+		if !ok {
+			return nil, fmt.Errorf("column %q is not in the CSV header", column)
+		}
+		columns[column] = index
+	}
+	return &csvRecordReader{reader: reader, columns: columns}, nil
+}
+
+func (r *csvRecordReader) Next() (record, error) {
+	row, err := r.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	return func(column string) interface{} {
+		index, ok := r.columns[column]
+		if !ok || index >= len(row) {
+			return nil
+		}
+		return row[index]
+	}, nil
+}
+
+// jsonRecordReader reads a JSON array of objects, or with lines set a file
+// of one object per line.
+type jsonRecordReader struct {
+	decoder *json.Decoder
+	lines   bool
+}
+
+func newJSONRecordReader(r io.Reader, lines bool) (*jsonRecordReader, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if !lines {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JSON: %v", err)
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return nil, errors.New("expected a JSON array of objects")
+		}
+	}
+	return &jsonRecordReader{decoder: decoder, lines: lines}, nil
+}
+
+func (r *jsonRecordReader) Next() (record, error) {
+	if !r.lines && !r.decoder.More() {
+		return nil, io.EOF
+	}
+	var object map[string]interface{}
+	if err := r.decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+	return func(column string) interface{} {
+		return object[column]
+	}, nil
+}
+
+// columns lists every column the descriptor reads.
+func (d *Descriptor) columns() []string {
+	var columns []string
+	for _, column := range []string{d.ID, d.Fields.Title, d.Fields.Poem, d.Fields.Poet, d.Fields.Language, d.Tags.Column} {
+		if column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// openRecords returns a reader for the dataset file f.
+func (d *Descriptor) openRecords(f io.Reader) (recordReader, error) {
+	switch d.Format {
+	case formatCSV:
+		return newCSVRecordReader(f, d)
+	case formatJSON:
+		return newJSONRecordReader(f, false)
+	case formatJSONL:
+		return newJSONRecordReader(f, true)
+	}
+	return nil, fmt.Errorf("unsupported format %q", d.Format)
+}
+
+// text returns a column value as a string.
+func text(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// poem builds the poem of one record.
+func (d *Descriptor) poem(rec record) db.Poem {
+	field := func(name, column string) string {
+		if column == "" {
+			return ""
+		}
+		value := text(rec(column))
+		if d.trims(name) {
+			value = strings.TrimSpace(value)
+		}
+		return value
+	}
+
+	poem := db.Poem{
+		Dataset:   d.Dataset,
+		DatasetId: field("id", d.ID),
+		Title:     field("title", d.Fields.Title),
+		Poem:      field("poem", d.Fields.Poem),
+		Poet:      field("poet", d.Fields.Poet),
+		Language:  strings.ToLower(strings.TrimSpace(field("language", d.Fields.Language))),
+	}
+	if poem.Language == "" {
+		poem.Language = d.Language
+	}
+
+	if d.Tags.Column != "" {
+		switch value := rec(d.Tags.Column).(type) {
+		case []interface{}:
+			for _, tag := range value {
+				poem.Tags = append(poem.Tags, text(tag))
+			}
+		default:
+			poem.Tags = d.Tags.split(text(value), d.trims("tags"))
+		}
+	}
+	return poem
+}
+
+// importDescriptor imports every file matching the descriptor's path.
+func importDescriptor(sink importSink, d *Descriptor) bool {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		log.Fatal("Error getting current working directory:", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(currentDir, DATAPATH, d.Path))
+	if err != nil {
+		fmt.Println("Error finding files:", err)
+		return false
+	}
+	if len(files) == 0 {
+		fmt.Printf("No files match %s in %s\n", d.Path, DATAPATH)
+		return false
+	}
+
+	for _, path := range files {
+		if info, err := os.Stat(path); err == nil {
+			sink.ExpectBytes(info.Size())
+		}
+	}
+
+	for _, path := range files {
+		fmt.Println("Processing file:", path)
+		if err := importFile(sink, d, path); err != nil {
+			fmt.Printf("Failed to import %s: %v\n", path, err)
+			return false
+		}
+	}
+	return true
+}
+
+// importFile streams the poems of one dataset file into sink.
+func importFile(sink importSink, d *Descriptor, path string) error {
+	if err := sink.StartFile(path); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records, err := d.openRecords(sink.CountBytes(f))
+	if err != nil {
+		return err
+	}
+
+	for {
+		rec, err := records.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		// A malformed CSV row leaves the reader on the next one, unlike a
+		// JSON syntax error.
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			if err := sink.Malformed(err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := sink.Add(d.poem(rec)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
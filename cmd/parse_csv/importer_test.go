@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"poetry/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDescriptor returns a valid CSV descriptor reading fields.
+func testDescriptor(t *testing.T, fields Fields) *Descriptor {
+	d := &Descriptor{Name: "odes", Dataset: "kaggle-odes", Path: "odes.csv", Format: formatCSV, Language: "english", Fields: fields}
+	require.NoError(t, d.validate())
+	return d
+}
+
+func TestNewCSVRecordReaderColumns(t *testing.T) {
+	const data = "\ufeffID, Title ,Text,title\n1,Ode,Verse,Other\n"
+
+	tests := []struct {
+		name   string
+		fields Fields
+		title  interface{}
+		poem   interface{}
+		err    string
+	}{
+		{"header names ignore case, spaces and the BOM", Fields{Title: "TITLE", Poem: "text"}, "Ode", "Verse", ""},
+		{"indexes", Fields{Title: "3", Poem: "2"}, "Other", "Verse", ""},
+		{"index past the row", Fields{Title: "9", Poem: "2"}, nil, "Verse", ""},
+		{"unknown column", Fields{Title: "Name", Poem: "Text"}, nil, nil, `column "Name" is not in the CSV header`},
+		{"negative index is a name", Fields{Title: "-1", Poem: "Text"}, nil, nil, `column "-1" is not in the CSV header`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := newCSVRecordReader(strings.NewReader(data), testDescriptor(t, tt.fields))
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+
+			rec, err := reader.Next()
+			require.NoError(t, err)
+			assert.Equal(t, tt.title, rec(tt.fields.Title))
+			assert.Equal(t, tt.poem, rec(tt.fields.Poem))
+			assert.Nil(t, rec("unused"))
+
+			_, err = reader.Next()
+			assert.ErrorIs(t, err, io.EOF)
+		})
+	}
+
+	_, err := newCSVRecordReader(strings.NewReader(""), testDescriptor(t, Fields{Poem: "0"}))
+	assert.ErrorContains(t, err, "failed to read CSV header")
+}
+
+func TestDescriptorPoem(t *testing.T) {
+	row := map[string]interface{}{
+		"id":       " 7 ",
+		"title":    "  Ode ",
+		"poem":     "\tVerse\n",
+		"poet":     " Keats ",
+		"language": " English ",
+		"tags":     " Living,Death , Nature,Love",
+		"list":     []interface{}{"love", "night"},
+		"number":   json.Number("42"),
+	}
+	rec := func(column string) interface{} { return row[column] }
+
+	tests := []struct {
+		name     string
+		fields   Fields
+		language string
+		tags     TagsRule
+		trim     []string
+		poem     db.Poem
+	}{
+		{
+			name:   "untrimmed",
+			fields: Fields{Title: "title", Poem: "poem", Poet: "poet", Language: "language"},
+			tags:   TagsRule{Column: "tags", Pattern: "[^,]+,[^,]+"},
+			poem: db.Poem{Dataset: "kaggle-odes", DatasetId: " 7 ", Title: "  Ode ", Poem: "\tVerse\n", Poet: " Keats ", Language: "english",
+				Tags: []string{" Living,Death ", " Nature,Love"}},
+		},
+		{
+			name:   "trimmed fields only",
+			fields: Fields{Title: "title", Poem: "poem", Poet: "poet"},
+			tags:   TagsRule{Column: "tags", Pattern: "[^,]+,[^,]+"},
+			trim:   []string{"title", "poem", "tags"},
+			poem: db.Poem{Dataset: "kaggle-odes", DatasetId: " 7 ", Title: "Ode", Poem: "Verse", Poet: " Keats ", Language: "french",
+				Tags: []string{"Living,Death", "Nature,Love"}},
+		},
+		{
+			name:   "json values",
+			fields: Fields{Title: "number", Poem: "poem"},
+			tags:   TagsRule{Column: "list"},
+			trim:   []string{"poem"},
+			poem:   db.Poem{Dataset: "kaggle-odes", DatasetId: " 7 ", Title: "42", Poem: "Verse", Language: "french", Tags: []string{"love", "night"}},
+		},
+		{
+			name:   "missing columns",
+			fields: Fields{Title: "absent", Poem: "poem"},
+			poem:   db.Poem{Dataset: "kaggle-odes", DatasetId: " 7 ", Poem: "\tVerse\n", Language: "french"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Descriptor{Name: "odes", Dataset: "kaggle-odes", Path: "odes.json", Format: formatJSON, Language: "french",
+				ID: "id", Fields: tt.fields, Tags: tt.tags, Trim: tt.trim}
+			require.NoError(t, d.validate())
+			assert.Equal(t, tt.poem, d.poem(rec))
+		})
+	}
+}
@@ -1,117 +1,54 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"poetry/db"
-	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 var DATAPATH = "cmd/parse_csv/data"
 
-func customSplit(input string) []string {
-	re := regexp.MustCompile(`[^,]+,[^,]+`)
-	result := re.FindAllString(input, -1)
-	return result
-}
-
-func createCSVReader(filePath string) (*csv.Reader, *os.File, error) {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		log.Fatal("Error getting current working directory:", err)
-	}
-
-	file, err := os.Open(filepath.Join(currentDir, DATAPATH, filePath))
-
-	if err != nil {
-		return nil, nil, err
-	}
-
-	reader := csv.NewReader(file)
-	_, err = reader.Read()
-
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return reader, file, nil
-}
-
-func importPoetryFoundation(mongoDBConnection db.MongoDBConnection) bool {
-	path := "PoetryFoundationData.csv"
-	reader, file, err := createCSVReader(path)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	for {
-		record, err := reader.Read()
-
-		if err != nil {
-			break
-		}
-
-		tags := customSplit(record[4])
-
-		poem := db.Poem{
-			Dataset:   "kaggle-poetry-foundations-poems",
-			DatasetId: record[0],
-			Title:     strings.TrimSpace(record[1]),
-			Poem:      strings.TrimSpace(record[2]),
-			Poet:      record[3],
-			Tags:      tags,
-			Language:  "english",
-		}
+// onDuplicate decides whether re-imported poems are skipped or updated.
+var onDuplicate = db.SkipDuplicates
 
-		db.InsertOnePoemIntoDB(mongoDBConnection, poem)
-	}
-	file.Close()
-	return true
-}
-
-func importChineseOneLine(mongoDBConnection db.MongoDBConnection) bool {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		log.Fatal("Error getting current working directory:", err)
-	}
-
-	filePath := filepath.Join(currentDir, DATAPATH, "/chinese_poetry_dataset_one_line_per_poem/poems_with_tags.json")
-	jsonData, err := os.ReadFile(filePath)
-	if err != nil {
-		fmt.Println("Error reading JSON file:", err)
-		return false
-	}
-
-	var poems []db.ChineseOneLinePoem
-	if jsonErr := json.Unmarshal(jsonData, &poems); jsonErr != nil {
-		log.Fatal("Error unmarshalling JSON:", jsonErr)
-	}
-
-	var documents []interface{}
-
-	// Iterate over the songs
-	for _, poem := range poems {
-		poem := db.Poem{
-			Dataset:  "chinese-poetry-one-line-kaggle",
-			Poem:     poem.Line,
-			Tags:     poem.Tags,
-			Language: "chinese",
-		}
-		documents = append(documents, poem)
-	}
+// totals accumulates the outcome of every save during an import. Batches
+// are saved concurrently, so it is guarded by totalsMu.
+var (
+	totals   db.UpsertResult
+	totalsMu sync.Mutex
+)
 
-	collection := mongoDBConnection.Client.Database("poetry").Collection("poems")
-	db.InsertManyIntoDB(*collection, documents)
-	return true
+// savePoems upserts poems, keeping re-runs of an importer from storing the
+// same poem twice. Poems rejected one by one are logged and counted; any
+// other error is returned.
+func savePoems(mongoDBConnection db.MongoDBConnection, poems ...db.Poem) (db.UpsertResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := db.UpsertPoems(ctx, &mongoDBConnection, poems, onDuplicate)
+	totalsMu.Lock()
+	totals.Add(result)
+	totalsMu.Unlock()
+
+	// Poems rejected one by one do not stop the rest of the import.
+	var rejected *db.PoemWriteError
+	if errors.As(err, &rejected) {
+		log.Printf("Skipping rejected poems: %v", err)
+		return result, nil
+	}
+	return result, err
 }
 
-func importEurovision(mongoDBConnection db.MongoDBConnection) bool {
+func importEurovision(sink importSink) bool {
 	currentDir, err := os.Getwd()
 	if err != nil {
 		log.Fatal("Error getting current working directory:", err)
@@ -126,8 +63,6 @@ func importEurovision(mongoDBConnection db.MongoDBConnection) bool {
 		return false
 	}
 
-	var documents []interface{}
-
 	for _, path := range files {
 		fmt.Println("Processing file:", path)
 
@@ -141,9 +76,14 @@ func importEurovision(mongoDBConnection db.MongoDBConnection) bool {
 		if jsonErr := json.Unmarshal(jsonData, &songs); jsonErr != nil {
 			log.Fatal("Error unmarshalling JSON:", jsonErr)
 		}
+		if err := sink.StartFile(path); err != nil {
+			log.Fatal(err)
+		}
 
-		// Iterate over the songs
-		for key, song := range songs {
+		// Iterate over the songs in a stable order, so a resumed run skips
+		// the songs the previous run saved
+		for _, key := range sortedNames(songs) {
+			song := songs[key]
 			poem := db.Poem{
 				Dataset:   "eurovision-kaggle",
 				DatasetId: key,
@@ -153,7 +93,10 @@ func importEurovision(mongoDBConnection db.MongoDBConnection) bool {
 				Tags:      []string{song.Year},
 				Language:  strings.ToLower(song.Language),
 			}
-			documents = append(documents, poem)
+			if err := sink.Add(poem); err != nil {
+				fmt.Printf("Failed to import %s: %v\n", path, err)
+				return false
+			}
 
 			// Some songs don't have translation, like UK songs
 			if song.Language != song.LyricsTranslation {
@@ -166,162 +109,93 @@ func importEurovision(mongoDBConnection db.MongoDBConnection) bool {
 					Tags:      []string{song.Year},
 					Language:  "english",
 				}
-				documents = append(documents, poem)
+				if err := sink.Add(poem); err != nil {
+					fmt.Printf("Failed to import %s: %v\n", path, err)
+					return false
+				}
 			}
 		}
-		collection := mongoDBConnection.Client.Database("poetry").Collection("poems")
-		db.InsertManyIntoDB(*collection, documents)
 	}
 
 	return true
 }
 
-func importCollectionOfPoetry(mongoDBConnection db.MongoDBConnection) bool {
-	path := "collection_of_poetry/poems.csv"
-	reader, file, err := createCSVReader(path)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	for {
-		record, err := reader.Read()
-
-		if err != nil {
-			break
-		}
-
-		poem := db.Poem{
-			Dataset:   "kaggle-collection-of-poems",
-			DatasetId: record[0],
-			Title:     record[1],
-			Poem:      record[7],
-			Poet:      record[2],
-			Language:  "english",
-		}
-
-		db.InsertOnePoemIntoDB(mongoDBConnection, poem)
-	}
-	file.Close()
-	return true
+// importers are the datasets that need code, as each Eurovision song gives
+// a poem in its original language and one in English. Every other dataset
+// is described by a Descriptor.
+var importers = map[string]func(sink importSink) bool{
+	"eurovision": importEurovision,
 }
 
-func importPoemsData(mongoDBConnection db.MongoDBConnection) bool {
-	path := "poems_data/gutenberg-poetry-dataset.csv"
-	reader, file, err := createCSVReader(path)
-
+func main() {
+	duplicateMode := flag.String("on-duplicate", string(db.SkipDuplicates), "what to do with poems already stored: skip or update")
+	descriptorDir := flag.String("datasets", "", "directory of extra dataset descriptors (.yaml or .json)")
+	descriptorFile := flag.String("descriptor", "", "import the dataset described by this file")
+	batchSize := flag.Int("batch-size", 500, "number of poems saved in one write")
+	writers := flag.Int("writers", 4, "number of concurrent batch writers")
+	maxErrors := flag.Int("max-errors", 100, "malformed rows skipped before the import fails, -1 for no limit")
+	dryRun := flag.Bool("dry-run", false, "read and map the dataset and print a report without saving anything")
+	resume := flag.Bool("resume", false, "continue files whose last import did not complete after their last committed row")
+	flag.Parse()
+
+	descriptors, err := loadDescriptors(*descriptorDir)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for {
-		record, err := reader.Read()
-
+	dataset := flag.Arg(0)
+	if *descriptorFile != "" {
+		descriptor, err := loadDescriptorFile(*descriptorFile)
 		if err != nil {
-			break
+			log.Fatal(err)
 		}
-
-		poem := db.Poem{
-			Dataset:   "kaggle-poems-data-gutenberg",
-			DatasetId: record[1],
-			Title:     record[4],
-			Poem:      record[2],
-			Poet:      record[3],
-			Language:  "english",
+		descriptors[descriptor.Name] = descriptor
+		if dataset == "" {
+			dataset = descriptor.Name
 		}
-
-		db.InsertOnePoemIntoDB(mongoDBConnection, poem)
 	}
-	file.Close()
-	return true
-}
-
-func importRussianPoetryCorpus(mongoDBConnection db.MongoDBConnection) bool {
-	path := "russian_poetry_corpus/russianPoetryWithTheme.csv"
-	reader, file, err := createCSVReader(path)
 
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	for {
-		record, err := reader.Read()
-
-		if err != nil {
-			break
+	if dataset == "" {
+		fmt.Println("You must pass dataset argument")
+		fmt.Println("Pass one of the following keys to import dataset:")
+		for _, key := range sortedNames(importers) {
+			fmt.Printf("%s\n", key)
 		}
-
-		poem := db.Poem{
-			Dataset:  "kaggle-russian-poetry-corpus",
-			Title:    record[3],
-			Poem:     record[2],
-			Poet:     record[0],
-			Language: "russian",
+		for _, key := range sortedNames(descriptors) {
+			fmt.Printf("%s\n", key)
 		}
-
-		db.InsertOnePoemIntoDB(mongoDBConnection, poem)
+		return
 	}
-	err = file.Close()
 
+	mode, err := db.ParseDuplicateMode(*duplicateMode)
 	if err != nil {
 		log.Fatal(err)
 	}
+	onDuplicate = mode
 
-	return true
-}
-
-func importArabicPoetryDataset(mongoDBConnection db.MongoDBConnection) bool {
-	path := "Arabic_Poetry_Dataset.csv"
-	reader, file, err := createCSVReader(path)
-
-	if err != nil {
-		log.Fatal(err)
+	if *batchSize < 1 || *writers < 1 {
+		log.Fatal("-batch-size and -writers must be at least 1")
 	}
 
-	for {
-		record, err := reader.Read()
-
-		if err != nil {
-			break
+	importer, ok := importers[dataset]
+	if !ok {
+		descriptor, found := descriptors[dataset]
+		if !found {
+			log.Fatalf("Unknown dataset %q", dataset)
 		}
-
-		poem := db.Poem{
-			Dataset:   "kaggle-arabic-dataset",
-			DatasetId: record[1],
-			Title:     record[3],
-			Poem:      record[4],
-			Poet:      record[0],
-			Language:  "arabic",
+		importer = func(sink importSink) bool {
+			return importDescriptor(sink, descriptor)
 		}
-
-		db.InsertOnePoemIntoDB(mongoDBConnection, poem)
 	}
-	file.Close()
-	return true
-}
-
-var datasets = map[string]func(connection db.MongoDBConnection) bool{
-	"poetry_foundation":     importPoetryFoundation,
-	"chinese_one_line":      importChineseOneLine,
-	"eurovision":            importEurovision,
-	"collection_of_poetry":  importCollectionOfPoetry,
-	"poems_data":            importPoemsData,
-	"russian_poetry_corpus": importRussianPoetryCorpus,
-	"arabic_poetry_dataset": importArabicPoetryDataset,
-}
 
-func main() {
-	if len(os.Args) == 1 {
-		fmt.Println("You must pass dataset argument")
-		fmt.Println("Pass one of the following keys to import dataset:")
-		for key, _ := range datasets {
-			fmt.Printf("%s\n", key)
-		}
+	if *dryRun {
+		fmt.Println("Dry run of collection:", dataset)
+		report := newDryRunReport()
+		report.Close(importer(report))
 		return
 	}
 
-	fmt.Println("Importing collection:", os.Args[1])
-	dataset := os.Args[1]
+	fmt.Println("Importing collection:", dataset)
 
 	mongoDBConnection, err := db.NewMongoDBConnection()
 	if err != nil {
@@ -329,8 +203,17 @@ func main() {
 	}
 	defer mongoDBConnection.Disconnect()
 
-	result := datasets[dataset](*mongoDBConnection)
+	if err := db.EnsurePoemIndexes(context.Background(), mongoDBConnection); err != nil {
+		log.Fatalf("Failed to create duplicate detection indexes: %v", err)
+	}
+
+	pipeline := newImportPipeline(*mongoDBConnection, dataset, *resume, *batchSize, *writers, *maxErrors)
+	result := importer(pipeline)
+	if err := pipeline.Close(result); err != nil {
+		fmt.Printf("Dataset %s import failed: %v\n", dataset, err)
+		return
+	}
 	if result {
-		fmt.Printf("Dataset %s imported\n", dataset)
+		fmt.Printf("Dataset %s imported: %d new, %d updated, %d skipped, %d failed\n", dataset, totals.New, totals.Updated, totals.Skipped, totals.Failed)
 	}
 }
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"poetry/db"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often the progress line is refreshed.
+const progressInterval = 2 * time.Second
+
+// importPipeline saves poems in batches written by concurrent writers. The
+// batch queue holds one batch per writer, so a reader faster than Mongo
+// waits instead of buffering the whole dataset. Every file is recorded in
+// the imports ledger, and with resume set a file whose last run did not
+// complete continues after its last committed row. A batch that cannot be
+// saved fails the pipeline: the writers drop the batches after it and the
+// reader is stopped by the error Add returns.
+type importPipeline struct {
+	connection db.MongoDBConnection
+	save       func(poems []db.Poem) (db.UpsertResult, error)
+	dataset    string
+	resume     bool
+	maxErrors  int
+	malformed  int
+	batchSize  int
+	batches    chan importBatch
+	current    importBatch
+	runs       []*fileRun
+	writers    sync.WaitGroup
+	failed     chan struct{}
+	failOnce   sync.Once
+	err        error
+
+	started    time.Time
+	rows       atomic.Int64
+	bytesRead  atomic.Int64
+	totalBytes atomic.Int64
+	stop       chan struct{}
+	reported   chan struct{}
+}
+
+// importBatch holds the poems of the file rows first to last. Malformed
+// rows in between have no poem but are covered by the batch all the same.
+type importBatch struct {
+	run       *fileRun
+	first     int64
+	last      int64
+	poems     []db.Poem
+	malformed int64
+}
+
+func newImportPipeline(connection db.MongoDBConnection, dataset string, resume bool, batchSize, writers, maxErrors int) *importPipeline {
+	p := &importPipeline{
+		connection: connection,
+		save: func(poems []db.Poem) (db.UpsertResult, error) {
+			return savePoems(connection, poems...)
+		},
+		dataset:   dataset,
+		resume:    resume,
+		maxErrors: maxErrors,
+		batchSize: batchSize,
+		batches:   make(chan importBatch, writers),
+		failed:    make(chan struct{}),
+		started:   time.Now(),
+		stop:      make(chan struct{}),
+		reported:  make(chan struct{}),
+	}
+	for i := 0; i < writers; i++ {
+		p.writers.Add(1)
+		go func() {
+			defer p.writers.Done()
+			for batch := range p.batches {
+				// Rows after a failed batch must not be committed.
+				if p.failure() != nil {
+					continue
+				}
+				var result db.UpsertResult
+				if len(batch.poems) > 0 {
+					var err error
+					if result, err = p.save(batch.poems); err != nil {
+						p.fail(fmt.Errorf("failed to save rows %d-%d of %s: %v", batch.first, batch.last, batch.run.record.File, err))
+						continue
+					}
+				}
+				batch.run.commit(p.connection, batch, result)
+			}
+		}()
+	}
+	go p.report()
+	return p
+}
+
+// StartFile records the import of the file at path, whose poems are added
+// next, in the ledger. When resuming, the rows its unfinished run committed
+// are skipped.
+func (p *importPipeline) StartFile(path string) error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	name := path
+	if currentDir, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(filepath.Join(currentDir, DATAPATH), path); err == nil {
+			name = rel
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	record := db.NewImportRun(p.dataset, name, checksum)
+	previous, err := db.FindUnfinishedImportRun(ctx, &p.connection, p.dataset, name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case previous == nil:
+	case previous.Checksum != checksum:
+		log.Printf("%s changed since run %s stopped, importing it from the start", name, previous.ID)
+	case !p.resume:
+		log.Printf("Run %s of %s stopped after row %d, pass -resume to continue it", previous.ID, name, previous.LastCommittedRow)
+	default:
+		log.Printf("Resuming run %s of %s after row %d", previous.ID, name, previous.LastCommittedRow)
+		record = previous
+		record.Status = db.ImportRunning
+		record.ResumedFrom = record.LastCommittedRow
+		record.SkippedRows = record.LastCommittedRow
+		record.RowsRead = 0
+	}
+
+	if err := db.SaveImportRun(ctx, &p.connection, record); err != nil {
+		return err
+	}
+	run := &fileRun{
+		record:  record,
+		skip:    record.LastCommittedRow,
+		flushed: record.LastCommittedRow,
+		pending: make(map[int64]committedBatch),
+	}
+	p.runs = append(p.runs, run)
+	p.current = importBatch{run: run}
+	return nil
+}
+
+// Add queues the next poem of the current file, handing a full batch to the
+// writers. It returns the error of a failed writer.
+func (p *importPipeline) Add(poem db.Poem) error {
+	run := p.current.run
+	if run == nil {
+		panic("importPipeline.Add called before StartFile")
+	}
+	if err := p.failure(); err != nil {
+		return err
+	}
+	p.rows.Add(1)
+	run.rows++
+	if run.rows <= run.skip {
+		return nil
+	}
+
+	if len(p.current.poems) == 0 {
+		p.current.poems = make([]db.Poem, 0, p.batchSize)
+	}
+	p.current.poems = append(p.current.poems, poem)
+	if len(p.current.poems) >= p.batchSize {
+		return p.flush()
+	}
+	return nil
+}
+
+// Malformed logs and skips a row that cannot be read. The import fails
+// once more than maxErrors rows are skipped, unless maxErrors is negative,
+// since so many bad rows hint at a wrong descriptor rather than a few
+// broken lines. Rows committed by the run being resumed were counted by
+// that run and are not counted again.
+func (p *importPipeline) Malformed(err error) error {
+	if run := p.current.run; run != nil {
+		run.rows++
+		if run.rows <= run.skip {
+			return nil
+		}
+		log.Printf("Skipping malformed row %d of %s: %v", run.rows, run.record.File, err)
+		p.current.malformed++
+	}
+	p.malformed++
+	if p.maxErrors >= 0 && p.malformed > p.maxErrors {
+		return fmt.Errorf("more than %d malformed rows, last: %v", p.maxErrors, err)
+	}
+	return nil
+}
+
+// flush hands the current batch to the writers. It covers every row read
+// since the previous batch, so the rows committed stay contiguous; a file
+// ending in malformed rows ends in a batch without poems.
+func (p *importPipeline) flush() error {
+	run := p.current.run
+	if run == nil || run.rows <= run.flushed {
+		return p.failure()
+	}
+	p.current.first, p.current.last = run.flushed+1, run.rows
+	run.flushed = run.rows
+	select {
+	case p.batches <- p.current:
+	case <-p.failed:
+		return p.failure()
+	}
+	p.current = importBatch{run: run}
+	return nil
+}
+
+// fail stops the pipeline with the first writer error.
+func (p *importPipeline) fail(err error) {
+	p.failOnce.Do(func() {
+		p.err = err
+		close(p.failed)
+	})
+}
+
+// failure returns the error that stopped the pipeline, if any.
+func (p *importPipeline) failure() error {
+	select {
+	case <-p.failed:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// Close saves the last batch, waits for the writers, marks the runs
+// completed or, unless ok, failed and prints the final count. It returns
+// the error of a failed writer, which fails the runs as well.
+func (p *importPipeline) Close(ok bool) error {
+	p.flush()
+	close(p.batches)
+	p.writers.Wait()
+
+	err := p.failure()
+	status := db.ImportCompleted
+	if !ok || err != nil {
+		status = db.ImportFailed
+	}
+	for _, run := range p.runs {
+		run.finish(p.connection, status)
+	}
+
+	close(p.stop)
+	<-p.reported
+
+	elapsed := time.Since(p.started)
+	fmt.Fprintf(os.Stderr, "\rRead %d rows in %s (%.0f rows/s), skipped %d malformed rows\n", p.rows.Load(), elapsed.Round(time.Second), rate(p.rows.Load(), elapsed), p.malformed)
+	return err
+}
+
+// ExpectBytes adds n to the bytes to read, which the ETA is based on.
+func (p *importPipeline) ExpectBytes(n int64) {
+	p.totalBytes.Add(n)
+}
+
+// CountBytes returns r counting what is read from it towards the ETA.
+func (p *importPipeline) CountBytes(r io.Reader) io.Reader {
+	return &countingReader{reader: r, count: &p.bytesRead}
+}
+
+// report refreshes the progress line until the pipeline is closed.
+func (p *importPipeline) report() {
+	defer close(p.reported)
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			fmt.Fprintf(os.Stderr, "\r%s", p.progress(time.Since(p.started)))
+		}
+	}
+}
+
+// progress describes the rows read so far, their rate and, once enough of
+// the input is read, the estimated time left.
+func (p *importPipeline) progress(elapsed time.Duration) string {
+	rows := p.rows.Load()
+	line := fmt.Sprintf("Rows: %d (%.0f rows/s)", rows, rate(rows, elapsed))
+
+	read, total := p.bytesRead.Load(), p.totalBytes.Load()
+	if read > 0 && total > read {
+		eta := time.Duration(float64(elapsed) * float64(total-read) / float64(read))
+		line += fmt.Sprintf(", %.0f%%, ETA %s", 100*float64(read)/float64(total), eta.Round(time.Second))
+	}
+	return line + "   "
+}
+
+func rate(rows int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(rows) / elapsed.Seconds()
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  *atomic.Int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.count.Add(int64(n))
+	return n, err
+}
+
+// fileRun follows the rows of one file through the writers. Batches finish
+// in any order, so a batch saved ahead of the others waits in pending until
+// every row before it is saved, keeping LastCommittedRow a safe place to
+// resume from.
+type fileRun struct {
+	// rows counts the file rows read, malformed ones included, skip the
+	// rows committed by the run being resumed and flushed the last row
+	// handed to the writers. They are only used by the reader.
+	rows    int64
+	skip    int64
+	flushed int64
+
+	mu      sync.Mutex
+	record  *db.ImportRun
+	pending map[int64]committedBatch
+}
+
+type committedBatch struct {
+	last      int64
+	rows      int64
+	poems     int64
+	malformed int64
+	result    db.UpsertResult
+}
+
+// commit records that the rows of batch are saved.
+func (r *fileRun) commit(connection db.MongoDBConnection, batch importBatch, result db.UpsertResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending[batch.first] = committedBatch{
+		last:      batch.last,
+		rows:      batch.last - batch.first + 1,
+		poems:     int64(len(batch.poems)),
+		malformed: batch.malformed,
+		result:    result,
+	}
+	advanced := false
+	for {
+		batch, ok := r.pending[r.record.LastCommittedRow+1]
+		if !ok {
+			break
+		}
+		delete(r.pending, r.record.LastCommittedRow+1)
+		r.record.LastCommittedRow = batch.last
+		r.record.RowsRead += batch.rows
+		r.record.PoemsSaved += batch.poems
+		r.record.MalformedRows += batch.malformed
+		r.record.Result.Add(batch.result)
+		advanced = true
+	}
+	if advanced {
+		r.save(connection)
+	}
+}
+
+func (r *fileRun) finish(connection db.MongoDBConnection, status db.ImportStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.record.Status = status
+	r.record.FinishedAt = &now
+	r.save(connection)
+}
+
+// save writes the run to the ledger. A failure is logged rather than fatal,
+// as it only costs the ability to resume.
+func (r *fileRun) save(connection db.MongoDBConnection) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := db.SaveImportRun(ctx, &connection, r.record); err != nil {
+		log.Printf("Failed to record import progress: %v", err)
+	}
+}
+
+// fileChecksum returns the SHA-256 of the file at path, telling whether a
+// file changed since an earlier run.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
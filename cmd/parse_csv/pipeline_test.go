@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"poetry/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// readerPipeline returns a pipeline without writers, reading a file whose
+// previous run committed its first skip rows. Flushed batches stay queued.
+func readerPipeline(skip int64, batchSize, maxErrors int) (*importPipeline, *fileRun) {
+	run := &fileRun{
+		record:  &db.ImportRun{ID: "run", File: "odes.csv", LastCommittedRow: skip, ResumedFrom: skip},
+		skip:    skip,
+		flushed: skip,
+		pending: make(map[int64]committedBatch),
+	}
+	p := &importPipeline{
+		batchSize: batchSize,
+		maxErrors: maxErrors,
+		batches:   make(chan importBatch, 10),
+		current:   importBatch{run: run},
+		runs:      []*fileRun{run},
+	}
+	return p, run
+}
+
+// queuedBatches closes the batch queue of p and returns what it holds.
+func queuedBatches(p *importPipeline) []importBatch {
+	p.flush()
+	close(p.batches)
+	var batches []importBatch
+	for batch := range p.batches {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// savedRun returns the import run written by the last command of mt.
+func savedRun(mt *mtest.T) db.ImportRun {
+	var run db.ImportRun
+	raw := mt.GetStartedEvent().Command.Lookup("updates", "0", "u").Document()
+	require.NoError(mt, bson.Unmarshal(raw, &run))
+	return run
+}
+
+func TestImportPipelineBatchesCoverFileRows(t *testing.T) {
+	p, run := readerPipeline(0, 2, -1)
+	p.Add(db.Poem{Title: "1"})
+	require.NoError(t, p.Malformed(errors.New("bare quote")))
+	p.Add(db.Poem{Title: "3"})
+	p.Add(db.Poem{Title: "4"})
+	require.NoError(t, p.Malformed(errors.New("bare quote")))
+
+	batches := queuedBatches(p)
+	require.Len(t, batches, 2)
+	assert.Equal(t, [2]int64{1, 3}, [2]int64{batches[0].first, batches[0].last})
+	assert.Equal(t, []db.Poem{{Title: "1"}, {Title: "3"}}, batches[0].poems)
+	// The trailing malformed row belongs to the last batch.
+	assert.Equal(t, [2]int64{4, 5}, [2]int64{batches[1].first, batches[1].last})
+	assert.Equal(t, int64(5), run.rows)
+}
+
+func TestImportPipelineResumeSkipsCommittedRows(t *testing.T) {
+	// Rows 1 to 3 were committed before the import stopped, row 2 being
+	// malformed. The file is read again from its first row.
+	p, _ := readerPipeline(3, 2, -1)
+	p.Add(db.Poem{Title: "1"})
+	require.NoError(t, p.Malformed(errors.New("bare quote")))
+	p.Add(db.Poem{Title: "3"})
+	p.Add(db.Poem{Title: "4"})
+	p.Add(db.Poem{Title: "5"})
+	p.Add(db.Poem{Title: "6"})
+
+	batches := queuedBatches(p)
+	require.Len(t, batches, 2)
+	assert.Equal(t, int64(4), batches[0].first)
+	assert.Equal(t, []db.Poem{{Title: "4"}, {Title: "5"}}, batches[0].poems)
+	assert.Equal(t, []db.Poem{{Title: "6"}}, batches[1].poems)
+	assert.Equal(t, int64(6), batches[1].last)
+}
+
+func TestFileRunCommitOutOfOrder(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("batches finishing early wait for the rows before them", func(mt *mtest.T) {
+		connection := db.MongoDBConnection{Client: mt.Client, Database: "poetry"}
+		p, run := readerPipeline(0, 2, -1)
+		for _, title := range []string{"1", "2", "4", "5", "6"} {
+			if title == "4" {
+				require.NoError(mt, p.Malformed(errors.New("bare quote")))
+			}
+			p.Add(db.Poem{Title: title})
+		}
+		batches := queuedBatches(p)
+		require.Len(mt, batches, 3)
+
+		run.commit(connection, batches[2], db.UpsertResult{New: 1})
+		run.commit(connection, batches[1], db.UpsertResult{New: 2})
+		assert.Empty(mt, mt.GetAllStartedEvents(), "nothing is committed before the first batch")
+		assert.Equal(mt, int64(0), run.record.LastCommittedRow)
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		run.commit(connection, batches[0], db.UpsertResult{New: 2})
+		saved := savedRun(mt)
+		assert.Equal(mt, int64(6), saved.LastCommittedRow, "malformed row 3 counts as a file row")
+		assert.Equal(mt, int64(6), saved.RowsRead)
+		assert.Equal(mt, int64(5), saved.PoemsSaved)
+		assert.Equal(mt, db.UpsertResult{New: 5}, saved.Result)
+		assert.Equal(mt, int64(1), saved.MalformedRows)
+		assert.Empty(mt, run.pending)
+	})
+}
+
+func TestImportPipelineMaxErrorsAcrossResume(t *testing.T) {
+	// Rows 2 and 3 were skipped as malformed by the run being resumed, which
+	// committed rows 1 to 3. Only the rows after them count towards the
+	// limit of one malformed row.
+	p, run := readerPipeline(3, 10, 1)
+	run.record.MalformedRows = 2
+	p.Add(db.Poem{Title: "1"})
+	require.NoError(t, p.Malformed(errors.New("bare quote")))
+	require.NoError(t, p.Malformed(errors.New("bare quote")))
+	p.Add(db.Poem{Title: "4"})
+	require.NoError(t, p.Malformed(errors.New("bare quote")))
+	assert.Equal(t, 1, p.malformed)
+	assert.ErrorContains(t, p.Malformed(errors.New("bare quote")), "more than 1 malformed rows")
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("the ledger counts each malformed row once", func(mt *mtest.T) {
+		connection := db.MongoDBConnection{Client: mt.Client, Database: "poetry"}
+		batches := queuedBatches(p)
+		require.Len(mt, batches, 1)
+		assert.Equal(mt, [2]int64{4, 6}, [2]int64{batches[0].first, batches[0].last})
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		run.commit(connection, batches[0], db.UpsertResult{New: 1})
+		saved := savedRun(mt)
+		assert.Equal(mt, int64(6), saved.LastCommittedRow)
+		assert.Equal(mt, int64(4), saved.MalformedRows)
+		assert.Equal(mt, int64(3), saved.RowsRead, "rows committed by the resumed run are not read again")
+		assert.Equal(mt, int64(1), saved.PoemsSaved)
+	})
+}
+
+func TestImportPipelineFlushesTrailingMalformedRows(t *testing.T) {
+	p, _ := readerPipeline(0, 10, -1)
+	p.flush()
+	p.Add(db.Poem{Title: "1"})
+	p.flush()
+	require.NoError(t, p.Malformed(errors.New("bare quote")))
+
+	batches := queuedBatches(p)
+	require.Len(t, batches, 2)
+	assert.Equal(t, importBatch{run: batches[1].run, first: 2, last: 2, malformed: 1}, batches[1])
+}
+
+// writerPipeline returns a pipeline with writers saving through save into a
+// run of odes.csv.
+func writerPipeline(connection db.MongoDBConnection, batchSize, writers int, save func([]db.Poem) (db.UpsertResult, error)) (*importPipeline, *fileRun) {
+	p := newImportPipeline(connection, "odes", false, batchSize, writers, -1)
+	p.save = save
+	run := &fileRun{
+		record:  &db.ImportRun{ID: "run", File: "odes.csv"},
+		pending: make(map[int64]committedBatch),
+	}
+	p.runs = append(p.runs, run)
+	p.current = importBatch{run: run}
+	return p, run
+}
+
+func TestImportPipelineConcurrentWriters(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("all batches are saved and committed", func(mt *mtest.T) {
+		connection := db.MongoDBConnection{Client: mt.Client, Database: "poetry"}
+		for i := 0; i < 11; i++ {
+			mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		}
+
+		var mu sync.Mutex
+		var saved []string
+		p, run := writerPipeline(connection, 2, 3, func(poems []db.Poem) (db.UpsertResult, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, poem := range poems {
+				saved = append(saved, poem.Title)
+			}
+			return db.UpsertResult{New: int64(len(poems))}, nil
+		})
+		p.ExpectBytes(400)
+		_, err := io.Copy(io.Discard, p.CountBytes(strings.NewReader(strings.Repeat("x", 100))))
+		require.NoError(mt, err)
+
+		for i := 1; i <= 20; i++ {
+			require.NoError(mt, p.Add(db.Poem{Title: strconv.Itoa(i)}))
+		}
+		assert.Equal(mt, "Rows: 20 (2 rows/s), 25%, ETA 30s   ", p.progress(10*time.Second))
+
+		require.NoError(mt, p.Close(true))
+		assert.Len(mt, saved, 20)
+		assert.Equal(mt, int64(20), run.record.LastCommittedRow)
+		assert.Equal(mt, db.UpsertResult{New: 20}, run.record.Result)
+		assert.Equal(mt, db.ImportCompleted, run.record.Status)
+	})
+
+	mt.Run("a failed batch stops the reader and fails the run", func(mt *mtest.T) {
+		connection := db.MongoDBConnection{Client: mt.Client, Database: "poetry"}
+		for i := 0; i < 3; i++ {
+			mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		}
+
+		p, run := writerPipeline(connection, 2, 2, func(poems []db.Poem) (db.UpsertResult, error) {
+			if poems[0].Title == "3" {
+				return db.UpsertResult{}, errors.New("connection reset")
+			}
+			return db.UpsertResult{New: int64(len(poems))}, nil
+		})
+		for i := 1; i <= 4; i++ {
+			require.NoError(mt, p.Add(db.Poem{Title: strconv.Itoa(i)}))
+		}
+		<-p.failed
+
+		err := p.Add(db.Poem{Title: "5"})
+		require.Error(mt, err)
+		assert.Contains(mt, err.Error(), "rows 3-4 of odes.csv")
+
+		assert.Equal(mt, err, p.Close(false))
+		assert.Less(mt, run.record.LastCommittedRow, int64(3))
+		assert.Equal(mt, db.ImportFailed, run.record.Status)
+	})
+}
+
+func TestImportPipelineStartFileResumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "odes.csv")
+	require.NoError(t, os.WriteFile(path, []byte("title,poem\n"), 0o644))
+	checksum, err := fileChecksum(path)
+	require.NoError(t, err)
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("counts the rows of the earlier run as skipped", func(mt *mtest.T) {
+		connection := db.MongoDBConnection{Client: mt.Client, Database: "poetry"}
+		raw, err := bson.Marshal(db.ImportRun{
+			ID: "run", File: "odes.csv", Checksum: checksum, Status: db.ImportFailed,
+			LastCommittedRow: 40, RowsRead: 40, PoemsSaved: 38, MalformedRows: 2,
+		})
+		require.NoError(mt, err)
+		var previous bson.D
+		require.NoError(mt, bson.Unmarshal(raw, &previous))
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "poetry.imports", mtest.FirstBatch, previous),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		p := newImportPipeline(connection, "odes", true, 10, 1, -1)
+		require.NoError(mt, p.StartFile(path))
+		require.NoError(mt, p.Close(true))
+
+		record := p.runs[0].record
+		assert.Equal(mt, int64(40), record.SkippedRows)
+		assert.Equal(mt, int64(0), record.RowsRead)
+		assert.Equal(mt, int64(38), record.PoemsSaved)
+		assert.Equal(mt, int64(40), record.ResumedFrom)
+		assert.Equal(mt, db.ImportCompleted, record.Status)
+	})
+}
@@ -1,26 +1,28 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"poetry/config"
 	"poetry/db"
 	"poetry/worker"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 func main() {
-	// Get configuration from environment variables or use defaults
-	bufferSize := getEnvInt("WORKER_BUFFER_SIZE", 10)
-	maxWorkers := getEnvInt("WORKER_MAX_WORKERS", 3)
-	port := getEnvString("WORKER_PORT", "8081")
+	cfg := config.GetConfig().Worker
 
-	log.Printf("Starting worker service on port %s with buffer size %d and %d workers", port, bufferSize, maxWorkers)
+	log.Printf("Starting worker service on port %s with buffer size %d and %d workers", cfg.Port, cfg.BufferSize, cfg.MaxWorkers)
 
 	// Connect to MongoDB
 	mongoDBConnection, err := db.NewMongoDBConnection()
@@ -29,32 +31,79 @@ func main() {
 	}
 	defer mongoDBConnection.Disconnect()
 
+	if err := db.EnsurePoemIndexes(context.Background(), mongoDBConnection); err != nil {
+		log.Fatalf("Failed to create duplicate detection indexes: %v", err)
+	}
+
+	// Uploads are streamed from the API, so reading a job body may take
+	// much longer than reading its headers.
+	server := &http.Server{
+		Addr:              ":" + cfg.Port,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       5 * time.Minute,
+		WriteTimeout:      5 * time.Minute,
+	}
+
 	// Create and start worker
-	w := worker.NewWorker(mongoDBConnection, bufferSize, maxWorkers)
+	options := []worker.Option{
+		worker.WithJobStore(worker.NewMongoJobStore(mongoDBConnection)),
+		worker.WithHTTPServer(server),
+		worker.WithShutdownTimeout(cfg.ShutdownTimeout.Duration),
+		worker.WithDrainQueue(cfg.DrainQueue),
+		worker.WithDeadLetterStore(worker.NewMongoDeadLetterStore(mongoDBConnection)),
+		worker.WithBatchSize(cfg.BatchSize),
+		worker.WithRetryPolicy(worker.RetryPolicy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: cfg.RetryBackoff.Duration,
+			MaxBackoff:     cfg.MaxBackoff.Duration,
+		}),
+	}
+	switch cfg.Queue {
+	case "memory":
+	case "mongo":
+		queue, err := worker.NewMongoQueue(context.Background(), mongoDBConnection, worker.MongoQueueOptions{
+			VisibilityTimeout: cfg.VisibilityTimeout.Duration,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up job queue: %v", err)
+		}
+		options = append(options, worker.WithQueue(queue))
+	}
+	log.Printf("Using %s job queue", cfg.Queue)
+
+	w := worker.NewWorker(mongoDBConnection, cfg.BufferSize, cfg.MaxWorkers, options...)
 	w.Start()
 
+	// Job endpoints only answer the API, which sends the shared secret
+	if cfg.Secret == "" {
+		log.Println("WORKER_SECRET is not set, job endpoints accept unauthenticated requests")
+	}
+
 	// Set up HTTP server for receiving jobs
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
 		statusHandler(rw, r, w)
 	})
-	http.HandleFunc("/jobs", func(rw http.ResponseWriter, r *http.Request) {
-		jobHandler(rw, r, w)
-	})
+	http.HandleFunc("/jobs", worker.RequireSecret(cfg.Secret, func(rw http.ResponseWriter, r *http.Request) {
+		jobHandler(rw, r, w, cfg.BatchSize)
+	}))
+	http.HandleFunc("/jobs/", worker.RequireSecret(cfg.Secret, func(rw http.ResponseWriter, r *http.Request) {
+		jobStatusHandler(rw, r, w)
+	}))
+	http.HandleFunc("/dead-letters", worker.RequireSecret(cfg.Secret, func(rw http.ResponseWriter, r *http.Request) {
+		deadLettersHandler(rw, r, w)
+	}))
+	http.HandleFunc("/dead-letters/", worker.RequireSecret(cfg.Secret, func(rw http.ResponseWriter, r *http.Request) {
+		requeueHandler(rw, r, w)
+	}))
 
 	// Set up graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
-	server := &http.Server{
-		Addr:         ":" + port,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-	}
-
 	// Start server in a goroutine
 	go func() {
-		log.Printf("Worker HTTP server listening on port %s", port)
+		log.Printf("Worker HTTP server listening on port %s", cfg.Port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start HTTP server: %v", err)
 		}
@@ -64,8 +113,15 @@ func main() {
 	<-quit
 	log.Println("Shutting down worker service...")
 
-	// Stop worker gracefully
-	w.Stop()
+	// Stop worker gracefully, which also shuts down the HTTP server
+	report := w.Stop()
+	if !report.Drained {
+		log.Printf("Worker stopped with work left undone: %d jobs in flight %v, %d dropped %v",
+			len(report.InFlight), report.InFlight, len(report.Dropped), report.Dropped)
+	}
+	if report.Queued > 0 {
+		log.Printf("%d jobs remain queued for the next worker", report.Queued)
+	}
 
 	log.Println("Worker service stopped")
 }
@@ -80,55 +136,206 @@ func statusHandler(w http.ResponseWriter, r *http.Request, worker *worker.Worker
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"queue_size": worker.GetQueueSize(),
-		"timestamp":  time.Now().Unix(),
+		"queue_size":     worker.GetQueueSize(),
+		"completed_jobs": worker.GetCompletedJobs(),
+		"failed_jobs":    worker.GetFailedJobs(),
+		"timestamp":      time.Now().Unix(),
 	})
 }
 
-func jobHandler(w http.ResponseWriter, r *http.Request, worker *worker.Worker) {
-	if r.Method != http.MethodPost {
+func jobHandler(w http.ResponseWriter, r *http.Request, wk *worker.Worker, batchSize int) {
+	switch r.Method {
+	case http.MethodGet:
+		listJobsHandler(w, r, wk)
+	case http.MethodPost:
+		submitJobHandler(w, r, wk, batchSize)
+	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseLimit reads the limit query parameter of list endpoints
+func parseLimit(r *http.Request) (int, error) {
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			return 0, fmt.Errorf("limit must be between 1 and 100")
+		}
+		limit = parsed
+	}
+	return limit, nil
+}
+
+func listJobsHandler(w http.ResponseWriter, r *http.Request, wk *worker.Worker) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var poems []db.Poem
-	if err := json.NewDecoder(r.Body).Decode(&poems); err != nil {
-		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+	jobs, err := wk.ListJobs(r.Context(), worker.JobState(r.URL.Query().Get("state")), limit)
+	if err != nil {
+		log.Printf("Failed to list jobs: %v", err)
+		http.Error(w, "Failed to list jobs", http.StatusInternalServerError)
 		return
 	}
 
-	if len(poems) == 0 {
-		http.Error(w, "No poems provided", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"jobs": jobs})
+}
+
+func jobStatusHandler(w http.ResponseWriter, r *http.Request, wk *worker.Worker) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	job, err := wk.GetJob(r.Context(), id)
+	if errors.Is(err, worker.ErrJobNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		log.Printf("Failed to load job %s: %v", id, err)
+		http.Error(w, "Failed to load job", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
 
-	err := worker.AddJob(poems)
+// submitJobHandler reads the JSON array of poems one element at a time and
+// hands them to the worker in chunks of batchSize, so an upload is never
+// decoded into memory as a whole.
+func submitJobHandler(w http.ResponseWriter, r *http.Request, wk *worker.Worker, batchSize int) {
+	mode, err := db.ParseDuplicateMode(r.URL.Query().Get("on_duplicate"))
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	decoder := json.NewDecoder(r.Body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		http.Error(w, "Invalid JSON: expected an array of poems", http.StatusBadRequest)
+		return
+	}
+
+	var decodeErr error
+	next := func() ([]db.Poem, error) {
+		var poems []db.Poem
+		for len(poems) < batchSize && decoder.More() {
+			var poem db.Poem
+			if err := decoder.Decode(&poem); err != nil {
+				decodeErr = err
+				return nil, err
+			}
+			poems = append(poems, poem)
+		}
+		if len(poems) > 0 {
+			return poems, nil
+		}
+		if _, err := decoder.Token(); err != nil {
+			decodeErr = err
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	job, err := wk.SubmitStream(worker.Job{OnDuplicate: mode}, next)
+	if decodeErr != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", decodeErr), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, worker.ErrNoPoems) {
+		http.Error(w, "No poems provided", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, worker.ErrQueueFull) || errors.Is(err, worker.ErrWorkerStopped) {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	if err != nil {
+		log.Printf("Failed to submit job: %v", err)
+		http.Error(w, "Failed to submit job", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":    "Job accepted",
-		"poem_count": len(poems),
-		"queue_size": worker.GetQueueSize(),
+		"job_id":     job.ID,
+		"status_url": "/jobs/" + job.ID,
+		"poem_count": job.PoemCount,
+		"queue_size": wk.GetQueueSize(),
 	})
 }
 
-func getEnvString(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+func deadLettersHandler(w http.ResponseWriter, r *http.Request, wk *worker.Worker) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	letters, err := wk.ListDeadLetters(r.Context(), limit)
+	if err != nil {
+		log.Printf("Failed to list dead letters: %v", err)
+		http.Error(w, "Failed to list dead letters", http.StatusInternalServerError)
+		return
 	}
-	return defaultValue
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"dead_letters": letters})
 }
 
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
-		}
+// requeueHandler serves POST /dead-letters/{id}/requeue
+func requeueHandler(w http.ResponseWriter, r *http.Request, wk *worker.Worker) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/dead-letters/"), "/requeue")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, err := wk.Requeue(r.Context(), id)
+	if errors.Is(err, worker.ErrDeadLetterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, worker.ErrQueueFull) || errors.Is(err, worker.ErrWorkerStopped) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to requeue dead letter %s: %v", id, err)
+		http.Error(w, "Failed to requeue job", http.StatusInternalServerError)
+		return
 	}
-	return defaultValue
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Job requeued",
+		"job_id":     job.ID,
+		"status_url": "/jobs/" + job.ID,
+		"poem_count": job.PoemCount,
+	})
 }
@@ -1,41 +1,262 @@
 package config
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Config is the configuration of every poetry service. Values come from,
+// in increasing priority, the defaults, the file named by CONFIG_FILE, a
+// .env file and the environment.
 type Config struct {
-	DbHost     string
-	DbPort     string
-	DbName     string
-	DbUser     string
-	DbPass     string
-	ElasticUrl string
+	API           APIConfig           `yaml:"api" toml:"api"`
+	Worker        WorkerConfig        `yaml:"worker" toml:"worker"`
+	Mongo         MongoConfig         `yaml:"mongo" toml:"mongo"`
+	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch" toml:"elasticsearch"`
+	Indexing      IndexingConfig      `yaml:"indexing" toml:"indexing"`
 }
 
-func NewConfig() *Config {
-	//if err := godotenv.Load(); err != nil {
-	//	log.Fatalf("error loading .env file: %v", err)
-	//}
+// APIConfig configures the HTTP API. ReadLimit and WriteLimit apply per API
+// key, except on the public read routes, which take no key and are limited
+// per client IP. AuthLimit throttles each client IP before its API key is
+// checked, so requests with bad or missing keys are limited too.
+// TrustedProxies lists the proxy addresses or CIDRs whose X-Forwarded-For
+// header names the client; none are trusted by default.
+type APIConfig struct {
+	Port           string          `yaml:"port" toml:"port" env:"PORT"`
+	AdminAPIKey    string          `yaml:"admin_api_key" toml:"admin_api_key" env:"ADMIN_API_KEY"`
+	WorkerTimeout  Duration        `yaml:"worker_timeout" toml:"worker_timeout" env:"API_WORKER_TIMEOUT"`
+	RateLimitStore string          `yaml:"rate_limit_store" toml:"rate_limit_store" env:"RATE_LIMIT_STORE"`
+	ReadLimit      RateLimitConfig `yaml:"read_limit" toml:"read_limit" env:"RATE_LIMIT_READ"`
+	WriteLimit     RateLimitConfig `yaml:"write_limit" toml:"write_limit" env:"RATE_LIMIT_WRITE"`
+	AuthLimit      RateLimitConfig `yaml:"auth_limit" toml:"auth_limit" env:"RATE_LIMIT_AUTH"`
+	TrustedProxies []string        `yaml:"trusted_proxies" toml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+}
+
+// RateLimitConfig is a token bucket of Burst requests refilled at RPS
+// requests per second. A zero RPS disables the limit.
+type RateLimitConfig struct {
+	RPS   float64 `yaml:"rps" toml:"rps" env:"RPS"`
+	Burst int     `yaml:"burst" toml:"burst" env:"BURST"`
+}
+
+// WorkerConfig configures the worker service and how the API reaches it.
+type WorkerConfig struct {
+	Host              string   `yaml:"host" toml:"host" env:"WORKER_HOST"`
+	Port              string   `yaml:"port" toml:"port" env:"WORKER_PORT"`
+	Secret            string   `yaml:"secret" toml:"secret" env:"WORKER_SECRET"`
+	Queue             string   `yaml:"queue" toml:"queue" env:"WORKER_QUEUE"`
+	BufferSize        int      `yaml:"buffer_size" toml:"buffer_size" env:"WORKER_BUFFER_SIZE"`
+	MaxWorkers        int      `yaml:"max_workers" toml:"max_workers" env:"WORKER_MAX_WORKERS"`
+	BatchSize         int      `yaml:"batch_size" toml:"batch_size" env:"WORKER_BATCH_SIZE"`
+	VisibilityTimeout Duration `yaml:"visibility_timeout" toml:"visibility_timeout" env:"WORKER_VISIBILITY_TIMEOUT"`
+	ShutdownTimeout   Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"WORKER_SHUTDOWN_TIMEOUT"`
+	DrainQueue        bool     `yaml:"drain_queue" toml:"drain_queue" env:"WORKER_DRAIN_QUEUE"`
+	MaxAttempts       int      `yaml:"max_attempts" toml:"max_attempts" env:"WORKER_MAX_ATTEMPTS"`
+	RetryBackoff      Duration `yaml:"retry_backoff" toml:"retry_backoff" env:"WORKER_RETRY_BACKOFF_MS" unit:"ms"`
+	MaxBackoff        Duration `yaml:"max_backoff" toml:"max_backoff" env:"WORKER_MAX_BACKOFF"`
+}
+
+// URL is the address the API sends jobs to.
+func (c WorkerConfig) URL() string {
+	return fmt.Sprintf("http://%s:%s", c.Host, c.Port)
+}
+
+// MongoConfig configures the MongoDB connection.
+type MongoConfig struct {
+	Host           string   `yaml:"host" toml:"host" env:"DB_HOST"`
+	Port           string   `yaml:"port" toml:"port" env:"DB_PORT"`
+	Database       string   `yaml:"database" toml:"database" env:"DB_NAME"`
+	User           string   `yaml:"user" toml:"user" env:"DB_USER"`
+	Password       string   `yaml:"password" toml:"password" env:"DB_PASS"`
+	ConnectTimeout Duration `yaml:"connect_timeout" toml:"connect_timeout" env:"DB_CONNECT_TIMEOUT"`
+}
+
+// URI is the connection string of the configured server. Credentials are
+// left out when no user is set.
+func (c MongoConfig) URI() string {
+	if c.User == "" {
+		return fmt.Sprintf("mongodb://%s:%s", c.Host, c.Port)
+	}
+	return fmt.Sprintf("mongodb://%s:%s@%s:%s", url.QueryEscape(c.User), url.QueryEscape(c.Password), c.Host, c.Port)
+}
+
+// ElasticsearchConfig configures the Elasticsearch client.
+type ElasticsearchConfig struct {
+	URL string `yaml:"url" toml:"url" env:"ELASTIC_URL,ELASTICSEARCH_URL"`
+}
+
+// IndexingConfig configures bulk indexing into Elasticsearch.
+type IndexingConfig struct {
+	Workers    int `yaml:"workers" toml:"workers" env:"INDEXING_WORKERS"`
+	Retries    int `yaml:"retries" toml:"retries" env:"INDEXING_RETRIES"`
+	FlushBytes int `yaml:"flush_bytes" toml:"flush_bytes" env:"INDEXING_FLUSH_BYTES"`
+}
+
+// Duration is a time.Duration read from strings such as "30s" or "5m". A
+// bare number is a count of seconds.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := parseDuration(string(text), time.Second)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// parseDuration parses a duration, reading a bare number in unit.
+func parseDuration(value string, unit time.Duration) (time.Duration, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(n) * unit, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return duration, nil
+}
+
+// Defaults returns the configuration used for values that are not set.
+// Mongo's host and database and Elasticsearch's URL have no default.
+func Defaults() Config {
+	return Config{
+		API: APIConfig{
+			Port:           "8080",
+			WorkerTimeout:  Duration{30 * time.Second},
+			RateLimitStore: "memory",
+			ReadLimit:      RateLimitConfig{RPS: 10, Burst: 20},
+			WriteLimit:     RateLimitConfig{RPS: 1, Burst: 5},
+			AuthLimit:      RateLimitConfig{RPS: 5, Burst: 20},
+		},
+		Worker: WorkerConfig{
+			Host:              "localhost",
+			Port:              "8081",
+			Queue:             "memory",
+			BufferSize:        10,
+			MaxWorkers:        3,
+			BatchSize:         1000,
+			VisibilityTimeout: Duration{5 * time.Minute},
+			ShutdownTimeout:   Duration{30 * time.Second},
+			MaxAttempts:       3,
+			RetryBackoff:      Duration{time.Second},
+			MaxBackoff:        Duration{30 * time.Second},
+		},
+		Mongo: MongoConfig{
+			Port:           "27017",
+			ConnectTimeout: Duration{10 * time.Second},
+		},
+		Indexing: IndexingConfig{
+			Workers:    4,
+			Retries:    3,
+			FlushBytes: 5 * 1024 * 1024,
+		},
+	}
+}
+
+// Validate reports every invalid or missing value at once.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Mongo.Host != "", "mongo.host is required (DB_HOST)")
+	check(c.Mongo.Database != "", "mongo.database is required (DB_NAME)")
+	check(isPort(c.Mongo.Port), "mongo.port %q is not a port number (DB_PORT)", c.Mongo.Port)
+	check(c.Mongo.Password == "" || c.Mongo.User != "", "mongo.password is set without mongo.user (DB_USER)")
+	check(c.Mongo.ConnectTimeout.Duration > 0, "mongo.connect_timeout must be positive (DB_CONNECT_TIMEOUT)")
+
+	check(isPort(c.API.Port), "api.port %q is not a port number (PORT)", c.API.Port)
+	check(c.API.WorkerTimeout.Duration > 0, "api.worker_timeout must be positive (API_WORKER_TIMEOUT)")
+	check(c.API.RateLimitStore == "memory" || c.API.RateLimitStore == "mongo",
+		"api.rate_limit_store %q must be memory or mongo (RATE_LIMIT_STORE)", c.API.RateLimitStore)
+	for _, limit := range []struct {
+		name, env string
+		config    RateLimitConfig
+	}{
+		{"read_limit", "RATE_LIMIT_READ", c.API.ReadLimit},
+		{"write_limit", "RATE_LIMIT_WRITE", c.API.WriteLimit},
+		{"auth_limit", "RATE_LIMIT_AUTH", c.API.AuthLimit},
+	} {
+		check(limit.config.RPS >= 0, "api.%s.rps must not be negative (%s_RPS)", limit.name, limit.env)
+		check(limit.config.RPS == 0 || limit.config.Burst >= 1, "api.%s.burst must be at least 1 (%s_BURST)", limit.name, limit.env)
+	}
+
+	check(c.Worker.Host != "", "worker.host is required (WORKER_HOST)")
+	check(isPort(c.Worker.Port), "worker.port %q is not a port number (WORKER_PORT)", c.Worker.Port)
+	check(c.Worker.Queue == "memory" || c.Worker.Queue == "mongo", "worker.queue %q must be memory or mongo (WORKER_QUEUE)", c.Worker.Queue)
+	check(c.Worker.BufferSize >= 0, "worker.buffer_size must not be negative (WORKER_BUFFER_SIZE)")
+	check(c.Worker.MaxWorkers >= 1, "worker.max_workers must be at least 1 (WORKER_MAX_WORKERS)")
+	check(c.Worker.BatchSize >= 1, "worker.batch_size must be at least 1 (WORKER_BATCH_SIZE)")
+	check(c.Worker.MaxAttempts >= 1, "worker.max_attempts must be at least 1 (WORKER_MAX_ATTEMPTS)")
+	check(c.Worker.VisibilityTimeout.Duration > 0, "worker.visibility_timeout must be positive (WORKER_VISIBILITY_TIMEOUT)")
+	check(c.Worker.ShutdownTimeout.Duration > 0, "worker.shutdown_timeout must be positive (WORKER_SHUTDOWN_TIMEOUT)")
+	check(c.Worker.RetryBackoff.Duration >= 0, "worker.retry_backoff must not be negative (WORKER_RETRY_BACKOFF_MS)")
+	check(c.Worker.MaxBackoff.Duration >= c.Worker.RetryBackoff.Duration, "worker.max_backoff must not be below worker.retry_backoff (WORKER_MAX_BACKOFF)")
 
-	return &Config{
-		DbHost:     os.Getenv("DB_HOST"),
-		DbPort:     os.Getenv("DB_PORT"),
-		DbName:     os.Getenv("DB_NAME"),
-		DbUser:     os.Getenv("DB_USER"),
-		DbPass:     os.Getenv("DB_PASS"),
-		ElasticUrl: os.Getenv("ELASTIC_URL"),
+	check(c.Indexing.Workers >= 1, "indexing.workers must be at least 1 (INDEXING_WORKERS)")
+	check(c.Indexing.Retries >= 0, "indexing.retries must not be negative (INDEXING_RETRIES)")
+	check(c.Indexing.FlushBytes >= 1, "indexing.flush_bytes must be at least 1 (INDEXING_FLUSH_BYTES)")
+
+	if c.Elasticsearch.URL != "" {
+		check(isURL(c.Elasticsearch.URL), "elasticsearch.url %q is not an http(s) URL (ELASTIC_URL)", c.Elasticsearch.URL)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// RequireElasticsearch checks the Elasticsearch settings, for the services
+// that search or index.
+func (c *Config) RequireElasticsearch() error {
+	if c.Elasticsearch.URL == "" {
+		return errors.New("invalid configuration: elasticsearch.url is required (ELASTIC_URL or ELASTICSEARCH_URL)")
 	}
+	return nil
 }
 
+func isPort(value string) bool {
+	port, err := strconv.Atoi(value)
+	return err == nil && port > 0 && port < 65536
+}
+
+func isURL(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+var (
+	once     sync.Once
+	instance *Config
+)
+
+// GetConfig loads the configuration on first use and exits when it is
+// invalid, as no service can run without it.
 func GetConfig() *Config {
-	var (
-		once     sync.Once
-		instance *Config
-	)
 	once.Do(func() {
-		instance = NewConfig()
+		cfg, err := Load()
+		if err != nil {
+			log.Fatal(err)
+		}
+		instance = cfg
 	})
 	return instance
 }
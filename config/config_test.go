@@ -0,0 +1,170 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFile writes content to name in a temporary directory.
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+// setEnv sets the variables for the test, clearing the ones set to "".
+func setEnv(t *testing.T, vars map[string]string) {
+	for _, name := range []string{"CONFIG_FILE", "DB_HOST", "DB_PORT", "DB_NAME", "DB_USER", "DB_PASS", "ELASTIC_URL", "ELASTICSEARCH_URL"} {
+		t.Setenv(name, "")
+	}
+	for name, value := range vars {
+		t.Setenv(name, value)
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	setEnv(t, map[string]string{"DB_HOST": "db", "DB_NAME": "poetry"})
+
+	cfg, err := load(filepath.Join(t.TempDir(), ".env"))
+	require.NoError(t, err)
+
+	expected := Defaults()
+	expected.Mongo.Host = "db"
+	expected.Mongo.Database = "poetry"
+	assert.Equal(t, &expected, cfg)
+	assert.Error(t, cfg.RequireElasticsearch())
+}
+
+func TestLoadReportsMissingValues(t *testing.T) {
+	setEnv(t, map[string]string{"WORKER_QUEUE": "redis", "WORKER_MAX_WORKERS": "0"})
+
+	_, err := load(filepath.Join(t.TempDir(), ".env"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mongo.host is required (DB_HOST)")
+	assert.Contains(t, err.Error(), "mongo.database is required (DB_NAME)")
+	assert.Contains(t, err.Error(), `worker.queue "redis" must be memory or mongo`)
+	assert.Contains(t, err.Error(), "worker.max_workers must be at least 1")
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "poetry.yaml", `
+mongo:
+  host: file-host
+  database: file-db
+  port: "27018"
+worker:
+  queue: mongo
+  shutdown_timeout: 1m
+api:
+  read_limit:
+    rps: 2.5
+`)
+	envFile := writeFile(t, ".env", "DB_HOST=dotenv-host\nDB_NAME=dotenv-db\nWORKER_BATCH_SIZE=50\n")
+	setEnv(t, map[string]string{"CONFIG_FILE": file, "DB_HOST": "env-host", "RATE_LIMIT_READ_BURST": "7"})
+
+	cfg, err := load(envFile)
+	require.NoError(t, err)
+
+	assert.Equal(t, "env-host", cfg.Mongo.Host)
+	assert.Equal(t, "dotenv-db", cfg.Mongo.Database)
+	assert.Equal(t, "27018", cfg.Mongo.Port)
+	assert.Equal(t, "mongo", cfg.Worker.Queue)
+	assert.Equal(t, time.Minute, cfg.Worker.ShutdownTimeout.Duration)
+	assert.Equal(t, 50, cfg.Worker.BatchSize)
+	assert.Equal(t, RateLimitConfig{RPS: 2.5, Burst: 7}, cfg.API.ReadLimit)
+}
+
+func TestLoadTOML(t *testing.T) {
+	file := writeFile(t, "poetry.toml", `
+[mongo]
+host = "toml-host"
+database = "poetry"
+
+[elasticsearch]
+url = "http://search:9200"
+
+[indexing]
+workers = 8
+`)
+	setEnv(t, map[string]string{"CONFIG_FILE": file})
+
+	cfg, err := load(filepath.Join(t.TempDir(), ".env"))
+	require.NoError(t, err)
+	assert.Equal(t, "toml-host", cfg.Mongo.Host)
+	assert.Equal(t, 8, cfg.Indexing.Workers)
+	assert.NoError(t, cfg.RequireElasticsearch())
+}
+
+func TestLoadRejectsBadInput(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+	}{
+		{"unknown file key", "mongo:\n  hots: db\n", nil},
+		{"unsupported file", "", map[string]string{"CONFIG_FILE": "poetry.json"}},
+		{"missing file", "", map[string]string{"CONFIG_FILE": "/does/not/exist.yaml"}},
+		{"bad integer", "", map[string]string{"WORKER_BATCH_SIZE": "many"}},
+		{"bad duration", "", map[string]string{"WORKER_SHUTDOWN_TIMEOUT": "soon"}},
+		{"bad url", "", map[string]string{"ELASTIC_URL": "search:9200"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"DB_HOST": "db", "DB_NAME": "poetry"}
+			if tt.file != "" {
+				env["CONFIG_FILE"] = writeFile(t, "poetry.yaml", tt.file)
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+
+			_, err := load(filepath.Join(t.TempDir(), ".env"))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestEnvDurationsAndAliases(t *testing.T) {
+	setEnv(t, map[string]string{
+		"DB_HOST":                   "db",
+		"DB_NAME":                   "poetry",
+		"WORKER_SHUTDOWN_TIMEOUT":   "45",
+		"WORKER_RETRY_BACKOFF_MS":   "250",
+		"WORKER_VISIBILITY_TIMEOUT": "2m",
+		"ELASTICSEARCH_URL":         "http://elasticsearch:9200",
+		"TRUSTED_PROXIES":           "10.0.0.1, 10.1.0.0/16,",
+		"RATE_LIMIT_AUTH_RPS":       "2.5",
+	})
+
+	cfg, err := load(filepath.Join(t.TempDir(), ".env"))
+	require.NoError(t, err)
+	assert.Equal(t, 45*time.Second, cfg.Worker.ShutdownTimeout.Duration)
+	assert.Equal(t, 250*time.Millisecond, cfg.Worker.RetryBackoff.Duration)
+	assert.Equal(t, 2*time.Minute, cfg.Worker.VisibilityTimeout.Duration)
+	assert.Equal(t, "http://elasticsearch:9200", cfg.Elasticsearch.URL)
+	assert.Equal(t, []string{"10.0.0.1", "10.1.0.0/16"}, cfg.API.TrustedProxies)
+	assert.Equal(t, RateLimitConfig{RPS: 2.5, Burst: 20}, cfg.API.AuthLimit)
+}
+
+func TestMongoURI(t *testing.T) {
+	mongo := MongoConfig{Host: "db", Port: "27017"}
+	assert.Equal(t, "mongodb://db:27017", mongo.URI())
+
+	mongo.User = "admin"
+	mongo.Password = "p@ss"
+	assert.Equal(t, "mongodb://admin:p%40ss@db:27017", mongo.URI())
+}
+
+func TestExampleFile(t *testing.T) {
+	setEnv(t, map[string]string{"CONFIG_FILE": "../config.example.yaml"})
+
+	cfg, err := load(filepath.Join(t.TempDir(), ".env"))
+	require.NoError(t, err)
+	assert.NoError(t, cfg.RequireElasticsearch())
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Load reads the configuration from the defaults, the YAML or TOML file
+// named by CONFIG_FILE, the .env file of the working directory and the
+// environment, then validates it.
+func Load() (*Config, error) {
+	return load(".env")
+}
+
+func load(envFile string) (*Config, error) {
+	dotenv, err := godotenv.Read(envFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read %s: %v", envFile, err)
+	}
+	// The environment takes precedence over .env, and empty values count as
+	// unset.
+	lookup := func(name string) (string, bool) {
+		if value := os.Getenv(name); value != "" {
+			return value, true
+		}
+		value := dotenv[name]
+		return value, value != ""
+	}
+
+	cfg := Defaults()
+	if path, ok := lookup("CONFIG_FILE"); ok {
+		if err := readFile(path, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), "", lookup); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// readFile decodes a YAML or TOML file, chosen by extension, over cfg.
+// Unknown keys are errors so typos do not go unnoticed.
+func readFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer f.Close()
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".toml":
+		err = toml.NewDecoder(f).DisallowUnknownFields().Decode(cfg)
+	default:
+		return fmt.Errorf("unsupported config file %s, expected .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(Duration{})
+
+// applyEnv sets the fields of v whose env tag names a variable that is set.
+// The env tag of a nested struct is a prefix for the variables of its
+// fields, and a tag may list alternative names separated by commas.
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		tag := field.Tag.Get("env")
+
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			nested := prefix
+			if tag != "" {
+				nested = envName(prefix, tag)
+			}
+			if err := applyEnv(v.Field(i), nested, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		if tag == "" {
+			continue
+		}
+
+		for _, name := range strings.Split(tag, ",") {
+			name = envName(prefix, name)
+			value, ok := lookup(name)
+			if !ok {
+				continue
+			}
+			if err := setField(v.Field(i), value, field.Tag.Get("unit")); err != nil {
+				return fmt.Errorf("invalid configuration: %s: %v", name, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func envName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "_" + name
+}
+
+// setField parses value into field. unit is the unit of a bare number set
+// on a Duration, seconds by default.
+func setField(field reflect.Value, value, unit string) error {
+	if field.Type() == durationType {
+		scale := time.Second
+		if unit == "ms" {
+			scale = time.Millisecond
+		}
+		duration, err := parseDuration(value, scale)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(Duration{duration}))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported field type %s", field.Type())
+		}
+		// A comma-separated list, where an empty value clears the list.
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// indexTimestampLayout is the suffix format of versioned index names.
+const indexTimestampLayout = "20060102150405"
+
+// indexNameReplacer strips characters Elasticsearch does not allow in index
+// names from dataset keys.
+var indexNameReplacer = strings.NewReplacer(
+	" ", "-", "\\", "-", "/", "-", "*", "-", "?", "-", "\"", "-",
+	"<", "-", ">", "-", "|", "-", ",", "-", "#", "-", ":", "-",
+)
+
+// datasetIndexPrefix returns the prefix shared by every versioned index built
+// for dataset behind alias.
+func datasetIndexPrefix(alias, dataset string) string {
+	return fmt.Sprintf("%s-%s-", alias, indexNameReplacer.Replace(strings.ToLower(dataset)))
+}
+
+// versionedIndexName returns a fresh index name for a reindex of dataset
+// started at t, e.g. poems-eurovision-kaggle-20240131120000.
+func versionedIndexName(alias, dataset string, t time.Time) string {
+	return datasetIndexPrefix(alias, dataset) + t.UTC().Format(indexTimestampLayout)
+}
+
+// isDatasetIndex reports whether indexName is a versioned index of dataset.
+// The timestamp check keeps a dataset whose key extends another one (foo and
+// foo-extra) from claiming its indices.
+func isDatasetIndex(indexName, alias, dataset string) bool {
+	suffix, found := strings.CutPrefix(indexName, datasetIndexPrefix(alias, dataset))
+	if !found || len(suffix) != len(indexTimestampLayout) {
+		return false
+	}
+	_, err := time.Parse(indexTimestampLayout, suffix)
+	return err == nil
+}
+
+// aliasIndices returns the names of the indices alias currently points to.
+// A missing alias yields an empty list.
+func aliasIndices(esClient *elasticsearch.Client, alias string) ([]string, error) {
+	response, err := esClient.Indices.GetAlias(esClient.Indices.GetAlias.WithName(alias))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if response.IsError() {
+		return nil, fmt.Errorf("error reading alias %s: %s", alias, response.String())
+	}
+
+	var aliases map[string]json.RawMessage
+	if err := json.NewDecoder(response.Body).Decode(&aliases); err != nil {
+		return nil, fmt.Errorf("failed to decode alias %s: %v", alias, err)
+	}
+
+	indices := make([]string, 0, len(aliases))
+	for index := range aliases {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+// datasetAliasIndices returns the versioned indices of dataset that alias
+// currently points to.
+func datasetAliasIndices(esClient *elasticsearch.Client, alias, dataset string) ([]string, error) {
+	indices, err := aliasIndices(esClient, alias)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []string
+	for _, index := range indices {
+		if isDatasetIndex(index, alias, dataset) {
+			matching = append(matching, index)
+		}
+	}
+	return matching, nil
+}
+
+// ensureNotConcreteIndex fails when name is a regular index rather than an
+// alias, since Elasticsearch cannot create an alias over an existing index.
+func ensureNotConcreteIndex(esClient *elasticsearch.Client, name string) error {
+	response, err := esClient.Indices.Exists([]string{name})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	indices, err := aliasIndices(esClient, name)
+	if err != nil {
+		return err
+	}
+	if len(indices) == 0 {
+		return fmt.Errorf("%s is an index, not an alias; delete it or pick another alias before reindexing", name)
+	}
+	return nil
+}
+
+// swapAlias points alias at addIndex and away from removeIndices in a single
+// atomic update, so readers never see a partially built index.
+func swapAlias(esClient *elasticsearch.Client, alias, addIndex string, removeIndices []string) error {
+	actions := []interface{}{
+		map[string]interface{}{"add": map[string]interface{}{"index": addIndex, "alias": alias}},
+	}
+	for _, index := range removeIndices {
+		actions = append(actions, map[string]interface{}{
+			"remove": map[string]interface{}{"index": index, "alias": alias},
+		})
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return fmt.Errorf("failed to encode alias actions: %v", err)
+	}
+
+	response, err := esClient.Indices.UpdateAliases(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.IsError() {
+		return fmt.Errorf("error moving alias %s to %s: %s", alias, addIndex, response.String())
+	}
+	return nil
+}
+
+// refreshIndex makes every document written to indexName visible to search
+// and count requests.
+func refreshIndex(esClient *elasticsearch.Client, indexName string) error {
+	response, err := esClient.Indices.Refresh(esClient.Indices.Refresh.WithIndex(indexName))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.IsError() {
+		return fmt.Errorf("error refreshing index %s: %s", indexName, response.String())
+	}
+	return nil
+}
+
+// countIndexDocuments returns the number of documents in indexName.
+func countIndexDocuments(esClient *elasticsearch.Client, indexName string) (int64, error) {
+	response, err := esClient.Count(esClient.Count.WithIndex(indexName))
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.IsError() {
+		return 0, fmt.Errorf("error counting documents in %s: %s", indexName, response.String())
+	}
+
+	var count struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&count); err != nil {
+		return 0, fmt.Errorf("failed to decode document count of %s: %v", indexName, err)
+	}
+	return count.Count, nil
+}
+
+// deleteIndices removes the given indices.
+func deleteIndices(esClient *elasticsearch.Client, indices []string) error {
+	if len(indices) == 0 {
+		return nil
+	}
+
+	response, err := esClient.Indices.Delete(indices)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.IsError() {
+		return fmt.Errorf("error deleting indices %s: %s", strings.Join(indices, ","), response.String())
+	}
+	return nil
+}
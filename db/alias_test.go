@@ -0,0 +1,61 @@
+package db
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionedIndexName(t *testing.T) {
+	at := time.Date(2024, 1, 31, 12, 0, 5, 0, time.UTC)
+
+	name := versionedIndexName("poems", "Kaggle Arabic/Dataset", at)
+
+	assert.Equal(t, "poems-kaggle-arabic-dataset-20240131120005", name)
+	assert.True(t, isDatasetIndex(name, "poems", "Kaggle Arabic/Dataset"))
+}
+
+func TestIsDatasetIndex(t *testing.T) {
+	assert.True(t, isDatasetIndex("poems-eurovision-kaggle-20240131120005", "poems", "eurovision-kaggle"))
+	assert.False(t, isDatasetIndex("poems-eurovision-kaggle-extra-20240131120005", "poems", "eurovision-kaggle"))
+	assert.False(t, isDatasetIndex("poems-eurovision-kaggle-latest", "poems", "eurovision-kaggle"))
+	assert.False(t, isDatasetIndex("books-eurovision-kaggle-20240131120005", "poems", "eurovision-kaggle"))
+}
+
+func TestDatasetAliasIndices(t *testing.T) {
+	client := newTestElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_alias/poems", r.URL.Path)
+		io.WriteString(w, `{
+			"poems-eurovision-kaggle-20240101000000": {"aliases": {"poems": {}}},
+			"poems-eurovision-kaggle-extra-20240101000000": {"aliases": {"poems": {}}},
+			"poems-kaggle-arabic-dataset-20240101000000": {"aliases": {"poems": {}}}
+		}`)
+	})
+
+	indices, err := datasetAliasIndices(client, "poems", "eurovision-kaggle")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"poems-eurovision-kaggle-20240101000000"}, indices)
+}
+
+func TestSwapAlias(t *testing.T) {
+	var actions struct {
+		Actions []map[string]map[string]string `json:"actions"`
+	}
+	client := newTestElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_aliases", r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&actions))
+		io.WriteString(w, `{"acknowledged": true}`)
+	})
+
+	err := swapAlias(client, "poems", "poems-a-20240201000000", []string{"poems-a-20240101000000"})
+	require.NoError(t, err)
+
+	require.Len(t, actions.Actions, 2)
+	assert.Equal(t, map[string]string{"index": "poems-a-20240201000000", "alias": "poems"}, actions.Actions[0]["add"])
+	assert.Equal(t, map[string]string{"index": "poems-a-20240101000000", "alias": "poems"}, actions.Actions[1]["remove"])
+}
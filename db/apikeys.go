@@ -0,0 +1,203 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidRole    = errors.New("invalid role")
+)
+
+// Role grants access to a group of endpoints. Each role includes the
+// permissions of the roles before it.
+type Role string
+
+const (
+	// RoleReader may follow jobs.
+	RoleReader Role = "reader"
+	// RoleContributor may also add and edit poems.
+	RoleContributor Role = "contributor"
+	// RoleAdmin may also delete poems and manage API keys.
+	RoleAdmin Role = "admin"
+)
+
+var roleRanks = map[Role]int{RoleReader: 1, RoleContributor: 2, RoleAdmin: 3}
+
+// ParseRole validates a role coming from a request.
+func ParseRole(value string) (Role, error) {
+	if _, ok := roleRanks[Role(value)]; !ok {
+		return "", fmt.Errorf("%w %q, expected %q, %q or %q", ErrInvalidRole, value, RoleReader, RoleContributor, RoleAdmin)
+	}
+	return Role(value), nil
+}
+
+// Allows reports whether r includes the permissions of required.
+func (r Role) Allows(required Role) bool {
+	return roleRanks[r] > 0 && roleRanks[r] >= roleRanks[required]
+}
+
+// APIKey is a stored API key. Only the hash of the key is kept; the key
+// itself is shown once, when it is created.
+type APIKey struct {
+	ID        string     `bson:"_id,omitempty" json:"id"`
+	Name      string     `bson:"name" json:"name"`
+	Role      Role       `bson:"role" json:"role"`
+	Prefix    string     `bson:"prefix" json:"prefix"`
+	Hash      string     `bson:"hash" json:"-"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	RevokedAt *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// apiKeyPrefixLength is how much of a key is stored in clear, so that keys
+// can be told apart in listings.
+const apiKeyPrefixLength = 8
+
+func apiKeysCollection(connection *MongoDBConnection) *mongo.Collection {
+	return connection.Client.Database(connection.Database).Collection("api_keys")
+}
+
+// HashAPIKey returns the stored form of key. Keys are long random strings,
+// so a plain SHA-256 is enough to make a leaked collection useless.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateAPIKey returns a new random API key.
+func GenerateAPIKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate api key: %v", err)
+	}
+	return "pk_" + hex.EncodeToString(secret), nil
+}
+
+func keyPrefix(key string) string {
+	if len(key) <= apiKeyPrefixLength {
+		return key
+	}
+	return key[:apiKeyPrefixLength]
+}
+
+// EnsureAPIKeyIndexes creates the unique index used to look keys up by hash.
+func EnsureAPIKeyIndexes(ctx context.Context, connection *MongoDBConnection) error {
+	_, err := apiKeysCollection(connection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetName("unique_hash").SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create api key indexes: %v", err)
+	}
+	return nil
+}
+
+// CreateAPIKey generates and stores a new key, returning its record and the
+// key itself.
+func CreateAPIKey(ctx context.Context, connection *MongoDBConnection, name string, role Role) (*APIKey, string, error) {
+	key, err := GenerateAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	record := APIKey{
+		Name:      name,
+		Role:      role,
+		Prefix:    keyPrefix(key),
+		Hash:      HashAPIKey(key),
+		CreatedAt: time.Now(),
+	}
+	result, err := apiKeysCollection(connection).InsertOne(ctx, record)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to save api key: %v", err)
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		record.ID = id.Hex()
+	}
+	return &record, key, nil
+}
+
+// EnsureAPIKey stores key with role unless it is already stored. It lets an
+// operator bootstrap the first admin key from configuration.
+func EnsureAPIKey(ctx context.Context, connection *MongoDBConnection, name, key string, role Role) error {
+	_, err := apiKeysCollection(connection).UpdateOne(ctx,
+		bson.D{{Key: "hash", Value: HashAPIKey(key)}},
+		bson.D{{Key: "$setOnInsert", Value: APIKey{
+			Name:      name,
+			Role:      role,
+			Prefix:    keyPrefix(key),
+			Hash:      HashAPIKey(key),
+			CreatedAt: time.Now(),
+		}}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save api key %s: %v", name, err)
+	}
+	return nil
+}
+
+// FindAPIKey returns the active key matching key.
+func FindAPIKey(ctx context.Context, connection *MongoDBConnection, key string) (*APIKey, error) {
+	var record APIKey
+	err := apiKeysCollection(connection).FindOne(ctx, bson.D{
+		{Key: "hash", Value: HashAPIKey(key)},
+		{Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}},
+	}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find api key: %v", err)
+	}
+	return &record, nil
+}
+
+// ListAPIKeys returns every key, including revoked ones, oldest first.
+func ListAPIKeys(ctx context.Context, connection *MongoDBConnection) ([]APIKey, error) {
+	cursor, err := apiKeysCollection(connection).Find(ctx, bson.D{},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %v", err)
+	}
+
+	keys := []APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, fmt.Errorf("failed to read api keys: %v", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey disables the key with id. Revoked keys stay listed.
+func RevokeAPIKey(ctx context.Context, connection *MongoDBConnection, id string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrAPIKeyNotFound
+	}
+
+	result, err := apiKeysCollection(connection).UpdateOne(ctx,
+		bson.D{
+			{Key: "_id", Value: objectID},
+			{Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: time.Now()}}}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key %s: %v", id, err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRole(t *testing.T) {
+	role, err := ParseRole("contributor")
+	assert.NoError(t, err)
+	assert.Equal(t, RoleContributor, role)
+
+	_, err = ParseRole("owner")
+	assert.ErrorIs(t, err, ErrInvalidRole)
+}
+
+func TestRoleAllows(t *testing.T) {
+	assert.True(t, RoleAdmin.Allows(RoleContributor))
+	assert.True(t, RoleContributor.Allows(RoleContributor))
+	assert.True(t, RoleContributor.Allows(RoleReader))
+	assert.False(t, RoleReader.Allows(RoleContributor))
+	assert.False(t, RoleContributor.Allows(RoleAdmin))
+	assert.False(t, Role("").Allows(RoleReader))
+}
+
+func TestGenerateAPIKey(t *testing.T) {
+	first, err := GenerateAPIKey()
+	require.NoError(t, err)
+	second, err := GenerateAPIKey()
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(first, "pk_"))
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, HashAPIKey(first), HashAPIKey(first))
+	assert.NotEqual(t, HashAPIKey(first), HashAPIKey(second))
+	assert.NotContains(t, HashAPIKey(first), first[3:])
+	assert.Equal(t, first[:apiKeyPrefixLength], keyPrefix(first))
+}
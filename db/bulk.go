@@ -0,0 +1,304 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// BulkOptions tunes a BulkIndexer. Zero values fall back to the defaults
+// below.
+type BulkOptions struct {
+	// Workers is the number of concurrent bulk requests.
+	Workers int
+	// FlushBytes is the body size at which a batch is sent.
+	FlushBytes int
+	// MaxRetries is how many times items rejected with 429 or 5xx are resent.
+	// Nil uses the default; zero or less disables retries.
+	MaxRetries *int
+	// RetryBackoff is the wait before the first retry; it doubles each time.
+	RetryBackoff time.Duration
+	// MaxFailureReasons caps the failures kept in the summary.
+	MaxFailureReasons int
+}
+
+const (
+	defaultBulkWorkers       = 4
+	defaultBulkFlushBytes    = 5 * 1024 * 1024
+	defaultBulkMaxRetries    = 3
+	defaultBulkRetryBackoff  = 500 * time.Millisecond
+	defaultMaxFailureReasons = 10
+)
+
+var errBulkIndexerClosed = errors.New("bulk indexer is closed")
+
+// BulkFailure describes a document Elasticsearch refused to index.
+type BulkFailure struct {
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// BulkSummary reports the outcome of a bulk indexing run. Failures holds at
+// most BulkOptions.MaxFailureReasons entries; Failed counts all of them.
+type BulkSummary struct {
+	Indexed  int64         `json:"indexed"`
+	Failed   int64         `json:"failed"`
+	Retried  int64         `json:"retried"`
+	Failures []BulkFailure `json:"failures,omitempty"`
+}
+
+type bulkItem struct {
+	id       string
+	document []byte
+}
+
+// BulkIndexer streams documents into an index through a fixed pool of bulk
+// writers. Add blocks while every writer is busy, so a slow cluster slows the
+// producer down instead of losing batches.
+type BulkIndexer struct {
+	client     *elasticsearch.Client
+	index      string
+	opts       BulkOptions
+	maxRetries int
+	batches    chan []bulkItem
+
+	current      []bulkItem
+	currentBytes int
+	closed       bool
+
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	summary BulkSummary
+}
+
+// NewBulkIndexer starts the writers of a BulkIndexer for index.
+func NewBulkIndexer(ctx context.Context, client *elasticsearch.Client, index string, opts BulkOptions) *BulkIndexer {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultBulkWorkers
+	}
+	if opts.FlushBytes <= 0 {
+		opts.FlushBytes = defaultBulkFlushBytes
+	}
+	maxRetries := defaultBulkMaxRetries
+	if opts.MaxRetries != nil {
+		maxRetries = max(*opts.MaxRetries, 0)
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultBulkRetryBackoff
+	}
+	if opts.MaxFailureReasons <= 0 {
+		opts.MaxFailureReasons = defaultMaxFailureReasons
+	}
+
+	indexer := &BulkIndexer{
+		client:     client,
+		index:      index,
+		opts:       opts,
+		maxRetries: maxRetries,
+		batches:    make(chan []bulkItem),
+	}
+
+	for i := 0; i < opts.Workers; i++ {
+		indexer.wg.Add(1)
+		go func() {
+			defer indexer.wg.Done()
+			for batch := range indexer.batches {
+				indexer.flush(ctx, batch)
+			}
+		}()
+	}
+
+	return indexer
+}
+
+// Add queues document for indexing under id. It is not safe for concurrent
+// use; a single producer is expected.
+func (b *BulkIndexer) Add(ctx context.Context, id string, document []byte) error {
+	if b.closed {
+		return errBulkIndexerClosed
+	}
+
+	b.current = append(b.current, bulkItem{id: id, document: document})
+	b.currentBytes += len(document)
+	if b.currentBytes < b.opts.FlushBytes {
+		return nil
+	}
+	return b.dispatch(ctx)
+}
+
+// dispatch hands the current batch to a writer, waiting for one to be free.
+func (b *BulkIndexer) dispatch(ctx context.Context) error {
+	if len(b.current) == 0 {
+		return nil
+	}
+
+	select {
+	case b.batches <- b.current:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	b.current = nil
+	b.currentBytes = 0
+	return nil
+}
+
+// Close sends any buffered documents, waits for the writers to finish and
+// returns the summary of the run.
+func (b *BulkIndexer) Close(ctx context.Context) (BulkSummary, error) {
+	if b.closed {
+		return b.summary, errBulkIndexerClosed
+	}
+	err := b.dispatch(ctx)
+	b.closed = true
+	close(b.batches)
+	b.wg.Wait()
+	return b.summary, err
+}
+
+// flush indexes batch, resending the items Elasticsearch rejected with a
+// retryable status until they succeed or the retries run out.
+func (b *BulkIndexer) flush(ctx context.Context, batch []bulkItem) {
+	pending := batch
+	backoff := b.opts.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		retry, status, reason := b.send(ctx, pending)
+		if len(retry) == 0 {
+			return
+		}
+
+		if attempt == b.maxRetries || ctx.Err() != nil {
+			for _, item := range retry {
+				b.recordFailure(BulkFailure{ID: item.id, Status: status[item.id], Reason: reason[item.id]})
+			}
+			return
+		}
+
+		b.mu.Lock()
+		b.summary.Retried += int64(len(retry))
+		b.mu.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+		pending = retry
+	}
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		ID     string `json:"_id"`
+		Status int    `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// send issues one bulk request and returns the items worth retrying along
+// with their last status and error reason. Permanent failures are recorded
+// directly.
+func (b *BulkIndexer) send(ctx context.Context, items []bulkItem) ([]bulkItem, map[string]int, map[string]string) {
+	status := map[string]int{}
+	reason := map[string]string{}
+	retryAll := func(code int, message string) ([]bulkItem, map[string]int, map[string]string) {
+		for _, item := range items {
+			status[item.id] = code
+			reason[item.id] = message
+		}
+		return items, status, reason
+	}
+
+	var body bytes.Buffer
+	for _, item := range items {
+		action, _ := json.Marshal(map[string]interface{}{
+			"index": map[string]string{"_index": b.index, "_id": item.id},
+		})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(item.document)
+		body.WriteByte('\n')
+	}
+
+	response, err := esapi.BulkRequest{
+		Index:   b.index,
+		Body:    &body,
+		Refresh: "false",
+	}.Do(ctx, b.client)
+	if err != nil {
+		return retryAll(0, err.Error())
+	}
+	defer response.Body.Close()
+
+	if response.IsError() {
+		if isRetryableStatus(response.StatusCode) {
+			return retryAll(response.StatusCode, response.String())
+		}
+		for _, item := range items {
+			b.recordFailure(BulkFailure{ID: item.id, Status: response.StatusCode, Reason: response.String()})
+		}
+		return nil, nil, nil
+	}
+
+	var decoded bulkResponse
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return retryAll(response.StatusCode, fmt.Sprintf("failed to decode bulk response: %v", err))
+	}
+	if len(decoded.Items) != len(items) {
+		return retryAll(response.StatusCode, fmt.Sprintf("bulk response has %d items, sent %d", len(decoded.Items), len(items)))
+	}
+
+	var retry []bulkItem
+	var indexed int64
+	for i, entry := range decoded.Items {
+		for _, result := range entry {
+			switch {
+			case result.Status >= 200 && result.Status < 300:
+				indexed++
+			case isRetryableStatus(result.Status):
+				retry = append(retry, items[i])
+				status[items[i].id] = result.Status
+				reason[items[i].id] = result.Error.Type + ": " + result.Error.Reason
+			default:
+				b.recordFailure(BulkFailure{
+					ID:     items[i].id,
+					Status: result.Status,
+					Reason: result.Error.Type + ": " + result.Error.Reason,
+				})
+			}
+		}
+	}
+
+	b.mu.Lock()
+	b.summary.Indexed += indexed
+	b.mu.Unlock()
+
+	return retry, status, reason
+}
+
+func (b *BulkIndexer) recordFailure(failure BulkFailure) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.summary.Failed++
+	if len(b.summary.Failures) < b.opts.MaxFailureReasons {
+		b.summary.Failures = append(b.summary.Failures, failure)
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bulkIDs returns the document IDs named in the action lines of a bulk body.
+func bulkIDs(t *testing.T, r *http.Request) []string {
+	var ids []string
+	scanner := bufio.NewScanner(r.Body)
+	for line := 0; scanner.Scan(); line++ {
+		if line%2 != 0 {
+			continue
+		}
+		var action map[string]map[string]string
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &action))
+		ids = append(ids, action["index"]["_id"])
+	}
+	return ids
+}
+
+func bulkItemsResponse(statuses map[string]int, ids []string) string {
+	var items []string
+	for _, id := range ids {
+		status := statuses[id]
+		if status == 0 {
+			status = 201
+		}
+		item := fmt.Sprintf(`{"index": {"_id": %q, "status": %d`, id, status)
+		if status >= 300 {
+			item += fmt.Sprintf(`, "error": {"type": "error_%d", "reason": "rejected %s"}`, status, id)
+		}
+		items = append(items, item+"}}")
+	}
+	return fmt.Sprintf(`{"errors": true, "items": [%s]}`, strings.Join(items, ","))
+}
+
+func TestBulkIndexerRetriesAndReportsFailures(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	client := newTestElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		ids := bulkIDs(t, r)
+
+		mu.Lock()
+		statuses := map[string]int{}
+		for _, id := range ids {
+			attempts[id]++
+			switch {
+			case id == "busy" && attempts[id] == 1:
+				statuses[id] = http.StatusTooManyRequests
+			case id == "broken":
+				statuses[id] = http.StatusBadRequest
+			case id == "down":
+				statuses[id] = http.StatusServiceUnavailable
+			}
+		}
+		mu.Unlock()
+
+		w.Write([]byte(bulkItemsResponse(statuses, ids)))
+	})
+
+	retries := 2
+	indexer := NewBulkIndexer(context.Background(), client, "poems-test", BulkOptions{
+		Workers:      2,
+		FlushBytes:   1,
+		MaxRetries:   &retries,
+		RetryBackoff: time.Millisecond,
+	})
+	for _, id := range []string{"ok", "busy", "broken", "down"} {
+		require.NoError(t, indexer.Add(context.Background(), id, []byte(`{"title":"`+id+`"}`)))
+	}
+	summary, err := indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(2), summary.Indexed)
+	assert.Equal(t, int64(2), summary.Failed)
+	// busy is retried once, down twice before giving up.
+	assert.Equal(t, int64(3), summary.Retried)
+	assert.Equal(t, 3, attempts["down"])
+	assert.Equal(t, 1, attempts["broken"])
+	assert.ElementsMatch(t, []BulkFailure{
+		{ID: "broken", Status: http.StatusBadRequest, Reason: "error_400: rejected broken"},
+		{ID: "down", Status: http.StatusServiceUnavailable, Reason: "error_503: rejected down"},
+	}, summary.Failures)
+}
+
+func TestBulkIndexerRetriesRejectedRequests(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	client := newTestElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		ids := bulkIDs(t, r)
+
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+
+		if first {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error": {"type": "es_rejected_execution_exception"}}`))
+			return
+		}
+		w.Write([]byte(bulkItemsResponse(nil, ids)))
+	})
+
+	indexer := NewBulkIndexer(context.Background(), client, "poems-test", BulkOptions{
+		Workers:      1,
+		RetryBackoff: time.Millisecond,
+	})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, indexer.Add(context.Background(), fmt.Sprint(i), []byte(`{}`)))
+	}
+	summary, err := indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(3), summary.Indexed)
+	assert.Equal(t, int64(3), summary.Retried)
+	assert.Zero(t, summary.Failed)
+	assert.Equal(t, 2, requests)
+}
+
+func TestBulkIndexerFailureReasonsAreCapped(t *testing.T) {
+	client := newTestElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		ids := bulkIDs(t, r)
+		statuses := map[string]int{}
+		for _, id := range ids {
+			statuses[id] = http.StatusBadRequest
+		}
+		w.Write([]byte(bulkItemsResponse(statuses, ids)))
+	})
+
+	indexer := NewBulkIndexer(context.Background(), client, "poems-test", BulkOptions{MaxFailureReasons: 2})
+	for i := 0; i < 5; i++ {
+		require.NoError(t, indexer.Add(context.Background(), fmt.Sprint(i), []byte(`{}`)))
+	}
+	summary, err := indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(5), summary.Failed)
+	assert.Len(t, summary.Failures, 2)
+
+	assert.ErrorIs(t, indexer.Add(context.Background(), "late", []byte(`{}`)), errBulkIndexerClosed)
+}
+
+func TestBulkIndexerZeroRetries(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	client := newTestElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": {"type": "es_rejected_execution_exception"}}`))
+	})
+
+	retries := 0
+	indexer := NewBulkIndexer(context.Background(), client, "poems-test", BulkOptions{
+		Workers:      1,
+		MaxRetries:   &retries,
+		RetryBackoff: time.Millisecond,
+	})
+	require.NoError(t, indexer.Add(context.Background(), "busy", []byte(`{}`)))
+	summary, err := indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(1), summary.Failed)
+	assert.Zero(t, summary.Retried)
+	assert.Equal(t, 1, requests)
+}
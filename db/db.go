@@ -7,7 +7,6 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
 	"poetry/config"
-	"time"
 )
 
 type MongoDBConnection struct {
@@ -21,12 +20,12 @@ type MongoDBConnection struct {
 func NewMongoDBConnection() (*MongoDBConnection, error) {
 	cfg := config.GetConfig()
 
-	uri := fmt.Sprintf("mongodb://%s:%s@%s:%s", cfg.DbUser, cfg.DbPass, cfg.DbHost, cfg.DbPort)
+	uri := cfg.Mongo.URI()
 
 	clientOptions := options.Client().ApplyURI(uri)
 
 	// Set a timeout for the connection attempt.
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Mongo.ConnectTimeout.Duration)
 	defer cancel()
 
 	client, err := mongo.Connect(ctx, clientOptions)
@@ -44,7 +43,7 @@ func NewMongoDBConnection() (*MongoDBConnection, error) {
 
 	return &MongoDBConnection{
 		URI:      uri,
-		Database: cfg.DbName,
+		Database: cfg.Mongo.Database,
 		Client:   client,
 	}, nil
 }
@@ -58,30 +57,6 @@ func (c *MongoDBConnection) Disconnect() {
 	}
 }
 
-func InsertOnePoemIntoDB(mongoDBConnection MongoDBConnection, poem Poem) {
-	collection := mongoDBConnection.Client.Database("poetry").Collection("poems")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_, err := collection.InsertOne(ctx, &poem)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-	return
-}
-
-func InsertManyIntoDB(collection mongo.Collection, documents []interface{}) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_, err := collection.InsertMany(ctx, documents)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 func GetCollection(databaseName, collectionName string, mongoDBConnection *MongoDBConnection) (*mongo.Collection, error) {
 	client := mongoDBConnection.Client
 	collection := client.Database(databaseName).Collection(collectionName)
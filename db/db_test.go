@@ -0,0 +1,27 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCollectionsUseConnectionDatabase(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("configured database", func(mt *mtest.T) {
+		connection := &MongoDBConnection{Client: mt.Client, Database: "anthology"}
+		collection, _ := GetCollection(connection.Database, "poems", connection)
+
+		for _, collection := range []*mongo.Collection{
+			collection,
+			poemsCollection(connection),
+			apiKeysCollection(connection),
+			importsCollection(connection),
+			rateLimitsCollection(connection),
+		} {
+			assert.Equal(t, "anthology", collection.Database().Name(), collection.Name())
+		}
+	})
+}
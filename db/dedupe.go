@@ -0,0 +1,215 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DuplicateMode decides what happens when an ingested poem matches one that
+// is already stored.
+type DuplicateMode string
+
+const (
+	// SkipDuplicates leaves the stored poem untouched.
+	SkipDuplicates DuplicateMode = "skip"
+	// UpdateDuplicates overwrites the stored poem with the ingested one.
+	UpdateDuplicates DuplicateMode = "update"
+)
+
+// duplicateKeyErrorCode is the MongoDB error code for unique index violations.
+const duplicateKeyErrorCode = 11000
+
+// ParseDuplicateMode validates a duplicate mode coming from a request or a
+// flag. An empty value selects SkipDuplicates.
+func ParseDuplicateMode(value string) (DuplicateMode, error) {
+	switch DuplicateMode(value) {
+	case "", SkipDuplicates:
+		return SkipDuplicates, nil
+	case UpdateDuplicates:
+		return UpdateDuplicates, nil
+	default:
+		return "", fmt.Errorf("unknown duplicate mode %q, expected %q or %q", value, SkipDuplicates, UpdateDuplicates)
+	}
+}
+
+// UpsertResult counts what happened to each poem passed to UpsertPoems.
+type UpsertResult struct {
+	New     int64 `json:"new"`
+	Updated int64 `json:"updated"`
+	Skipped int64 `json:"skipped"`
+	Failed  int64 `json:"failed"`
+}
+
+// Add accumulates other into r.
+func (r *UpsertResult) Add(other UpsertResult) {
+	r.New += other.New
+	r.Updated += other.Updated
+	r.Skipped += other.Skipped
+	r.Failed += other.Failed
+}
+
+// Saved returns how many poems ended up stored, whether written or already
+// present.
+func (r UpsertResult) Saved() int64 {
+	return r.New + r.Updated + r.Skipped
+}
+
+// maxWriteErrorMessages bounds the messages kept by a PoemWriteError
+const maxWriteErrorMessages = 10
+
+// PoemWriteError is returned by UpsertPoems when MongoDB rejected some poems
+// individually, for example for exceeding the document size limit. Every
+// other poem was saved, so retrying the call does not help.
+type PoemWriteError struct {
+	// Indexes are the positions of the rejected poems in the slice passed
+	// to UpsertPoems
+	Indexes  []int
+	Messages []string
+}
+
+func (e *PoemWriteError) Error() string {
+	return fmt.Sprintf("%d poems were rejected: %s", len(e.Indexes), strings.Join(e.Messages, "; "))
+}
+
+// ContentHash fingerprints the text of a poem. It identifies duplicates in
+// datasets that carry no IDs of their own, such as
+// chinese-poetry-one-line-kaggle.
+func ContentHash(poem Poem) string {
+	normalize := func(value string) string {
+		return strings.Join(strings.Fields(strings.ToLower(value)), " ")
+	}
+
+	hash := sha256.New()
+	for _, part := range []string{poem.Title, poem.Poet, poem.Poem, poem.Language} {
+		hash.Write([]byte(normalize(part)))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// duplicateKey returns the filter identifying poem among stored poems:
+// (dataset, dataset_id, language) when the dataset has IDs, or
+// (dataset, content_hash) otherwise. Language is part of the key because
+// datasets such as eurovision-kaggle store translations under the same ID.
+func duplicateKey(poem Poem) bson.D {
+	if poem.DatasetId != "" {
+		return bson.D{
+			{Key: "dataset", Value: poem.Dataset},
+			{Key: "dataset_id", Value: poem.DatasetId},
+			{Key: "language", Value: poem.Language},
+		}
+	}
+	return bson.D{
+		{Key: "dataset", Value: poem.Dataset},
+		{Key: "content_hash", Value: poem.ContentHash},
+	}
+}
+
+// EnsurePoemIndexes creates the unique indexes that back duplicate
+// detection. It fails when the collection already holds duplicates, which
+// have to be removed before the indexes can be built.
+func EnsurePoemIndexes(ctx context.Context, connection *MongoDBConnection) error {
+	_, err := poemsCollection(connection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "dataset", Value: 1}, {Key: "dataset_id", Value: 1}, {Key: "language", Value: 1}},
+			Options: options.Index().
+				SetName("unique_dataset_id").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "dataset_id", Value: bson.D{{Key: "$gt", Value: ""}}}}),
+		},
+		{
+			Keys: bson.D{{Key: "dataset", Value: 1}, {Key: "content_hash", Value: 1}},
+			Options: options.Index().
+				SetName("unique_content_hash").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.D{
+					{Key: "dataset_id", Value: bson.D{{Key: "$eq", Value: ""}}},
+					{Key: "content_hash", Value: bson.D{{Key: "$exists", Value: true}}},
+				}),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create poem indexes: %v", err)
+	}
+	return nil
+}
+
+// UpsertPoems stores poems, matching each one against existing poems by its
+// duplicate key. New poems are inserted; duplicates are skipped or updated
+// according to mode.
+func UpsertPoems(ctx context.Context, connection *MongoDBConnection, poems []Poem, mode DuplicateMode) (UpsertResult, error) {
+	var result UpsertResult
+	if len(poems) == 0 {
+		return result, nil
+	}
+
+	operator := "$setOnInsert"
+	if mode == UpdateDuplicates {
+		operator = "$set"
+	}
+
+	models := make([]mongo.WriteModel, 0, len(poems))
+	for _, poem := range poems {
+		poem.ID = ""
+		poem.ContentHash = ContentHash(poem)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(duplicateKey(poem)).
+			SetUpdate(bson.D{{Key: operator, Value: poem}}).
+			SetUpsert(true))
+	}
+
+	collection := poemsCollection(connection)
+	response, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+
+	// Two copies of a new poem in the same batch race to insert it; the loser
+	// fails on the unique index and counts as a skipped duplicate. Other
+	// write errors only affect their own poem, as the write is unordered.
+	var duplicates int64
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		var rejected PoemWriteError
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Code == duplicateKeyErrorCode {
+				duplicates++
+				continue
+			}
+			rejected.Indexes = append(rejected.Indexes, writeErr.Index)
+			if len(rejected.Messages) < maxWriteErrorMessages {
+				rejected.Messages = append(rejected.Messages, fmt.Sprintf("poem %d: %s", writeErr.Index, writeErr.Message))
+			}
+		}
+		result.Failed = int64(len(rejected.Indexes))
+		err = nil
+		if result.Failed > 0 {
+			err = &rejected
+		}
+	}
+	if response != nil {
+		result.New = response.UpsertedCount
+		if mode == UpdateDuplicates {
+			result.Updated = response.ModifiedCount
+			result.Skipped = response.MatchedCount - response.ModifiedCount
+		} else {
+			result.Skipped = response.MatchedCount
+		}
+		if duplicates > 0 {
+			result.Skipped += duplicates
+		}
+	}
+	var rejected *PoemWriteError
+	if errors.As(err, &rejected) {
+		return result, err
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to save %d poems into %s: %v", len(poems), collection.Name(), err)
+	}
+	return result, nil
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestContentHash(t *testing.T) {
+	poem := Poem{Title: "Waterloo", Poet: "ABBA", Poem: "My, my\nAt Waterloo", Language: "english"}
+
+	same := poem
+	same.Title = "  WATERLOO "
+	same.Poem = "My,  my At   waterloo"
+	assert.Equal(t, ContentHash(poem), ContentHash(same))
+
+	other := poem
+	other.Language = "swedish"
+	assert.NotEqual(t, ContentHash(poem), ContentHash(other))
+
+	// The hash covers the text, not where the poem came from.
+	moved := poem
+	moved.Dataset = "another-dataset"
+	assert.Equal(t, ContentHash(poem), ContentHash(moved))
+}
+
+func TestDuplicateKey(t *testing.T) {
+	withID := Poem{Dataset: "eurovision-kaggle", DatasetId: "42", Language: "english"}
+	assert.Equal(t, bson.D{
+		{Key: "dataset", Value: "eurovision-kaggle"},
+		{Key: "dataset_id", Value: "42"},
+		{Key: "language", Value: "english"},
+	}, duplicateKey(withID))
+
+	withoutID := Poem{Dataset: "chinese-poetry-one-line-kaggle", ContentHash: "abc"}
+	assert.Equal(t, bson.D{
+		{Key: "dataset", Value: "chinese-poetry-one-line-kaggle"},
+		{Key: "content_hash", Value: "abc"},
+	}, duplicateKey(withoutID))
+}
+
+func TestParseDuplicateMode(t *testing.T) {
+	mode, err := ParseDuplicateMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, SkipDuplicates, mode)
+
+	mode, err = ParseDuplicateMode("update")
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateDuplicates, mode)
+
+	_, err = ParseDuplicateMode("replace")
+	assert.Error(t, err)
+}
+
+func TestUpsertResultAdd(t *testing.T) {
+	total := UpsertResult{New: 1, Skipped: 2}
+	total.Add(UpsertResult{New: 3, Updated: 1, Failed: 2})
+
+	assert.Equal(t, UpsertResult{New: 4, Updated: 1, Skipped: 2, Failed: 2}, total)
+	assert.Equal(t, int64(7), total.Saved())
+}
+
+func TestPoemWriteError(t *testing.T) {
+	err := &PoemWriteError{Indexes: []int{1, 4}, Messages: []string{"poem 1: too large", "poem 4: too large"}}
+	assert.Equal(t, "2 poems were rejected: poem 1: too large; poem 4: too large", err.Error())
+}
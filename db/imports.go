@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ImportStatus is the state of an import run.
+type ImportStatus string
+
+const (
+	ImportRunning   ImportStatus = "running"
+	ImportCompleted ImportStatus = "completed"
+	ImportFailed    ImportStatus = "failed"
+)
+
+// ImportRun records the import of one dataset file. A run that is not
+// completed can be resumed after LastCommittedRow, as long as the file
+// still has the same checksum; the resumed run keeps the record.
+//
+// PoemsSaved, Result and MalformedRows cover every row up to
+// LastCommittedRow, whichever run committed it. RowsRead and SkippedRows
+// only cover the latest run: the file rows it read and committed,
+// malformed ones included, and the rows it skipped because an earlier run
+// had committed them.
+type ImportRun struct {
+	ID            string       `bson:"_id" json:"id"`
+	Dataset       string       `bson:"dataset" json:"dataset"`
+	File          string       `bson:"file" json:"file"`
+	Checksum      string       `bson:"checksum" json:"checksum"`
+	Status        ImportStatus `bson:"status" json:"status"`
+	RowsRead      int64        `bson:"rows_read" json:"rows_read"`
+	SkippedRows   int64        `bson:"skipped_rows" json:"skipped_rows"`
+	PoemsSaved    int64        `bson:"poems_saved" json:"poems_saved"`
+	Result        UpsertResult `bson:"result" json:"result"`
+	MalformedRows int64        `bson:"malformed_rows" json:"malformed_rows"`
+	// LastCommittedRow is the row up to which every row is saved, counting
+	// from 1. Zero means no row is.
+	LastCommittedRow int64      `bson:"last_committed_row" json:"last_committed_row"`
+	ResumedFrom      int64      `bson:"resumed_from,omitempty" json:"resumed_from,omitempty"`
+	StartedAt        time.Time  `bson:"started_at" json:"started_at"`
+	UpdatedAt        time.Time  `bson:"updated_at" json:"updated_at"`
+	FinishedAt       *time.Time `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+func importsCollection(connection *MongoDBConnection) *mongo.Collection {
+	return connection.Client.Database(connection.Database).Collection("imports")
+}
+
+// NewImportRun returns a running import of file.
+func NewImportRun(dataset, file, checksum string) *ImportRun {
+	now := time.Now()
+	return &ImportRun{
+		ID:        primitive.NewObjectID().Hex(),
+		Dataset:   dataset,
+		File:      file,
+		Checksum:  checksum,
+		Status:    ImportRunning,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// SaveImportRun stores run, replacing its previous state.
+func SaveImportRun(ctx context.Context, connection *MongoDBConnection, run *ImportRun) error {
+	run.UpdatedAt = time.Now()
+	_, err := importsCollection(connection).ReplaceOne(ctx,
+		bson.D{{Key: "_id", Value: run.ID}},
+		run,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save import run %s: %v", run.ID, err)
+	}
+	return nil
+}
+
+// FindUnfinishedImportRun returns the latest run of file in dataset that
+// did not complete, or nil when there is none.
+func FindUnfinishedImportRun(ctx context.Context, connection *MongoDBConnection, dataset, file string) (*ImportRun, error) {
+	var run ImportRun
+	err := importsCollection(connection).FindOne(ctx,
+		bson.D{
+			{Key: "dataset", Value: dataset},
+			{Key: "file", Value: file},
+			{Key: "status", Value: bson.D{{Key: "$ne", Value: ImportCompleted}}},
+		},
+		options.FindOne().SetSort(bson.D{{Key: "started_at", Value: -1}}),
+	).Decode(&run)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find import run of %s: %v", file, err)
+	}
+	return &run, nil
+}
@@ -0,0 +1,18 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewImportRun(t *testing.T) {
+	run := NewImportRun("poems_data", "poems_data/gutenberg-poetry-dataset.csv", "abc")
+	other := NewImportRun("poems_data", "poems_data/gutenberg-poetry-dataset.csv", "abc")
+
+	assert.NotEmpty(t, run.ID)
+	assert.NotEqual(t, run.ID, other.ID)
+	assert.Equal(t, ImportRunning, run.Status)
+	assert.Zero(t, run.LastCommittedRow)
+	assert.Nil(t, run.FinishedAt)
+}
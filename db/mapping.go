@@ -0,0 +1,152 @@
+package db
+
+import "strings"
+
+// MappingVersion identifies the layout produced by poemIndexMapping. Bump it
+// whenever the mapping changes in a way that needs existing indices rebuilt.
+const MappingVersion = 2
+
+// keywordSubField is the exact-match sub-field added to every facet field.
+const keywordSubField = "keyword"
+
+// languageAnalyzers maps Language values written by the importers to the
+// built-in Elasticsearch analyzer backing the matching title and poem
+// language fields. Languages not listed here are only searched through the
+// standard-analyzed title and poem.
+var languageAnalyzers = map[string]string{
+	"english":  "english",
+	"russian":  "russian",
+	"arabic":   "arabic",
+	"chinese":  "cjk",
+	"japanese": "cjk",
+	"korean":   "cjk",
+}
+
+// analyzers lists the analyzers with a language field next to title and poem,
+// in a stable order.
+var analyzers = []string{"english", "russian", "arabic", "cjk"}
+
+// analyzedFields lists the text fields copied into a language field.
+var analyzedFields = []string{"title", "poem"}
+
+// AnalyzerFor returns the analyzer used for language, or an empty string when
+// the language has no dedicated analyzer.
+func AnalyzerFor(language string) string {
+	return languageAnalyzers[strings.ToLower(strings.TrimSpace(language))]
+}
+
+// keywordField returns the exact-match field for a facet field name.
+func keywordField(name string) string {
+	return name + "." + keywordSubField
+}
+
+// languageField returns the field holding the copy of a text field analyzed
+// with analyzer, such as poem_russian.
+func languageField(name, analyzer string) string {
+	return name + "_" + analyzer
+}
+
+// addLanguageFields copies title and poem of a poem document into the
+// language fields for its Language, so each poem is only analyzed by the
+// analyzer of its own language. Documents in other languages are left as
+// they are.
+func addLanguageFields(document map[string]interface{}) {
+	language, _ := document["language"].(string)
+	analyzer := AnalyzerFor(language)
+	if analyzer == "" {
+		return
+	}
+	for _, name := range analyzedFields {
+		if value, ok := document[name]; ok {
+			document[languageField(name, analyzer)] = value
+		}
+	}
+}
+
+// languageSearchFields expands the boosted base search fields with the
+// language fields of title and poem. When languages is empty every language
+// field is searched, otherwise only the ones selected by the given Language
+// values. A language field only holds poems of its own language, so
+// searching all of them still matches each poem through one analyzer.
+func languageSearchFields(base []string, languages []string) []string {
+	selected := analyzers
+	if len(languages) > 0 {
+		selected = nil
+		seen := map[string]bool{}
+		for _, language := range languages {
+			if analyzer := AnalyzerFor(language); analyzer != "" && !seen[analyzer] {
+				seen[analyzer] = true
+				selected = append(selected, analyzer)
+			}
+		}
+	}
+
+	fields := append([]string{}, base...)
+	for _, field := range base {
+		name, boost, _ := strings.Cut(field, "^")
+		if name != "title" && name != "poem" {
+			continue
+		}
+		for _, analyzer := range selected {
+			analyzed := languageField(name, analyzer)
+			if boost != "" {
+				analyzed += "^" + boost
+			}
+			fields = append(fields, analyzed)
+		}
+	}
+	return fields
+}
+
+func textField() map[string]interface{} {
+	return map[string]interface{}{"type": "text"}
+}
+
+func languageTextField(analyzer string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "text",
+		"analyzer": analyzer,
+	}
+}
+
+func facetTextField() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "text",
+		"fields": map[string]interface{}{
+			keywordSubField: map[string]interface{}{
+				"type":         "keyword",
+				"ignore_above": 256,
+			},
+		},
+	}
+}
+
+// poemIndexMapping returns the mappings every poems index is created with.
+// Dynamic mapping is disabled so unexpected fields coming from Mongo are
+// stored but not indexed.
+func poemIndexMapping() map[string]interface{} {
+	properties := map[string]interface{}{
+		"dataset":    facetTextField(),
+		"dataset_id": map[string]interface{}{"type": "keyword"},
+		"title":      textField(),
+		"poem":       textField(),
+		"poet":       facetTextField(),
+		"tags":       facetTextField(),
+		"language":   facetTextField(),
+	}
+	for _, name := range analyzedFields {
+		for _, analyzer := range analyzers {
+			properties[languageField(name, analyzer)] = languageTextField(analyzer)
+		}
+	}
+
+	return map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"dynamic": false,
+			"_meta": map[string]interface{}{
+				"mapping_version": MappingVersion,
+			},
+			"properties": properties,
+		},
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzerFor(t *testing.T) {
+	assert.Equal(t, "russian", AnalyzerFor("russian"))
+	assert.Equal(t, "cjk", AnalyzerFor(" Chinese "))
+	assert.Equal(t, "", AnalyzerFor("swedish"))
+}
+
+func TestLanguageSearchFields(t *testing.T) {
+	base := []string{"title^3", "poet^2", "poem"}
+
+	assert.Equal(t, []string{
+		"title^3", "poet^2", "poem",
+		"title_russian^3", "title_cjk^3",
+		"poem_russian", "poem_cjk",
+	}, languageSearchFields(base, []string{"russian", "chinese", "japanese", "swedish"}))
+
+	all := languageSearchFields(base, nil)
+	assert.Contains(t, all, "title_english^3")
+	assert.Contains(t, all, "poem_arabic")
+	assert.NotContains(t, all, "poet_english")
+}
+
+func TestPoemIndexMapping(t *testing.T) {
+	mappings := poemIndexMapping()["mappings"].(map[string]interface{})
+	assert.Equal(t, MappingVersion, mappings["_meta"].(map[string]interface{})["mapping_version"])
+
+	properties := mappings["properties"].(map[string]interface{})
+	for _, name := range FacetNames {
+		field := properties[name].(map[string]interface{})
+		assert.Contains(t, field["fields"], keywordSubField, name)
+	}
+	assert.NotContains(t, properties["poem"], "fields")
+	assert.Equal(t, "cjk", properties["poem_cjk"].(map[string]interface{})["analyzer"])
+	assert.Equal(t, "russian", properties["title_russian"].(map[string]interface{})["analyzer"])
+}
+
+func TestAddLanguageFields(t *testing.T) {
+	document := map[string]interface{}{"title": "Парус", "poem": "Белеет парус одинокой", "language": "Russian"}
+	addLanguageFields(document)
+	assert.Equal(t, "Парус", document["title_russian"])
+	assert.Equal(t, "Белеет парус одинокой", document["poem_russian"])
+	assert.NotContains(t, document, "poem_english")
+
+	untouched := map[string]interface{}{"title": "Segel", "poem": "Ett segel", "language": "swedish"}
+	addLanguageFields(untouched)
+	assert.Len(t, untouched, 3)
+}
@@ -1,14 +1,15 @@
 package db
 
 type Poem struct {
-	ID        string   `bson:"_id,omitempty"`
-	Dataset   string   `bson:"dataset"`
-	DatasetId string   `bson:"dataset_id"`
-	Title     string   `bson:"title"`
-	Poem      string   `bson:"poem"`
-	Poet      string   `bson:"poet"`
-	Tags      []string `bson:"tags"`
-	Language  string   `bson:"language"`
+	ID          string   `bson:"_id,omitempty" json:"id,omitempty"`
+	Dataset     string   `bson:"dataset" json:"dataset"`
+	DatasetId   string   `bson:"dataset_id" json:"dataset_id"`
+	Title       string   `bson:"title" json:"title"`
+	Poem        string   `bson:"poem" json:"poem"`
+	Poet        string   `bson:"poet" json:"poet"`
+	Tags        []string `bson:"tags" json:"tags"`
+	Language    string   `bson:"language" json:"language"`
+	ContentHash string   `bson:"content_hash,omitempty" json:"-"`
 }
 
 type Song struct {
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrPoemNotFound  = errors.New("poem not found")
+	ErrInvalidPoemID = errors.New("invalid poem id")
+	ErrDuplicatePoem = errors.New("poem duplicates an existing poem")
+)
+
+// PoemFilter narrows ListPoems to poems matching every non-empty field.
+type PoemFilter struct {
+	Dataset  string
+	Language string
+	Poet     string
+}
+
+func poemsCollection(connection *MongoDBConnection) *mongo.Collection {
+	return connection.Client.Database(connection.Database).Collection("poems")
+}
+
+// ParsePoemID converts the hex form of a poem's ObjectID, as exposed by the
+// API and the search index, back into an ObjectID.
+func ParsePoemID(id string) (primitive.ObjectID, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, ErrInvalidPoemID
+	}
+	return objectID, nil
+}
+
+func FindPoemByID(ctx context.Context, connection *MongoDBConnection, id primitive.ObjectID) (*Poem, error) {
+	var poem Poem
+	err := poemsCollection(connection).FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&poem)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPoemNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find poem %s: %v", id.Hex(), err)
+	}
+	return &poem, nil
+}
+
+// ReplacePoem overwrites every field of the poem with id and returns the
+// stored result.
+func ReplacePoem(ctx context.Context, connection *MongoDBConnection, id primitive.ObjectID, poem Poem) (*Poem, error) {
+	poem.ID = ""
+	poem.ContentHash = ContentHash(poem)
+
+	var replaced Poem
+	err := poemsCollection(connection).FindOneAndReplace(ctx,
+		bson.D{{Key: "_id", Value: id}},
+		poem,
+		options.FindOneAndReplace().SetReturnDocument(options.After),
+	).Decode(&replaced)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPoemNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrDuplicatePoem
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to replace poem %s: %v", id.Hex(), err)
+	}
+	return &replaced, nil
+}
+
+// updatePoemAttempts bounds how often UpdatePoem retries when the poem
+// changes between reading and writing it.
+const updatePoemAttempts = 3
+
+// UpdatePoem sets the given fields, keyed by their bson names, on the poem
+// with id and returns the stored result. The fields and the content hash
+// they lead to are written together, conditioned on the hash read, so a
+// duplicate leaves the poem untouched and a concurrent edit is not mixed
+// with a stale hash.
+func UpdatePoem(ctx context.Context, connection *MongoDBConnection, id primitive.ObjectID, fields bson.M) (*Poem, error) {
+	collection := poemsCollection(connection)
+
+	for attempt := 0; attempt < updatePoemAttempts; attempt++ {
+		current, err := FindPoemByID(ctx, connection, id)
+		if err != nil {
+			return nil, err
+		}
+		merged, err := mergePoemFields(*current, fields)
+		if err != nil {
+			return nil, err
+		}
+
+		set := bson.M{"content_hash": ContentHash(merged)}
+		for key, value := range fields {
+			set[key] = value
+		}
+		// Poems stored before content hashes existed have none.
+		var previousHash interface{} = current.ContentHash
+		if current.ContentHash == "" {
+			previousHash = nil
+		}
+
+		var updated Poem
+		err = collection.FindOneAndUpdate(ctx,
+			bson.D{{Key: "_id", Value: id}, {Key: "content_hash", Value: previousHash}},
+			bson.D{{Key: "$set", Value: set}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&updated)
+		if err == mongo.ErrNoDocuments {
+			// Deleted or edited since it was read; FindPoemByID tells which.
+			continue
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrDuplicatePoem
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update poem %s: %v", id.Hex(), err)
+		}
+		return &updated, nil
+	}
+	return nil, fmt.Errorf("failed to update poem %s: it kept changing during the update", id.Hex())
+}
+
+// mergePoemFields returns poem with fields, keyed by bson names, applied.
+func mergePoemFields(poem Poem, fields bson.M) (Poem, error) {
+	var document bson.M
+	raw, err := bson.Marshal(poem)
+	if err == nil {
+		err = bson.Unmarshal(raw, &document)
+	}
+	if err != nil {
+		return Poem{}, fmt.Errorf("failed to merge poem fields: %v", err)
+	}
+	for key, value := range fields {
+		document[key] = value
+	}
+
+	var merged Poem
+	raw, err = bson.Marshal(document)
+	if err == nil {
+		err = bson.Unmarshal(raw, &merged)
+	}
+	if err != nil {
+		return Poem{}, fmt.Errorf("failed to merge poem fields: %v", err)
+	}
+	return merged, nil
+}
+
+func DeletePoem(ctx context.Context, connection *MongoDBConnection, id primitive.ObjectID) error {
+	result, err := poemsCollection(connection).DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		return fmt.Errorf("failed to delete poem %s: %v", id.Hex(), err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrPoemNotFound
+	}
+	return nil
+}
+
+func (f PoemFilter) query() bson.D {
+	query := bson.D{}
+	if f.Dataset != "" {
+		query = append(query, bson.E{Key: "dataset", Value: f.Dataset})
+	}
+	if f.Language != "" {
+		query = append(query, bson.E{Key: "language", Value: f.Language})
+	}
+	if f.Poet != "" {
+		query = append(query, bson.E{Key: "poet", Value: f.Poet})
+	}
+	return query
+}
+
+// ListPoems returns one page of poems matching filter, in insertion order,
+// along with the total number of matches.
+func ListPoems(ctx context.Context, connection *MongoDBConnection, filter PoemFilter, page, size int) ([]Poem, int64, error) {
+	collection := poemsCollection(connection)
+	query := filter.query()
+
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count poems: %v", err)
+	}
+
+	cursor, err := collection.Find(ctx, query, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetSkip(int64((page-1)*size)).
+		SetLimit(int64(size)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list poems: %v", err)
+	}
+
+	poems := []Poem{}
+	if err := cursor.All(ctx, &poems); err != nil {
+		return nil, 0, fmt.Errorf("failed to read poems: %v", err)
+	}
+	return poems, total, nil
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func storedPoem(id primitive.ObjectID, title string) bson.D {
+	poem := Poem{Dataset: "user", Title: title, Poem: "My, my", Poet: "ABBA", Language: "english"}
+	return bson.D{
+		{Key: "_id", Value: id},
+		{Key: "dataset", Value: poem.Dataset},
+		{Key: "title", Value: poem.Title},
+		{Key: "poem", Value: poem.Poem},
+		{Key: "poet", Value: poem.Poet},
+		{Key: "language", Value: poem.Language},
+		{Key: "content_hash", Value: ContentHash(poem)},
+	}
+}
+
+func TestUpdatePoemDuplicate(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("fields and hash are written at once", func(mt *mtest.T) {
+		id := primitive.NewObjectID()
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "poetry.poems", mtest.FirstBatch, storedPoem(id, "Waterloo")),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 11000, Message: "E11000 duplicate key error"}),
+		)
+		connection := &MongoDBConnection{Client: mt.Client, Database: "poetry"}
+
+		_, err := UpdatePoem(context.Background(), connection, id, bson.M{"title": "Mamma Mia"})
+		assert.ErrorIs(t, err, ErrDuplicatePoem)
+
+		// A rejected update writes nothing: there is no separate hash write
+		// that could leave the new title behind.
+		events := mt.GetAllStartedEvents()
+		require.Len(t, events, 2)
+		assert.Equal(t, "findAndModify", events[1].CommandName)
+
+		command := events[1].Command
+		assert.Equal(t, ContentHash(Poem{Dataset: "user", Title: "Waterloo", Poem: "My, my", Poet: "ABBA", Language: "english"}),
+			command.Lookup("query", "content_hash").StringValue())
+		assert.Equal(t, "Mamma Mia", command.Lookup("update", "$set", "title").StringValue())
+		assert.Equal(t, ContentHash(Poem{Title: "Mamma Mia", Poem: "My, my", Poet: "ABBA", Language: "english"}),
+			command.Lookup("update", "$set", "content_hash").StringValue())
+	})
+}
+
+func TestUpdatePoemRetriesConcurrentEdit(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("a poem edited meanwhile is read again", func(mt *mtest.T) {
+		id := primitive.NewObjectID()
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "poetry.poems", mtest.FirstBatch, storedPoem(id, "Waterloo")),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}),
+			mtest.CreateCursorResponse(0, "poetry.poems", mtest.FirstBatch, storedPoem(id, "Waterloo (live)")),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: storedPoem(id, "Mamma Mia")}),
+		)
+		connection := &MongoDBConnection{Client: mt.Client, Database: "poetry"}
+
+		updated, err := UpdatePoem(context.Background(), connection, id, bson.M{"title": "Mamma Mia"})
+		require.NoError(t, err)
+		assert.Equal(t, "Mamma Mia", updated.Title)
+
+		events := mt.GetAllStartedEvents()
+		require.Len(t, events, 4)
+		assert.Equal(t, ContentHash(Poem{Title: "Waterloo (live)", Poem: "My, my", Poet: "ABBA", Language: "english"}),
+			events[3].Command.Lookup("query", "content_hash").StringValue())
+	})
+}
+
+func TestMergePoemFields(t *testing.T) {
+	poem := Poem{Title: "Waterloo", Poet: "ABBA", Tags: []string{"1974"}, Language: "english"}
+	merged, err := mergePoemFields(poem, bson.M{"poet": "Abba", "tags": []string{"pop"}})
+	require.NoError(t, err)
+	assert.Equal(t, Poem{Title: "Waterloo", Poet: "Abba", Tags: []string{"pop"}, Language: "english"}, merged)
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rateLimitIdleTTL is how long an untouched rate limit bucket is kept. A
+// bucket left alone that long has refilled anyway.
+const rateLimitIdleTTL = time.Hour
+
+func rateLimitsCollection(connection *MongoDBConnection) *mongo.Collection {
+	return connection.Client.Database(connection.Database).Collection("rate_limits")
+}
+
+// EnsureRateLimitIndexes creates the index expiring idle rate limit buckets.
+func EnsureRateLimitIndexes(ctx context.Context, connection *MongoDBConnection) error {
+	_, err := rateLimitsCollection(connection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "updated_at", Value: 1}},
+		Options: options.Index().
+			SetName("expire_idle").
+			SetExpireAfterSeconds(int32(rateLimitIdleTTL.Seconds())),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create rate limit indexes: %v", err)
+	}
+	return nil
+}
+
+// TakeRateLimitToken takes a token from the bucket of key, which refills at
+// rate tokens per second up to burst tokens. The bucket is updated in a
+// single atomic write, so replicas sharing the collection share the limit.
+// It returns whether a token was taken and the tokens left afterwards.
+func TakeRateLimitToken(ctx context.Context, connection *MongoDBConnection, key string, rate float64, burst int, now time.Time) (bool, float64, error) {
+	elapsedSeconds := bson.D{{Key: "$divide", Value: bson.A{
+		bson.D{{Key: "$subtract", Value: bson.A{now, bson.D{{Key: "$ifNull", Value: bson.A{"$updated_at", now}}}}}},
+		1000,
+	}}}
+	refilled := bson.D{{Key: "$min", Value: bson.A{
+		float64(burst),
+		bson.D{{Key: "$add", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$tokens", float64(burst)}}},
+			bson.D{{Key: "$multiply", Value: bson.A{rate, elapsedSeconds}}},
+		}}},
+	}}}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{{Key: "tokens", Value: refilled}, {Key: "updated_at", Value: now}}}},
+		{{Key: "$set", Value: bson.D{{Key: "allowed", Value: bson.D{{Key: "$gte", Value: bson.A{"$tokens", 1}}}}}}},
+		{{Key: "$set", Value: bson.D{{Key: "tokens", Value: bson.D{{Key: "$cond", Value: bson.A{
+			"$allowed", bson.D{{Key: "$subtract", Value: bson.A{"$tokens", 1}}}, "$tokens",
+		}}}}}}},
+	}
+
+	var bucket struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	err := rateLimitsCollection(connection).FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: key}},
+		pipeline,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&bucket)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to update rate limit of %s: %v", key, err)
+	}
+	return bucket.Allowed, bucket.Tokens, nil
+}
@@ -1,23 +1,26 @@
 package db
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"io"
+	"log"
 	"net/http"
 	configuration "poetry/config"
-	"strings"
-	"sync"
+	"time"
 )
 
 func ConnectElasticsearch() (*elasticsearch.Client, error) {
 	cfg := configuration.GetConfig()
 	config := elasticsearch.Config{
-		Addresses: []string{cfg.ElasticUrl},
+		Addresses: []string{cfg.Elasticsearch.URL},
 	}
 	client, err := elasticsearch.NewClient(config)
 	if err != nil {
@@ -27,6 +30,9 @@ func ConnectElasticsearch() (*elasticsearch.Client, error) {
 	return client, nil
 }
 
+// CreateIndex creates indexName with the poem mapping unless it already
+// exists. An existing index built from an older mapping version is kept as is
+// and reported, since changing analyzers requires a reindex.
 func CreateIndex(esClient *elasticsearch.Client, indexName string) error {
 	existsRequest := esapi.IndicesExistsRequest{
 		Index: []string{indexName},
@@ -40,10 +46,22 @@ func CreateIndex(esClient *elasticsearch.Client, indexName string) error {
 
 	if response.StatusCode == http.StatusOK {
 		// Index already exists, no need to create it
+		version, err := indexMappingVersion(esClient, indexName)
+		if err != nil {
+			return err
+		}
+		if version != MappingVersion {
+			log.Printf("Index %s uses mapping version %d, current version is %d; reindex to apply the new mapping", indexName, version, MappingVersion)
+		}
 		return nil
 	}
 
-	response, err = esClient.Indices.Create(indexName)
+	body, err := json.Marshal(poemIndexMapping())
+	if err != nil {
+		return fmt.Errorf("failed to encode index mapping: %v", err)
+	}
+
+	response, err = esClient.Indices.Create(indexName, esClient.Indices.Create.WithBody(bytes.NewReader(body)))
 
 	if err != nil {
 		return err
@@ -62,188 +80,397 @@ func CreateIndex(esClient *elasticsearch.Client, indexName string) error {
 	return nil
 }
 
-func ReindexData(client *mongo.Client, esClient *elasticsearch.Client, dataset string, indexName string, numWorkers int) error {
-	cfg := configuration.GetConfig()
-	collection := client.Database(cfg.DbName).Collection("poems")
-	var once sync.Once
-
-	// Connect to Elasticsearch index
-	err := CreateIndex(esClient, indexName)
+// indexMappingVersion reads the mapping version recorded in the _meta of an
+// existing index. Indices created before mappings were versioned report 0.
+func indexMappingVersion(esClient *elasticsearch.Client, indexName string) (int, error) {
+	response, err := esClient.Indices.GetMapping(esClient.Indices.GetMapping.WithIndex(indexName))
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer response.Body.Close()
 
-	// Retrieve data from MongoDB
+	if response.IsError() {
+		return 0, fmt.Errorf("error reading mapping of index %s: %s", indexName, response.String())
+	}
+
+	var mappings map[string]struct {
+		Mappings struct {
+			Meta struct {
+				MappingVersion int `json:"mapping_version"`
+			} `json:"_meta"`
+		} `json:"mappings"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&mappings); err != nil {
+		return 0, fmt.Errorf("failed to decode mapping of index %s: %v", indexName, err)
+	}
+
+	return mappings[indexName].Mappings.Meta.MappingVersion, nil
+}
+
+// ReindexOptions controls how ReindexData publishes a rebuilt dataset.
+type ReindexOptions struct {
+	// Alias is the read alias searched by the API.
+	Alias string
+	// Bulk tunes the bulk indexer writing the new index.
+	Bulk BulkOptions
+	// DeleteOld removes the indices the alias pointed to before the swap.
+	DeleteOld bool
+}
+
+// ReindexResult describes a reindex run. It is returned alongside errors
+// too, so callers can report what was written before the run failed.
+type ReindexResult struct {
+	Index string `json:"index"`
+	BulkSummary
+}
+
+// ReindexData rebuilds the search index of dataset without disturbing
+// readers. Documents are written to a fresh timestamped index, the index's
+// document count is checked against Mongo and only then is the read alias
+// moved to it in one atomic step. A failed build is deleted and the alias is
+// left untouched.
+func ReindexData(connection *MongoDBConnection, esClient *elasticsearch.Client, dataset string, opts ReindexOptions) (ReindexResult, error) {
+	collection := poemsCollection(connection)
 	filter := bson.D{{
 		Key:   "dataset",
 		Value: dataset,
 	}}
-	cursor, err := collection.Find(context.TODO(), filter)
+
+	if err := ensureNotConcreteIndex(esClient, opts.Alias); err != nil {
+		return ReindexResult{}, err
+	}
+
+	oldIndices, err := datasetAliasIndices(esClient, opts.Alias, dataset)
 	if err != nil {
-		fmt.Println("collection err")
-		return err
+		return ReindexResult{}, err
 	}
-	defer func(cursor *mongo.Cursor) {
-		err := cursor.Close(context.TODO())
-		if err != nil {
-			// Handle or log the error
+
+	result := ReindexResult{Index: versionedIndexName(opts.Alias, dataset, time.Now())}
+	if err := CreateIndex(esClient, result.Index); err != nil {
+		return result, err
+	}
+
+	result.BulkSummary, err = indexDocuments(collection, esClient, filter, result.Index, opts.Bulk)
+	if err == nil {
+		err = publishIndex(collection, esClient, filter, result.Index, opts.Alias, oldIndices)
+	}
+	if err != nil {
+		if deleteErr := deleteIndices(esClient, []string{result.Index}); deleteErr != nil {
+			log.Printf("Failed to delete incomplete index %s: %v", result.Index, deleteErr)
 		}
-	}(cursor)
+		return result, err
+	}
 
-	// Prepare bulk request
-	var bulkRequest strings.Builder
+	if opts.DeleteOld {
+		if err := deleteIndices(esClient, oldIndices); err != nil {
+			return result, err
+		}
+	}
 
-	// Wait group to wait for all workers to finish
-	var wg sync.WaitGroup
+	return result, nil
+}
 
-	// Channel to signal completion of each worker
-	workerDone := make(chan struct{})
+// publishIndex verifies the freshly built indexName and swaps alias over to
+// it.
+func publishIndex(collection *mongo.Collection, esClient *elasticsearch.Client, filter bson.D, indexName string, alias string, oldIndices []string) error {
+	if err := refreshIndex(esClient, indexName); err != nil {
+		return err
+	}
+
+	expected, err := collection.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return fmt.Errorf("failed to count source documents: %v", err)
+	}
+	indexed, err := countIndexDocuments(esClient, indexName)
+	if err != nil {
+		return err
+	}
+	if indexed != expected {
+		return fmt.Errorf("index %s holds %d documents, expected %d from MongoDB", indexName, indexed, expected)
+	}
 
-	// Channel to send bulk requests to workers
-	bulkRequests := make(chan string, numWorkers)
+	return swapAlias(esClient, alias, indexName, oldIndices)
+}
 
-	// Start worker goroutines
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
+// documentID returns the Elasticsearch _id of a Mongo poem document: the hex
+// form of its ObjectID, or the _id itself when it was stored as a string.
+// Documents without an _id fall back to their dataset and dataset_id.
+func documentID(document bson.M) string {
+	switch id := document["_id"].(type) {
+	case primitive.ObjectID:
+		return id.Hex()
+	case string:
+		return id
+	case nil:
+		return fmt.Sprintf("%v:%v", document["dataset"], document["dataset_id"])
+	default:
+		return fmt.Sprint(id)
+	}
+}
 
-		go func() {
-			defer wg.Done()
-			go worker(context.Background(), esClient, indexName, bulkRequests, workerDone, &wg)
-		}()
+// searchDocument converts a Mongo poem document into its Elasticsearch _id and
+// JSON source. The document is keyed by its Mongo _id so reindexing
+// overwrites instead of duplicating, and hits can be traced back to Mongo.
+// Title and poem are also copied into the language fields of the poem's
+// language.
+func searchDocument(document bson.M) (string, []byte, error) {
+	id := documentID(document)
+	delete(document, "_id")
+	addLanguageFields(document)
+
+	source, err := bson.MarshalExtJSON(document, false, false)
+	if err != nil {
+		return id, nil, fmt.Errorf("failed to encode poem %s: %v", id, err)
 	}
+	return id, source, nil
+}
 
-	// Iterate over MongoDB documents and append to bulk request
-	for cursor.Next(context.TODO()) {
-		var document bson.M
-		if err := cursor.Decode(&document); err != nil {
-			fmt.Println("reading err")
-			select {
-			case bulkRequests <- bulkRequest.String():
-			default:
-				// Handle the case when the channel is closed
-				fmt.Println("closed -1")
-			}
-			close(bulkRequests)
-			wg.Done()
-			return err
+// indexDocuments bulk-writes every document matching filter into indexName.
+func indexDocuments(collection *mongo.Collection, esClient *elasticsearch.Client, filter bson.D, indexName string, opts BulkOptions) (BulkSummary, error) {
+	ctx := context.TODO()
+
+	// Retrieve data from MongoDB
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return BulkSummary{}, fmt.Errorf("failed to read poems from MongoDB: %v", err)
+	}
+	defer func(cursor *mongo.Cursor) {
+		if err := cursor.Close(ctx); err != nil {
+			log.Printf("Error closing MongoDB cursor: %v", err)
 		}
+	}(cursor)
 
-		delete(document, "_id")
+	indexer := NewBulkIndexer(ctx, esClient, indexName, opts)
 
-		// Prepare the action line for the bulk request
-		bulkRequest.WriteString(fmt.Sprintf(`{"index":{"_index":"%s"}}%s`, indexName, "\n"))
+	// Iterate over MongoDB documents and feed them to the bulk indexer
+	for cursor.Next(ctx) {
+		var document bson.M
+		if err := cursor.Decode(&document); err != nil {
+			summary, _ := indexer.Close(ctx)
+			return summary, fmt.Errorf("failed to decode poem: %v", err)
+		}
 
-		// Convert document to JSON and append to bulk request
-		documentString, err := bson.MarshalExtJSON(document, false, false)
+		id, documentJSON, err := searchDocument(document)
 		if err != nil {
-			select {
-			case bulkRequests <- bulkRequest.String():
-			default:
-				// Handle the case when the channel is closed
-				fmt.Println("closed 0")
-			}
-			close(bulkRequests)
-			wg.Wait()
-			return err
+			summary, _ := indexer.Close(ctx)
+			return summary, err
 		}
-		bulkRequest.WriteString(fmt.Sprintf("%s%s", string(documentString), "\n"))
-
-		// Send bulk request to workers when batch size is reached
-		if bulkRequest.Len() > 10*1024 { // Adjust the threshold based on your requirements
-			select {
-			case bulkRequests <- bulkRequest.String():
-			default:
-				// Handle the case when the channel is closed
-			}
-			bulkRequest.Reset()
+
+		if err := indexer.Add(ctx, id, documentJSON); err != nil {
+			summary, _ := indexer.Close(ctx)
+			return summary, err
 		}
 	}
 
-	// Send any remaining documents as a final bulk request
-	if bulkRequest.Len() > 0 {
-		select {
-		case bulkRequests <- bulkRequest.String():
-		default:
-			// Handle the case when the channel is closed
-		}
+	summary, err := indexer.Close(ctx)
+	if err != nil {
+		return summary, err
+	}
+	if err := cursor.Err(); err != nil {
+		return summary, fmt.Errorf("failed to read poems from MongoDB: %v", err)
+	}
+	if summary.Failed > 0 {
+		return summary, fmt.Errorf("%d documents failed to index", summary.Failed)
 	}
+	return summary, nil
+}
+
+// PoemsAlias is the read alias queried by SearchData. It points at one
+// versioned index per dataset, see ReindexData.
+const PoemsAlias = "poems"
 
-	// Close the bulk request channel to signal workers to finish
-	once.Do(func() {
-		close(bulkRequests)
-	})
+// searchFields are the poem fields matched by a full-text query, with boosts.
+var searchFields = []string{"title^3", "poet^2", "tags^2", "poem"}
 
-	wg.Wait()
+// facetFields maps the filterable poem fields to the keyword fields used for
+// exact filtering and aggregations.
+var facetFields = map[string]string{
+	"language": keywordField("language"),
+	"dataset":  keywordField("dataset"),
+	"poet":     keywordField("poet"),
+	"tags":     keywordField("tags"),
+}
 
-	// Close the workerDone channel to release any waiting goroutines
-	close(workerDone)
+// FacetNames lists the facets returned with every search, in display order.
+var FacetNames = []string{"language", "dataset", "poet", "tags"}
 
-	return nil
+const facetSize = 20
+
+type SearchParams struct {
+	Query string
+	// Filters restricts hits to poems whose facet field matches any of the
+	// given values, keyed by facet name.
+	Filters map[string][]string
+	Page    int
+	Size    int
+}
+
+type FacetBucket struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
 }
 
-func worker(ctx context.Context, esClient *elasticsearch.Client, indexName string, bulkRequests <-chan string, workerDone chan<- struct{}, wg *sync.WaitGroup) {
-	defer wg.Done()
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Worker panic:", r)
+type SearchHit struct {
+	Poem
+	Score     float64             `json:"score"`
+	Highlight map[string][]string `json:"highlight,omitempty"`
+}
+
+type SearchResult struct {
+	Total  int64                    `json:"total"`
+	Page   int                      `json:"page"`
+	Size   int                      `json:"size"`
+	Hits   []SearchHit              `json:"hits"`
+	Facets map[string][]FacetBucket `json:"facets"`
+}
+
+type searchResponse struct {
+	Hits struct {
+		Total struct {
+			Value int64 `json:"value"`
+		} `json:"total"`
+		Hits []struct {
+			ID        string              `json:"_id"`
+			Score     float64             `json:"_score"`
+			Source    Poem                `json:"_source"`
+			Highlight map[string][]string `json:"highlight"`
+		} `json:"hits"`
+	} `json:"hits"`
+	Aggregations map[string]struct {
+		Values struct {
+			Buckets []struct {
+				Key      string `json:"key"`
+				DocCount int64  `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"values"`
+	} `json:"aggregations"`
+}
+
+func buildSearchQuery(params SearchParams) map[string]interface{} {
+	must := map[string]interface{}{"match_all": map[string]interface{}{}}
+	if params.Query != "" {
+		must = map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":  params.Query,
+				"fields": languageSearchFields(searchFields, params.Filters["language"]),
+				"type":   "best_fields",
+			},
 		}
-	}()
-
-processingLoop:
-	for {
-		select {
-		case bulkRequest, ok := <-bulkRequests:
-			if !ok {
-				// Channel closed, no more requests
-				break processingLoop
-			}
+	}
 
-			// Send bulk request to Elasticsearch
-			response, err := esapi.BulkRequest{
-				Index:   indexName,
-				Body:    strings.NewReader(bulkRequest),
-				Refresh: "false",
-			}.Do(ctx, esClient)
-			if err != nil {
-				fmt.Println("Error during bulk request:", err)
-				break processingLoop
+	// Facet selections narrow the hits through post_filter rather than the
+	// query, so each facet's counts can apply every selection but its own
+	// and still offer the values not picked yet.
+	selections := map[string]interface{}{}
+	for _, name := range FacetNames {
+		if values := params.Filters[name]; len(values) > 0 {
+			selections[name] = map[string]interface{}{
+				"terms": map[string]interface{}{facetFields[name]: values},
 			}
-
-			// Check for errors in the response
-			if response.IsError() {
-				fmt.Printf("Error response after bulk request: %s\n", response.String())
-				break processingLoop
+		}
+	}
+	selected := func(except string) []interface{} {
+		filters := []interface{}{}
+		for _, name := range FacetNames {
+			if selection, ok := selections[name]; ok && name != except {
+				filters = append(filters, selection)
 			}
-
-		case <-ctx.Done():
-			// Timeout reached, stop processing
-			break processingLoop
 		}
+		return filters
+	}
 
+	aggregations := map[string]interface{}{}
+	for _, name := range FacetNames {
+		aggregations[name] = map[string]interface{}{
+			"filter": map[string]interface{}{
+				"bool": map[string]interface{}{"filter": selected(name)},
+			},
+			"aggs": map[string]interface{}{
+				"values": map[string]interface{}{
+					"terms": map[string]interface{}{"field": facetFields[name], "size": facetSize},
+				},
+			},
+		}
 	}
 
-	// Signal completion to the main function
-	workerDone <- struct{}{}
+	query := map[string]interface{}{
+		"from": (params.Page - 1) * params.Size,
+		"size": params.Size,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": must,
+			},
+		},
+		"aggs": aggregations,
+		"highlight": map[string]interface{}{
+			"fields": map[string]interface{}{
+				"title": map[string]interface{}{"number_of_fragments": 0},
+				"poem":  map[string]interface{}{"fragment_size": 150, "number_of_fragments": 3},
+			},
+		},
+		"track_total_hits": true,
+	}
+	if len(selections) > 0 {
+		query["post_filter"] = map[string]interface{}{
+			"bool": map[string]interface{}{"filter": selected("")},
+		}
+	}
+	return query
 }
 
-func SearchData(esClient *elasticsearch.Client, query string) error {
+// SearchData runs a full-text query over title, poem, poet and tags, narrowed
+// by the requested facet filters, and returns one page of ranked hits together
+// with facet counts for the whole result set. An empty query matches every
+// poem, which lets callers browse by filters alone.
+func SearchData(esClient *elasticsearch.Client, params SearchParams) (*SearchResult, error) {
+	body, err := json.Marshal(buildSearchQuery(params))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode search query: %v", err)
+	}
+
 	searchRequest := esapi.SearchRequest{
-		Index: []string{"poems"},
-		Body:  strings.NewReader(fmt.Sprintf(`{"query":{"match":{"field":"%s"}}}`, query)),
+		Index: []string{PoemsAlias},
+		Body:  bytes.NewReader(body),
 	}
 
 	response, err := searchRequest.Do(context.Background(), esClient)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
+	defer response.Body.Close()
 
-		}
-	}(response.Body)
+	if response.IsError() {
+		return nil, fmt.Errorf("error searching poems: %s", response.String())
+	}
 
-	// TODO Process the search response
+	var decoded searchResponse
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode search response: %v", err)
+	}
 
-	return nil
+	result := &SearchResult{
+		Total:  decoded.Hits.Total.Value,
+		Page:   params.Page,
+		Size:   params.Size,
+		Hits:   make([]SearchHit, 0, len(decoded.Hits.Hits)),
+		Facets: make(map[string][]FacetBucket, len(FacetNames)),
+	}
+	for _, name := range FacetNames {
+		buckets := []FacetBucket{}
+		for _, bucket := range decoded.Aggregations[name].Values.Buckets {
+			buckets = append(buckets, FacetBucket{Value: bucket.Key, Count: bucket.DocCount})
+		}
+		result.Facets[name] = buckets
+	}
+	for _, hit := range decoded.Hits.Hits {
+		poem := hit.Source
+		poem.ID = hit.ID
+		result.Hits = append(result.Hits, SearchHit{
+			Poem:      poem,
+			Score:     hit.Score,
+			Highlight: hit.Highlight,
+		})
+	}
+
+	return result, nil
 }
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestElasticsearch returns a client talking to a fake Elasticsearch
+// server backed by handler.
+func newTestElasticsearch(t *testing.T, handler http.HandlerFunc) *elasticsearch.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	require.NoError(t, err)
+	return client
+}
+
+func TestBuildSearchQuery(t *testing.T) {
+	query := buildSearchQuery(SearchParams{Query: "autumn moon", Page: 3, Size: 20})
+
+	assert.Equal(t, 40, query["from"])
+	assert.Equal(t, 20, query["size"])
+
+	boolQuery := query["query"].(map[string]interface{})["bool"].(map[string]interface{})
+	multiMatch := boolQuery["must"].(map[string]interface{})["multi_match"].(map[string]interface{})
+	assert.Equal(t, "autumn moon", multiMatch["query"])
+	assert.Equal(t, languageSearchFields(searchFields, nil), multiMatch["fields"])
+	assert.NotContains(t, boolQuery, "filter")
+	assert.NotContains(t, query, "post_filter")
+}
+
+func TestBuildSearchQueryFilters(t *testing.T) {
+	query := buildSearchQuery(SearchParams{
+		Filters: map[string][]string{
+			"language": {"russian", "arabic"},
+			"tags":     {"love"},
+		},
+		Page: 1,
+		Size: 10,
+	})
+
+	boolQuery := query["query"].(map[string]interface{})["bool"].(map[string]interface{})
+	assert.Contains(t, boolQuery["must"], "match_all")
+	assert.NotContains(t, boolQuery, "filter")
+
+	languageFilter := map[string]interface{}{"terms": map[string]interface{}{"language.keyword": []string{"russian", "arabic"}}}
+	tagsFilter := map[string]interface{}{"terms": map[string]interface{}{"tags.keyword": []string{"love"}}}
+	postFilter := query["post_filter"].(map[string]interface{})["bool"].(map[string]interface{})
+	assert.Equal(t, []interface{}{languageFilter, tagsFilter}, postFilter["filter"])
+
+	// Each facet counts the hits of the other facets' selections only.
+	aggregations := query["aggs"].(map[string]interface{})
+	facetFilter := func(name string) interface{} {
+		aggregation := aggregations[name].(map[string]interface{})
+		return aggregation["filter"].(map[string]interface{})["bool"].(map[string]interface{})["filter"]
+	}
+	assert.Equal(t, []interface{}{tagsFilter}, facetFilter("language"))
+	assert.Equal(t, []interface{}{languageFilter}, facetFilter("tags"))
+	assert.Equal(t, []interface{}{languageFilter, tagsFilter}, facetFilter("poet"))
+	for _, name := range FacetNames {
+		assert.Contains(t, aggregations, name)
+	}
+}
+
+func TestSearchData(t *testing.T) {
+	var requestBody map[string]interface{}
+	client := newTestElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/"+PoemsAlias+"/_search", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &requestBody))
+
+		io.WriteString(w, `{
+			"hits": {
+				"total": {"value": 42, "relation": "eq"},
+				"hits": [{
+					"_id": "abc",
+					"_score": 7.5,
+					"_source": {"dataset": "eurovision-kaggle", "title": "Waterloo", "poem": "My, my", "poet": "ABBA", "tags": ["1974"], "language": "english"},
+					"highlight": {"title": ["<em>Waterloo</em>"]}
+				}]
+			},
+			"aggregations": {
+				"language": {"doc_count": 42, "values": {"buckets": [{"key": "english", "doc_count": 40}, {"key": "swedish", "doc_count": 2}]}},
+				"dataset": {"doc_count": 42, "values": {"buckets": [{"key": "eurovision-kaggle", "doc_count": 42}]}},
+				"poet": {"doc_count": 42, "values": {"buckets": []}},
+				"tags": {"doc_count": 42, "values": {"buckets": []}}
+			}
+		}`)
+	})
+
+	result, err := SearchData(client, SearchParams{Query: "waterloo", Page: 1, Size: 10})
+	require.NoError(t, err)
+
+	assert.Contains(t, requestBody, "aggs")
+	assert.Equal(t, int64(42), result.Total)
+	require.Len(t, result.Hits, 1)
+
+	hit := result.Hits[0]
+	assert.Equal(t, "abc", hit.ID)
+	assert.Equal(t, "Waterloo", hit.Title)
+	assert.Equal(t, "ABBA", hit.Poet)
+	assert.Equal(t, []string{"1974"}, hit.Tags)
+	assert.Equal(t, 7.5, hit.Score)
+	assert.Equal(t, []string{"<em>Waterloo</em>"}, hit.Highlight["title"])
+
+	assert.Equal(t, []FacetBucket{{Value: "english", Count: 40}, {Value: "swedish", Count: 2}}, result.Facets["language"])
+	assert.Equal(t, []FacetBucket{{Value: "eurovision-kaggle", Count: 42}}, result.Facets["dataset"])
+	assert.Equal(t, []FacetBucket{}, result.Facets["poet"])
+}
+
+func TestSearchDataError(t *testing.T) {
+	client := newTestElasticsearch(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error": {"type": "parsing_exception"}}`)
+	})
+
+	_, err := SearchData(client, SearchParams{Query: "waterloo", Page: 1, Size: 10})
+	assert.Error(t, err)
+}
+
+func TestDocumentID(t *testing.T) {
+	objectID := primitive.NewObjectID()
+
+	assert.Equal(t, objectID.Hex(), documentID(bson.M{"_id": objectID, "dataset": "eurovision-kaggle"}))
+	assert.Equal(t, "custom-id", documentID(bson.M{"_id": "custom-id"}))
+	assert.Equal(t, "eurovision-kaggle:42", documentID(bson.M{"dataset": "eurovision-kaggle", "dataset_id": "42"}))
+}
+
+func TestSearchDocumentAddsLanguageFields(t *testing.T) {
+	id, source, err := searchDocument(bson.M{"_id": "custom-id", "title": "Moon", "poem": "The moon rose", "language": "english"})
+	require.NoError(t, err)
+	assert.Equal(t, "custom-id", id)
+
+	var document map[string]interface{}
+	require.NoError(t, json.Unmarshal(source, &document))
+	assert.Equal(t, "The moon rose", document["poem_english"])
+	assert.Equal(t, "Moon", document["title_english"])
+	assert.NotContains(t, document, "poem_russian")
+	assert.NotContains(t, document, "_id")
+}
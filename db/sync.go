@@ -0,0 +1,247 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// syncStateCollection stores the change stream resume token of each sync
+// process, keyed by the alias it maintains.
+const syncStateCollection = "sync_state"
+
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   bson.M `bson:"documentKey"`
+	FullDocument  bson.M `bson:"fullDocument"`
+	// FullDocumentBeforeChange is only present when pre-images are enabled
+	// on the poems collection.
+	FullDocumentBeforeChange bson.M             `bson:"fullDocumentBeforeChange"`
+	UpdateDescription        *updateDescription `bson:"updateDescription"`
+}
+
+type updateDescription struct {
+	UpdatedFields bson.M   `bson:"updatedFields"`
+	RemovedFields []string `bson:"removedFields"`
+}
+
+type syncState struct {
+	ID          string    `bson:"_id"`
+	ResumeToken bson.Raw  `bson:"resume_token"`
+	UpdatedAt   time.Time `bson:"updated_at"`
+}
+
+// SyncChanges tails the poems collection change stream and mirrors inserts,
+// updates and deletes into the indices behind alias until ctx is cancelled.
+// The resume token is saved after every applied change, so a restarted sync
+// continues where the previous one stopped instead of needing a full
+// reindex. Change streams require MongoDB to run as a replica set.
+//
+// Pre-images are enabled on the poems collection so replaced poems carry
+// their previous dataset; on servers without pre-images every replacement is
+// treated as a possible dataset change.
+func SyncChanges(ctx context.Context, connection *MongoDBConnection, esClient *elasticsearch.Client, alias string) error {
+	database := connection.Client.Database(connection.Database)
+	collection := database.Collection("poems")
+	states := database.Collection(syncStateCollection)
+	stateID := "poems:" + alias
+
+	err := database.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: "poems"},
+		{Key: "changeStreamPreAndPostImages", Value: bson.D{{Key: "enabled", Value: true}}},
+	}).Err()
+	if err != nil {
+		log.Printf("Could not enable pre-images on poems, replacements will be removed from every other index: %v", err)
+	}
+
+	streamOptions := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+
+	var state syncState
+	err = states.FindOne(ctx, bson.D{{Key: "_id", Value: stateID}}).Decode(&state)
+	switch {
+	case err == nil:
+		streamOptions.SetResumeAfter(state.ResumeToken)
+		log.Printf("Resuming change stream sync for alias %s from token saved at %s", alias, state.UpdatedAt.Format(time.RFC3339))
+	case err == mongo.ErrNoDocuments:
+		log.Printf("Starting change stream sync for alias %s from now", alias)
+	default:
+		return fmt.Errorf("failed to load sync state: %v", err)
+	}
+
+	pipeline := mongo.Pipeline{{{
+		Key: "$match", Value: bson.D{{
+			Key: "operationType", Value: bson.D{{
+				Key: "$in", Value: bson.A{"insert", "update", "replace", "delete"},
+			}},
+		}},
+	}}}
+
+	stream, err := collection.Watch(ctx, pipeline, streamOptions)
+	if err != nil {
+		return fmt.Errorf("failed to open change stream: %v", err)
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var event changeEvent
+		if err := stream.Decode(&event); err != nil {
+			return fmt.Errorf("failed to decode change event: %v", err)
+		}
+
+		if err := applyChange(esClient, alias, event); err != nil {
+			return err
+		}
+
+		_, err := states.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: stateID}},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "resume_token", Value: stream.ResumeToken()},
+				{Key: "updated_at", Value: time.Now()},
+			}}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to save sync state: %v", err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	return stream.Err()
+}
+
+// applyChange mirrors a single change event into the search indices.
+func applyChange(esClient *elasticsearch.Client, alias string, event changeEvent) error {
+	id := documentID(event.DocumentKey)
+
+	// An update lookup returns no document when the poem was deleted before
+	// the event was read; the delete event that follows removes it too.
+	if event.OperationType == "delete" || event.FullDocument == nil {
+		return deleteFromAlias(esClient, alias, id, "")
+	}
+
+	dataset, _ := event.FullDocument["dataset"].(string)
+	indexName, err := datasetWriteIndex(esClient, alias, dataset)
+	if err != nil {
+		return err
+	}
+
+	_, source, err := searchDocument(event.FullDocument)
+	if err != nil {
+		return err
+	}
+
+	response, err := esClient.Index(indexName, bytes.NewReader(source), esClient.Index.WithDocumentID(id))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.IsError() {
+		return fmt.Errorf("error indexing poem %s into %s: %s", id, indexName, response.String())
+	}
+
+	// A poem moved to another dataset still has a copy in its old index.
+	if datasetChanged(event) {
+		return deleteFromAlias(esClient, alias, id, indexName)
+	}
+	return nil
+}
+
+// datasetChanged reports whether the poem of an insert, update or replace
+// event may have moved from another dataset. Without a pre-image the
+// previous dataset of a replaced poem is unknown, so it counts as changed.
+func datasetChanged(event changeEvent) bool {
+	switch {
+	case event.OperationType == "insert":
+		return false
+	case event.FullDocumentBeforeChange != nil:
+		return event.FullDocumentBeforeChange["dataset"] != event.FullDocument["dataset"]
+	case event.OperationType == "update" && event.UpdateDescription != nil:
+		if _, ok := event.UpdateDescription.UpdatedFields["dataset"]; ok {
+			return true
+		}
+		for _, field := range event.UpdateDescription.RemovedFields {
+			if field == "dataset" {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// datasetWriteIndex returns the index receiving new documents of dataset.
+// When the dataset has not been indexed yet, a versioned index is created for
+// it and added to alias.
+func datasetWriteIndex(esClient *elasticsearch.Client, alias, dataset string) (string, error) {
+	indices, err := datasetAliasIndices(esClient, alias, dataset)
+	if err != nil {
+		return "", err
+	}
+	if len(indices) > 0 {
+		// Versioned names sort by timestamp, so the last one is the newest.
+		return indices[len(indices)-1], nil
+	}
+
+	indexName := versionedIndexName(alias, dataset, time.Now())
+	if err := CreateIndex(esClient, indexName); err != nil {
+		return "", err
+	}
+	if err := swapAlias(esClient, alias, indexName, nil); err != nil {
+		return "", err
+	}
+	log.Printf("Created index %s for new dataset %q", indexName, dataset)
+	return indexName, nil
+}
+
+// deleteFromAlias removes the poem with id from every index behind alias
+// except keepIndex.
+func deleteFromAlias(esClient *elasticsearch.Client, alias, id, keepIndex string) error {
+	query := map[string]interface{}{
+		"ids": map[string]interface{}{"values": []string{id}},
+	}
+	if keepIndex != "" {
+		query = map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":     query,
+				"must_not": map[string]interface{}{"term": map[string]interface{}{"_index": keepIndex}},
+			},
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"query": query})
+	if err != nil {
+		return fmt.Errorf("failed to encode delete query: %v", err)
+	}
+
+	response, err := esClient.DeleteByQuery([]string{alias}, bytes.NewReader(body),
+		esClient.DeleteByQuery.WithConflicts("proceed"),
+	)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// Nothing has been indexed behind alias yet.
+	if response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if response.IsError() {
+		return fmt.Errorf("error deleting poem %s from %s: %s", id, alias, response.String())
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Body   map[string]interface{}
+}
+
+// recordingElasticsearch answers alias lookups with indices and acknowledges
+// every other request, recording them in order.
+func recordingElasticsearch(t *testing.T, indices string) (*[]recordedRequest, func(http.ResponseWriter, *http.Request)) {
+	var mu sync.Mutex
+	var requests []recordedRequest
+	return &requests, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_alias/poems" {
+			io.WriteString(w, indices)
+			return
+		}
+
+		var body map[string]interface{}
+		if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+			require.NoError(t, json.Unmarshal(data, &body))
+		}
+		mu.Lock()
+		requests = append(requests, recordedRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Body: body})
+		mu.Unlock()
+		io.WriteString(w, `{"result": "ok"}`)
+	}
+}
+
+func TestApplyChangeInsert(t *testing.T) {
+	requests, handler := recordingElasticsearch(t, `{"poems-eurovision-kaggle-20240101000000": {"aliases": {"poems": {}}}}`)
+	client := newTestElasticsearch(t, handler)
+	id := primitive.NewObjectID()
+
+	err := applyChange(client, "poems", changeEvent{
+		OperationType: "insert",
+		DocumentKey:   bson.M{"_id": id},
+		FullDocument:  bson.M{"_id": id, "dataset": "eurovision-kaggle", "title": "Waterloo"},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, *requests, 1)
+	assert.Equal(t, "/poems-eurovision-kaggle-20240101000000/_doc/"+id.Hex(), (*requests)[0].Path)
+	assert.Equal(t, map[string]interface{}{"dataset": "eurovision-kaggle", "title": "Waterloo"}, (*requests)[0].Body)
+}
+
+func TestApplyChangeUpdateRemovesOtherCopies(t *testing.T) {
+	requests, handler := recordingElasticsearch(t, `{"poems-eurovision-kaggle-20240101000000": {"aliases": {"poems": {}}}}`)
+	client := newTestElasticsearch(t, handler)
+	id := primitive.NewObjectID()
+
+	err := applyChange(client, "poems", changeEvent{
+		OperationType:     "update",
+		DocumentKey:       bson.M{"_id": id},
+		FullDocument:      bson.M{"_id": id, "dataset": "eurovision-kaggle", "title": "Waterloo"},
+		UpdateDescription: &updateDescription{UpdatedFields: bson.M{"dataset": "eurovision-kaggle"}},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, *requests, 2)
+	assert.Equal(t, "/poems/_delete_by_query", (*requests)[1].Path)
+	assert.Contains(t, (*requests)[1].Body["query"], "bool")
+	assert.NotContains(t, (*requests)[1].Query, "refresh")
+}
+
+func TestApplyChangeKeepsDatasetWithoutDelete(t *testing.T) {
+	id := primitive.NewObjectID()
+	document := bson.M{"_id": id, "dataset": "eurovision-kaggle", "title": "Waterloo"}
+
+	events := map[string]changeEvent{
+		"update": {
+			OperationType:     "update",
+			DocumentKey:       bson.M{"_id": id},
+			FullDocument:      document,
+			UpdateDescription: &updateDescription{UpdatedFields: bson.M{"title": "Waterloo"}},
+		},
+		"replace": {
+			OperationType:            "replace",
+			DocumentKey:              bson.M{"_id": id},
+			FullDocument:             document,
+			FullDocumentBeforeChange: bson.M{"_id": id, "dataset": "eurovision-kaggle", "title": "Waterlo"},
+		},
+	}
+	for name, event := range events {
+		t.Run(name, func(t *testing.T) {
+			requests, handler := recordingElasticsearch(t, `{"poems-eurovision-kaggle-20240101000000": {"aliases": {"poems": {}}}}`)
+			client := newTestElasticsearch(t, handler)
+
+			require.NoError(t, applyChange(client, "poems", event))
+			require.Len(t, *requests, 1)
+			assert.Equal(t, "/poems-eurovision-kaggle-20240101000000/_doc/"+id.Hex(), (*requests)[0].Path)
+		})
+	}
+}
+
+func TestDatasetChanged(t *testing.T) {
+	document := bson.M{"dataset": "eurovision-kaggle"}
+
+	assert.False(t, datasetChanged(changeEvent{OperationType: "insert", FullDocument: document}))
+	assert.True(t, datasetChanged(changeEvent{OperationType: "replace", FullDocument: document}))
+	assert.True(t, datasetChanged(changeEvent{
+		OperationType:            "replace",
+		FullDocument:             document,
+		FullDocumentBeforeChange: bson.M{"dataset": "poetry-foundation"},
+	}))
+	assert.True(t, datasetChanged(changeEvent{
+		OperationType:     "update",
+		FullDocument:      document,
+		UpdateDescription: &updateDescription{RemovedFields: []string{"dataset"}},
+	}))
+}
+
+func TestApplyChangeDelete(t *testing.T) {
+	requests, handler := recordingElasticsearch(t, `{}`)
+	client := newTestElasticsearch(t, handler)
+	id := primitive.NewObjectID()
+
+	err := applyChange(client, "poems", changeEvent{
+		OperationType: "delete",
+		DocumentKey:   bson.M{"_id": id},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, *requests, 1)
+	assert.Equal(t, "/poems/_delete_by_query", (*requests)[0].Path)
+	assert.Equal(t, map[string]interface{}{
+		"ids": map[string]interface{}{"values": []interface{}{id.Hex()}},
+	}, (*requests)[0].Body["query"])
+}
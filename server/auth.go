@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	db "poetry/db"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyHeader carries the API key of a request. A bearer token in the
+// Authorization header is accepted as well.
+const apiKeyHeader = "X-API-Key"
+
+// apiKeyContextKey stores the authenticated key in the gin context
+const apiKeyContextKey = "api_key"
+
+// apiKeyLookup returns the active stored key matching a presented key, or
+// db.ErrAPIKeyNotFound.
+type apiKeyLookup func(ctx context.Context, key string) (*db.APIKey, error)
+
+// presentedKey returns the API key sent with the request, if any
+func presentedKey(c *gin.Context) string {
+	if key := c.GetHeader(apiKeyHeader); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// authenticate looks up the presented key, answering 401 for unknown keys
+// and 500 when the lookup fails. It returns nil once it has answered.
+func authenticate(c *gin.Context, lookup apiKeyLookup, key string) *db.APIKey {
+	record, err := lookup(c.Request.Context(), key)
+	if errors.Is(err, db.ErrAPIKeyNotFound) {
+		c.AbortWithStatusJSON(401, gin.H{"error": "Invalid API key"})
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to check API key: %v", err)
+		c.AbortWithStatusJSON(500, gin.H{"error": "Unable to check API key"})
+		return nil
+	}
+	return record
+}
+
+// requireRole only lets requests through whose API key has at least role,
+// answering 401 for missing or unknown keys and 403 for insufficient roles.
+func requireRole(lookup apiKeyLookup, role db.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := presentedKey(c)
+		if key == "" {
+			c.AbortWithStatusJSON(401, gin.H{"error": "API key required"})
+			return
+		}
+
+		record := authenticate(c, lookup, key)
+		if record == nil {
+			return
+		}
+		if !record.Role.Allows(role) {
+			c.AbortWithStatusJSON(403, gin.H{"error": fmt.Sprintf("API key lacks the %s role", role)})
+			return
+		}
+		c.Set(apiKeyContextKey, record)
+		c.Next()
+	}
+}
+
+// optionalAPIKey lets anonymous requests through to public routes, but
+// checks a presented key like requireRole, so keyed clients are rate
+// limited per key rather than per IP.
+func optionalAPIKey(lookup apiKeyLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := presentedKey(c)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		record := authenticate(c, lookup, key)
+		if record == nil {
+			return
+		}
+		c.Set(apiKeyContextKey, record)
+		c.Next()
+	}
+}
+
+// withAPIKey only runs handler for requests presenting an API key.
+func withAPIKey(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if presentedKey(c) == "" {
+			c.Next()
+			return
+		}
+		handler(c)
+	}
+}
+
+// CreateAPIKeyRequest is the body of POST /api-keys
+type CreateAPIKeyRequest struct {
+	Name string `json:"name" binding:"required"`
+	Role string `json:"role" binding:"required"`
+}
+
+func createAPIKey(c *gin.Context, connection *db.MongoDBConnection) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	role, err := db.ParseRole(req.Role)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	record, key, err := db.CreateAPIKey(c.Request.Context(), connection, req.Name, role)
+	if err != nil {
+		log.Printf("Failed to create API key: %v", err)
+		c.JSON(500, gin.H{"error": "Unable to create API key"})
+		return
+	}
+
+	// The key cannot be recovered later, only its hash is stored.
+	c.JSON(201, gin.H{"api_key": record, "key": key})
+}
+
+func listAPIKeys(c *gin.Context, connection *db.MongoDBConnection) {
+	keys, err := db.ListAPIKeys(c.Request.Context(), connection)
+	if err != nil {
+		log.Printf("Failed to list API keys: %v", err)
+		c.JSON(500, gin.H{"error": "Unable to list API keys"})
+		return
+	}
+	c.JSON(200, gin.H{"api_keys": keys})
+}
+
+func revokeAPIKey(c *gin.Context, connection *db.MongoDBConnection) {
+	err := db.RevokeAPIKey(c.Request.Context(), connection, c.Param("id"))
+	if errors.Is(err, db.ErrAPIKeyNotFound) {
+		c.JSON(404, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke API key: %v", err)
+		c.JSON(500, gin.H{"error": "Unable to revoke API key"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	db "poetry/db"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeLookup(keys map[string]db.Role) apiKeyLookup {
+	return func(ctx context.Context, key string) (*db.APIKey, error) {
+		if key == "broken" {
+			return nil, errors.New("connection refused")
+		}
+		role, ok := keys[key]
+		if !ok {
+			return nil, db.ErrAPIKeyNotFound
+		}
+		return &db.APIKey{Name: key, Role: role}, nil
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	lookup := fakeLookup(map[string]db.Role{
+		"reader-key":      db.RoleReader,
+		"contributor-key": db.RoleContributor,
+		"admin-key":       db.RoleAdmin,
+	})
+
+	router := gin.New()
+	router.POST("/poem", requireRole(lookup, db.RoleContributor), func(c *gin.Context) {
+		record := c.MustGet(apiKeyContextKey).(*db.APIKey)
+		c.JSON(200, gin.H{"name": record.Name})
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"missing key", "", "", http.StatusUnauthorized},
+		{"unknown key", apiKeyHeader, "nope", http.StatusUnauthorized},
+		{"lookup failure", apiKeyHeader, "broken", http.StatusInternalServerError},
+		{"role too low", apiKeyHeader, "reader-key", http.StatusForbidden},
+		{"exact role", apiKeyHeader, "contributor-key", http.StatusOK},
+		{"higher role", apiKeyHeader, "admin-key", http.StatusOK},
+		{"bearer token", "Authorization", "Bearer contributor-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/poem", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
+
+func TestOptionalAPIKey(t *testing.T) {
+	lookup := fakeLookup(map[string]db.Role{"reader-key": db.RoleReader})
+	store := newMemoryRateLimitStore()
+
+	router := gin.New()
+	router.GET("/search", withAPIKey(limitRate(store, "auth", rateLimit{Rate: 1, Burst: 1})), optionalAPIKey(lookup), limitRate(store, "read", rateLimit{Rate: 1, Burst: 2}), func(c *gin.Context) {
+		name := ""
+		if record, ok := c.Get(apiKeyContextKey); ok {
+			name = record.(*db.APIKey).Name
+		}
+		c.JSON(200, gin.H{"name": name})
+	})
+
+	search := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/search", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	anonymous := search("")
+	assert.Equal(t, http.StatusOK, anonymous.Code)
+	assert.JSONEq(t, `{"name": ""}`, anonymous.Body.String())
+
+	keyed := search("reader-key")
+	assert.Equal(t, http.StatusOK, keyed.Code)
+	assert.JSONEq(t, `{"name": "reader-key"}`, keyed.Body.String())
+
+	// The key has its own read bucket, apart from the anonymous one.
+	assert.Equal(t, http.StatusOK, search("").Code)
+	assert.Equal(t, http.StatusTooManyRequests, search("").Code)
+
+	// Presented keys pass the auth limit, so guessing is throttled.
+	assert.Equal(t, http.StatusTooManyRequests, search("nope").Code)
+}
+
+func TestOptionalAPIKeyRejectsUnknownKey(t *testing.T) {
+	router := gin.New()
+	router.GET("/search", optionalAPIKey(fakeLookup(nil)), func(c *gin.Context) {
+		c.JSON(200, gin.H{})
+	})
+
+	req := httptest.NewRequest("GET", "/search", nil)
+	req.Header.Set(apiKeyHeader, "nope")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	router := gin.New()
+	router.POST("/api-keys", func(c *gin.Context) {
+		createAPIKey(c, nil)
+	})
+
+	for _, body := range []string{`{"name": "ci"}`, `{"name": "ci", "role": "owner"}`} {
+		req := httptest.NewRequest("POST", "/api-keys", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
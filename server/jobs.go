@@ -0,0 +1,57 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// proxyToWorker forwards a job status request to the worker service and
+// relays its response unchanged.
+func proxyToWorker(c *gin.Context, path string, query url.Values) {
+	target := getWorkerURL() + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, target, nil)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Unable to create worker request"})
+		return
+	}
+	setWorkerSecret(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Failed to reach worker: %v", err)
+		c.JSON(503, gin.H{"error": "Worker service unavailable"})
+		return
+	}
+	defer resp.Body.Close()
+
+	c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, nil)
+}
+
+// getJob returns the state of a job submitted through POST /poems
+func getJob(c *gin.Context) {
+	proxyToWorker(c, "/jobs/"+url.PathEscape(c.Param("id")), nil)
+}
+
+// listJobs returns the most recent jobs, filtered by the state and limit
+// query parameters
+func listJobs(c *gin.Context) {
+	query := url.Values{}
+	for _, key := range []string{"state", "limit"} {
+		if value := c.Query(key); value != "" {
+			query.Set(key, value)
+		}
+	}
+	proxyToWorker(c, "/jobs", query)
+}
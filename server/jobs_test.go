@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"poetry/worker"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobEndpointsProxyToWorker(t *testing.T) {
+	var requested, secrets []string
+	workerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.RequestURI())
+		secrets = append(secrets, r.Header.Get(worker.SecretHeader))
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/jobs/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"job not found"}`))
+			return
+		}
+		w.Write([]byte(`{"id":"abc","state":"running"}`))
+	}))
+	defer workerServer.Close()
+
+	useWorker(t, workerServer.URL, "s3cret")
+
+	router := gin.New()
+	router.GET("/jobs", listJobs)
+	router.GET("/jobs/:id", getJob)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/jobs/abc", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"abc","state":"running"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/jobs/missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/jobs?state=failed&limit=5&other=1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, []string{"/jobs/abc", "/jobs/missing", "/jobs?limit=5&state=failed"}, requested)
+	assert.Equal(t, []string{"s3cret", "s3cret", "s3cret"}, secrets)
+}
+
+func TestJobEndpointsWorkerUnavailable(t *testing.T) {
+	useWorker(t, "http://127.0.0.1:1", "")
+
+	router := gin.New()
+	router.GET("/jobs/:id", getJob)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/jobs/abc", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+// useWorker points the API at a test worker service until the test ends.
+func useWorker(t *testing.T, rawURL, secret string) {
+	parsed, err := url.Parse(rawURL)
+	require.NoError(t, err)
+
+	previous := workerConfig
+	workerConfig.Host = parsed.Hostname()
+	workerConfig.Port = parsed.Port()
+	workerConfig.Secret = secret
+	t.Cleanup(func() { workerConfig = previous })
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"log"
+	db "poetry/db"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UpdatePoemRequest is the body of PATCH /poems/:id. Only the fields present
+// are changed; required poem fields may not be blanked.
+type UpdatePoemRequest struct {
+	Dataset   *string `json:"dataset"`
+	Title     *string `json:"title" binding:"omitempty,min=1"`
+	Poem      *string `json:"poem" binding:"omitempty,min=1"`
+	Poet      *string `json:"poet"`
+	Tags      *string `json:"tags"`
+	Language  *string `json:"language" binding:"omitempty,min=1"`
+	DatasetId *string `json:"dataset_id"`
+}
+
+// fields returns the bson fields to set for the present request fields.
+func (r UpdatePoemRequest) fields() bson.M {
+	fields := bson.M{}
+	set := func(name string, value *string) {
+		if value != nil {
+			fields[name] = *value
+		}
+	}
+	set("dataset", r.Dataset)
+	set("dataset_id", r.DatasetId)
+	set("title", r.Title)
+	set("poem", r.Poem)
+	set("poet", r.Poet)
+	set("language", r.Language)
+	if r.Tags != nil {
+		fields["tags"] = splitTags(*r.Tags)
+	}
+	return fields
+}
+
+// poemID reads the :id path parameter, answering 400 when it is not a valid
+// poem ID.
+func poemID(c *gin.Context) (primitive.ObjectID, bool) {
+	id, err := db.ParsePoemID(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid poem ID"})
+		return id, false
+	}
+	return id, true
+}
+
+// respondPoemError answers with 404 for missing poems, 409 for changes that
+// would duplicate another poem and 500 otherwise.
+func respondPoemError(c *gin.Context, err error) {
+	if errors.Is(err, db.ErrPoemNotFound) {
+		c.JSON(404, gin.H{"error": "Poem not found"})
+		return
+	}
+	if errors.Is(err, db.ErrDuplicatePoem) {
+		c.JSON(409, gin.H{"error": "Poem duplicates an existing poem"})
+		return
+	}
+	log.Printf("Poem request failed: %v", err)
+	c.JSON(500, gin.H{"error": "Internal server error"})
+}
+
+func getPoem(c *gin.Context, connection *db.MongoDBConnection) {
+	id, ok := poemID(c)
+	if !ok {
+		return
+	}
+
+	poem, err := db.FindPoemByID(c.Request.Context(), connection, id)
+	if err != nil {
+		respondPoemError(c, err)
+		return
+	}
+	c.JSON(200, poem)
+}
+
+func replacePoem(c *gin.Context, connection *db.MongoDBConnection) {
+	id, ok := poemID(c)
+	if !ok {
+		return
+	}
+
+	var req AddPoemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	poem, err := db.ReplacePoem(c.Request.Context(), connection, id, req.toPoem())
+	if err != nil {
+		respondPoemError(c, err)
+		return
+	}
+	c.JSON(200, poem)
+}
+
+func updatePoem(c *gin.Context, connection *db.MongoDBConnection) {
+	id, ok := poemID(c)
+	if !ok {
+		return
+	}
+
+	var req UpdatePoemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	fields := req.fields()
+	if len(fields) == 0 {
+		c.JSON(400, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	poem, err := db.UpdatePoem(c.Request.Context(), connection, id, fields)
+	if err != nil {
+		respondPoemError(c, err)
+		return
+	}
+	c.JSON(200, poem)
+}
+
+func deletePoem(c *gin.Context, connection *db.MongoDBConnection) {
+	id, ok := poemID(c)
+	if !ok {
+		return
+	}
+
+	if err := db.DeletePoem(c.Request.Context(), connection, id); err != nil {
+		respondPoemError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Poem deleted successfully"})
+}
+
+func listPoems(c *gin.Context, connection *db.MongoDBConnection) {
+	page, size, err := parsePagination(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := db.PoemFilter{
+		Dataset:  c.Query("dataset"),
+		Language: c.Query("language"),
+		Poet:     c.Query("poet"),
+	}
+
+	poems, total, err := db.ListPoems(c.Request.Context(), connection, filter, page, size)
+	if err != nil {
+		respondPoemError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"total": total,
+		"page":  page,
+		"size":  size,
+		"poems": poems,
+	})
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func setupPoemsRouter() *gin.Engine {
+	r := gin.Default()
+	// DB is nil: every request below must be rejected before it is used.
+	r.GET("/poems", func(c *gin.Context) { listPoems(c, nil) })
+	r.GET("/poems/:id", func(c *gin.Context) { getPoem(c, nil) })
+	r.PUT("/poems/:id", func(c *gin.Context) { replacePoem(c, nil) })
+	r.PATCH("/poems/:id", func(c *gin.Context) { updatePoem(c, nil) })
+	r.DELETE("/poems/:id", func(c *gin.Context) { deletePoem(c, nil) })
+	return r
+}
+
+func TestPoemsRejectInvalidRequests(t *testing.T) {
+	router := setupPoemsRouter()
+	validID := "65a1b2c3d4e5f60718293a4b"
+
+	cases := []struct {
+		method string
+		url    string
+		body   string
+	}{
+		{"GET", "/poems/not-an-id", ""},
+		{"DELETE", "/poems/123", ""},
+		{"PUT", "/poems/not-an-id", `{"title": "T", "poem": "P", "language": "english"}`},
+		{"PUT", "/poems/" + validID, `{"title": "T", "poem": "P"}`},
+		{"PATCH", "/poems/" + validID, `{}`},
+		{"PATCH", "/poems/" + validID, `{"title": ""}`},
+		{"PATCH", "/poems/" + validID, `not json`},
+		{"GET", "/poems?page=0", ""},
+		{"GET", "/poems?size=500", ""},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, tc.url, bytes.NewBufferString(tc.body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "%s %s %s", tc.method, tc.url, tc.body)
+	}
+}
+
+func TestUpdatePoemRequestFields(t *testing.T) {
+	title := "New Title"
+	tags := "love,war"
+	empty := ""
+
+	fields := UpdatePoemRequest{Title: &title, Tags: &tags, Poet: &empty}.fields()
+
+	assert.Equal(t, bson.M{
+		"title": "New Title",
+		"tags":  []string{"love", "war"},
+		"poet":  "",
+	}, fields)
+}
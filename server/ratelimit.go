@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	db "poetry/db"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimit is a token bucket: clients get Burst requests at once, refilled
+// at Rate requests per second. A zero Rate disables the limit.
+type rateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// retryAfter returns how long a bucket holding tokens takes to hold one.
+func (l rateLimit) retryAfter(tokens float64) time.Duration {
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+}
+
+// rateLimitStore keeps the token buckets of every client.
+type rateLimitStore interface {
+	// Take takes a token from the bucket of key, returning whether there was
+	// one and how many tokens are left.
+	Take(ctx context.Context, key string, limit rateLimit, now time.Time) (bool, float64, error)
+}
+
+// maxMemoryBuckets bounds the buckets a memoryRateLimitStore keeps before
+// forgetting the ones that have refilled
+const maxMemoryBuckets = 10000
+
+// tokenBucket remembers the limit it was filled with, since the read and
+// write scopes share a store with different limits.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   rateLimit
+}
+
+// memoryRateLimitStore keeps buckets in process, so each replica enforces
+// its own limit.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+}
+
+// refill returns the tokens a bucket holds at now
+func (l rateLimit) refill(bucket *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(l.Burst), bucket.tokens+elapsed*l.Rate)
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, limit rateLimit, now time.Time) (bool, float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= maxMemoryBuckets {
+			s.prune(now)
+		}
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = bucket
+	}
+
+	bucket.tokens = limit.refill(bucket, now)
+	bucket.updated = now
+	bucket.limit = limit
+	if bucket.tokens < 1 {
+		return false, bucket.tokens, nil
+	}
+	bucket.tokens--
+	return true, bucket.tokens, nil
+}
+
+// prune forgets buckets that have refilled under their own limit, as a new
+// bucket starts full
+func (s *memoryRateLimitStore) prune(now time.Time) {
+	for key, bucket := range s.buckets {
+		if bucket.limit.refill(bucket, now) >= float64(bucket.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// mongoRateLimitStore shares buckets between API replicas through MongoDB.
+type mongoRateLimitStore struct {
+	connection *db.MongoDBConnection
+}
+
+func (s *mongoRateLimitStore) Take(ctx context.Context, key string, limit rateLimit, now time.Time) (bool, float64, error) {
+	return db.TakeRateLimitToken(ctx, s.connection, key, limit.Rate, limit.Burst, now)
+}
+
+// rateLimitKey identifies the client of a request: its API key once
+// authenticated, its IP address before authentication and on routes that
+// take no key.
+func rateLimitKey(c *gin.Context) string {
+	if value, ok := c.Get(apiKeyContextKey); ok {
+		if record, ok := value.(*db.APIKey); ok {
+			return "key:" + record.ID
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// limitRate answers 429 with a Retry-After header to clients that exceed
+// limit on the routes of scope. Requests are let through when the store
+// fails, so an unavailable store does not take the API down.
+func limitRate(store rateLimitStore, scope string, limit rateLimit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit.Rate <= 0 {
+			c.Next()
+			return
+		}
+
+		allowed, tokens, err := store.Take(c.Request.Context(), scope+":"+rateLimitKey(c), limit, time.Now())
+		if err != nil {
+			log.Printf("Rate limit unavailable: %v", err)
+			c.Next()
+			return
+		}
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(int(tokens)))
+		if !allowed {
+			wait := limit.retryAfter(tokens)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(429, gin.H{"error": fmt.Sprintf("Rate limit exceeded, retry in %s", wait.Round(time.Millisecond))})
+			return
+		}
+		c.Next()
+	}
+}
+
+// newRateLimitStore returns the named store: "memory", or "mongo" to share
+// limits between replicas.
+func newRateLimitStore(ctx context.Context, connection *db.MongoDBConnection, store string) (rateLimitStore, error) {
+	switch store {
+	case "memory":
+		return newMemoryRateLimitStore(), nil
+	case "mongo":
+		if err := db.EnsureRateLimitIndexes(ctx, connection); err != nil {
+			return nil, err
+		}
+		return &mongoRateLimitStore{connection: connection}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q, expected memory or mongo", store)
+	}
+}
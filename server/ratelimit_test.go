@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	db "poetry/db"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	limit := rateLimit{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		allowed, _, err := store.Take(context.Background(), "client", limit, now)
+		assert.NoError(t, err)
+		assert.True(t, allowed, "request %d", i)
+	}
+	allowed, tokens, _ := store.Take(context.Background(), "client", limit, now)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, limit.retryAfter(tokens))
+
+	// Other clients have their own bucket.
+	allowed, _, _ = store.Take(context.Background(), "other", limit, now)
+	assert.True(t, allowed)
+
+	// Half a second refills one token at two per second.
+	allowed, _, _ = store.Take(context.Background(), "client", limit, now.Add(500*time.Millisecond))
+	assert.True(t, allowed)
+	allowed, _, _ = store.Take(context.Background(), "client", limit, now.Add(500*time.Millisecond))
+	assert.False(t, allowed)
+
+	// Buckets never hold more than the burst.
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		allowed, _, _ = store.Take(context.Background(), "client", limit, later)
+		assert.True(t, allowed)
+	}
+	allowed, _, _ = store.Take(context.Background(), "client", limit, later)
+	assert.False(t, allowed)
+}
+
+func TestMemoryRateLimitStorePrunesByBucketLimit(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	read := rateLimit{Rate: 100, Burst: 100}
+	write := rateLimit{Rate: 0.1, Burst: 1}
+	now := time.Now()
+
+	allowed, _, _ := store.Take(context.Background(), "write:ip:1", write, now)
+	assert.True(t, allowed)
+	for i := 1; i < maxMemoryBuckets; i++ {
+		store.Take(context.Background(), fmt.Sprintf("read:ip:%d", i), read, now)
+	}
+
+	// A second later every read bucket has refilled, but the write bucket
+	// has not and must survive the prune triggered by a new read client.
+	later := now.Add(time.Second)
+	store.Take(context.Background(), "read:ip:new", read, later)
+	assert.Len(t, store.buckets, 2)
+	allowed, _, _ = store.Take(context.Background(), "write:ip:1", write, later)
+	assert.False(t, allowed)
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(ctx context.Context, key string, limit rateLimit, now time.Time) (bool, float64, error) {
+	return false, 0, errors.New("connection refused")
+}
+
+func TestLimitRate(t *testing.T) {
+	router := gin.New()
+	router.GET("/search", limitRate(newMemoryRateLimitStore(), "read", rateLimit{Rate: 0.5, Burst: 2}), func(c *gin.Context) {
+		c.JSON(200, gin.H{})
+	})
+
+	search := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/search", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, search("10.0.0.1").Code)
+	assert.Equal(t, http.StatusOK, search("10.0.0.1").Code)
+	w := search("10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+
+	assert.Equal(t, http.StatusOK, search("10.0.0.2").Code)
+}
+
+func TestLimitRateByAPIKey(t *testing.T) {
+	lookup := fakeLookup(map[string]db.Role{"contributor-key": db.RoleContributor})
+	router := gin.New()
+	router.POST("/poem", requireRole(lookup, db.RoleContributor), limitRate(newMemoryRateLimitStore(), "write", rateLimit{Rate: 1, Burst: 1}), func(c *gin.Context) {
+		c.JSON(200, gin.H{})
+	})
+
+	post := func(ip string) int {
+		req := httptest.NewRequest("POST", "/poem", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set(apiKeyHeader, "contributor-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("10.0.0.1"))
+	// The same key is limited whatever address it comes from.
+	assert.Equal(t, http.StatusTooManyRequests, post("10.0.0.2"))
+}
+
+func TestLimitRateBeforeAuth(t *testing.T) {
+	lookup := fakeLookup(map[string]db.Role{"contributor-key": db.RoleContributor})
+	store := newMemoryRateLimitStore()
+	router := gin.New()
+	require.NoError(t, router.SetTrustedProxies(nil))
+	router.POST("/poem", limitRate(store, "auth", rateLimit{Rate: 1, Burst: 2}), requireRole(lookup, db.RoleContributor), func(c *gin.Context) {
+		c.JSON(200, gin.H{})
+	})
+
+	post := func(key, forwardedFor string) int {
+		req := httptest.NewRequest("POST", "/poem", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(apiKeyHeader, key)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Guessed keys are throttled, and a forged X-Forwarded-For does not
+	// give the client a fresh bucket.
+	assert.Equal(t, http.StatusUnauthorized, post("guess-1", "192.0.2.1"))
+	assert.Equal(t, http.StatusUnauthorized, post("guess-2", "192.0.2.2"))
+	assert.Equal(t, http.StatusTooManyRequests, post("contributor-key", "192.0.2.3"))
+}
+
+func TestLimitRateFailsOpen(t *testing.T) {
+	router := gin.New()
+	router.GET("/search", limitRate(failingRateLimitStore{}, "read", rateLimit{Rate: 1, Burst: 1}), func(c *gin.Context) {
+		c.JSON(200, gin.H{})
+	})
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/search", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+}
@@ -1,27 +1,35 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
-	"os"
+	"poetry/config"
 	db "poetry/db"
+	"poetry/worker"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 func getCollections(c *gin.Context, connection *db.MongoDBConnection) {
-	collection, _ := db.GetCollection("poetry", "poems", connection)
+	collection, _ := db.GetCollection(connection.Database, "poems", connection)
 
 	results, err := collection.Distinct(c.Request.Context(), "dataset", bson.D{})
 
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Failed to list datasets: %v", err)
+		c.JSON(500, gin.H{"error": "Unable to list collections"})
+		return
 	}
 
 	c.JSON(200, gin.H{
@@ -39,6 +47,26 @@ type AddPoemRequest struct {
 	DatasetId string `json:"dataset_id"`
 }
 
+// splitTags turns the comma-separated tags of a request into a list.
+func splitTags(tags string) []string {
+	if tags == "" {
+		return []string{}
+	}
+	return strings.Split(tags, ",")
+}
+
+func (r AddPoemRequest) toPoem() db.Poem {
+	return db.Poem{
+		Dataset:   r.Dataset,
+		DatasetId: r.DatasetId,
+		Title:     r.Title,
+		Poem:      r.Poem,
+		Poet:      r.Poet,
+		Tags:      splitTags(r.Tags),
+		Language:  r.Language,
+	}
+}
+
 func addPoem(c *gin.Context, connection *db.MongoDBConnection) {
 	var req AddPoemRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -46,111 +74,292 @@ func addPoem(c *gin.Context, connection *db.MongoDBConnection) {
 		return
 	}
 
-	tags := []string{}
-	if req.Tags != "" {
-		tags = strings.Split(req.Tags, ",")
+	mode, err := db.ParseDuplicateMode(c.Query("on_duplicate"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
 	}
 
-	poem := db.Poem{
-		Dataset:   req.Dataset,
-		DatasetId: req.DatasetId,
-		Title:     req.Title,
-		Poem:      req.Poem,
-		Poet:      req.Poet,
-		Tags:      tags,
-		Language:  req.Language,
+	result, err := db.UpsertPoems(c.Request.Context(), connection, []db.Poem{req.toPoem()}, mode)
+	if err != nil {
+		log.Printf("Failed to add poem: %v", err)
+		c.JSON(500, gin.H{"error": "Unable to save poem"})
+		return
 	}
 
-	db.InsertOnePoemIntoDB(*connection, poem)
-	c.JSON(200, gin.H{"message": "Poem added successfully"})
+	message := "Poem added successfully"
+	switch {
+	case result.Updated > 0:
+		message = "Existing poem updated"
+	case result.Skipped > 0:
+		message = "Poem already exists, skipped"
+	}
+	c.JSON(200, gin.H{"message": message, "result": result})
 }
 
-func sendJobToWorker(poems []db.Poem) error {
-	workerURL := getWorkerURL()
+// workerConfig tells the API where the worker service is. Start replaces
+// the defaults with the loaded configuration.
+var workerConfig = config.Defaults().Worker
 
-	jsonData, err := json.Marshal(poems)
-	if err != nil {
-		return fmt.Errorf("failed to marshal poems: %v", err)
+// workerClient sends jobs to the worker service. Uploads are streamed, so
+// there is no overall timeout, only one for the worker to answer.
+var workerClient = newWorkerClient(config.Defaults().API.WorkerTimeout.Duration)
+
+func newWorkerClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			ResponseHeaderTimeout: timeout,
+		},
 	}
+}
+
+// sendJobToWorker streams a JSON array of poems to the worker service and
+// returns the ID of the accepted job.
+func sendJobToWorker(ctx context.Context, poems io.Reader, mode db.DuplicateMode) (string, error) {
+	workerURL := getWorkerURL()
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, workerURL+"/jobs?on_duplicate="+string(mode), poems)
+	if err != nil {
+		return "", fmt.Errorf("failed to create worker request: %v", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	setWorkerSecret(req)
 
-	resp, err := client.Post(workerURL+"/jobs", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := workerClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send job to worker: %v", err)
+		return "", fmt.Errorf("failed to send job to worker: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("worker rejected job with status: %d", resp.StatusCode)
+		return "", fmt.Errorf("worker rejected job with status: %d", resp.StatusCode)
 	}
 
-	return nil
+	var accepted struct {
+		JobID string `json:"job_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&accepted); err != nil {
+		return "", fmt.Errorf("failed to read worker response: %v", err)
+	}
+	return accepted.JobID, nil
 }
 
-func getWorkerURL() string {
-	workerHost := os.Getenv("WORKER_HOST")
-	if workerHost == "" {
-		workerHost = "localhost"
+// setWorkerSecret authenticates a request to the worker service with the
+// secret they share
+func setWorkerSecret(req *http.Request) {
+	if workerConfig.Secret != "" {
+		req.Header.Set(worker.SecretHeader, workerConfig.Secret)
 	}
+}
 
-	workerPort := os.Getenv("WORKER_PORT")
-	if workerPort == "" {
-		workerPort = "8081"
+func getWorkerURL() string {
+	return workerConfig.URL()
+}
+
+// openUpload opens the uploaded file and returns a decoder for its poems.
+// The returned file must be closed by the caller.
+func openUpload(file *multipart.FileHeader, format uploadFormat, mapping map[string]string) (poemDecoder, multipart.File, error) {
+	f, err := file.Open()
+	if err != nil {
+		return nil, nil, err
 	}
+	decoder, err := newPoemDecoder(format, f, mapping)
+	if err != nil {
+		f.Close()
+		return nil, nil, &uploadError{err}
+	}
+	return decoder, f, nil
+}
 
-	return fmt.Sprintf("http://%s:%s", workerHost, workerPort)
+// uploadError marks errors caused by the content of an upload
+type uploadError struct {
+	err error
+}
+
+func (e *uploadError) Error() string {
+	return e.err.Error()
 }
 
 func addPoems(c *gin.Context) {
+	mode, err := db.ParseDuplicateMode(c.Query("on_duplicate"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	onInvalid, err := parseInvalidMode(c.Query("on_invalid"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Large uploads are spooled to a temporary file rather than memory.
 	file, err := c.FormFile("file")
 	if err != nil {
 		c.JSON(400, gin.H{"error": "File is required"})
 		return
 	}
-	f, err := file.Open()
+	format, err := detectUploadFormat(c.Query("format"), file.Header.Get("Content-Type"), file.Filename)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Unable to open file"})
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	defer f.Close()
-	var req []AddPoemRequest
-	if err := json.NewDecoder(f).Decode(&req); err != nil {
-		c.JSON(400, gin.H{"error": "Invalid JSON"})
-		return
+	var mapping map[string]string
+	if value := c.PostForm("mapping"); value != "" {
+		if err := json.Unmarshal([]byte(value), &mapping); err != nil {
+			c.JSON(400, gin.H{"error": "mapping must be a JSON object of poem fields to CSV columns"})
+			return
+		}
 	}
-	var poems []db.Poem
-	for _, r := range req {
-		tags := []string{}
-		if r.Tags != "" {
-			tags = strings.Split(r.Tags, ",")
+
+	respondOpenError := func(err error) {
+		var invalid *uploadError
+		if errors.As(err, &invalid) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Unable to open file"})
+	}
+
+	// Rejecting a file for its invalid poems has to happen before any of
+	// them reach the worker, so the file is read once just to validate it.
+	if onInvalid == rejectInvalid {
+		decoder, f, err := openUpload(file, format, mapping)
+		if err != nil {
+			respondOpenError(err)
+			return
 		}
-		poem := db.Poem{
-			Dataset:   r.Dataset,
-			DatasetId: r.DatasetId,
-			Title:     r.Title,
-			Poem:      r.Poem,
-			Poet:      r.Poet,
-			Tags:      tags,
-			Language:  r.Language,
+		report := &validationReport{Errors: []RecordError{}}
+		_, err = encodePoems(&validatingDecoder{decoder: decoder, report: report}, io.Discard)
+		f.Close()
+		if err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid %s upload: %v", format, err)})
+			return
+		}
+		if report.Rejected > 0 {
+			c.JSON(400, gin.H{"error": "Upload contains invalid poems", "validation": report})
+			return
 		}
-		poems = append(poems, poem)
 	}
 
-	// Send job to worker service
-	err = sendJobToWorker(poems)
+	decoder, f, err := openUpload(file, format, mapping)
 	if err != nil {
+		respondOpenError(err)
+		return
+	}
+	defer f.Close()
+	report := &validationReport{Errors: []RecordError{}}
+
+	// Send job to worker service, decoding the upload as it is sent
+	stream := streamPoems(&validatingDecoder{decoder: decoder, report: report})
+	jobID, err := sendJobToWorker(c.Request.Context(), stream, mode)
+	count, uploadErr := stream.Close()
+	// An interrupted upload says nothing about the file, only that the
+	// worker failed to take it.
+	interrupted := errors.Is(uploadErr, errUploadInterrupted)
+	if uploadErr != nil && !interrupted {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid %s upload: %v", format, uploadErr)})
+		return
+	}
+	if count == 0 && !interrupted {
+		c.JSON(400, gin.H{"error": "No valid poems provided", "validation": report})
+		return
+	}
+	if err != nil || interrupted {
 		log.Printf("Failed to send job to worker: %v", err)
 		c.JSON(503, gin.H{"error": "Worker service unavailable"})
 		return
 	}
 
-	c.JSON(200, gin.H{"message": "Poems scheduled for processing"})
+	c.JSON(202, gin.H{
+		"message":    "Poems scheduled for processing",
+		"job_id":     jobID,
+		"poem_count": count,
+		"status_url": "/jobs/" + jobID,
+		"validation": report,
+	})
+}
+
+const (
+	defaultPageSize = 10
+	maxPageSize     = 100
+	// maxResultWindow is the default index.max_result_window of
+	// Elasticsearch, beyond which it refuses to page.
+	maxResultWindow = 10000
+)
+
+// parsePagination reads the page and size query parameters, applying defaults
+// and bounds. Pages ending past maxResultWindow are rejected.
+func parsePagination(c *gin.Context) (int, int, error) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return 0, 0, fmt.Errorf("query parameter 'page' must be a positive integer")
+	}
+
+	size, err := strconv.Atoi(c.DefaultQuery("size", strconv.Itoa(defaultPageSize)))
+	if err != nil || size < 1 || size > maxPageSize {
+		return 0, 0, fmt.Errorf("query parameter 'size' must be between 1 and %d", maxPageSize)
+	}
+	if page > maxResultWindow/size {
+		return 0, 0, fmt.Errorf("page %d of size %d is past the first %d results", page, size, maxResultWindow)
+	}
+
+	return page, size, nil
+}
+
+// parseSearchFilters collects the facet filters from the query string. Each
+// facet may be repeated (?language=russian&language=arabic) or given as a
+// comma-separated list.
+func parseSearchFilters(c *gin.Context) map[string][]string {
+	filters := map[string][]string{}
+	for _, name := range db.FacetNames {
+		for _, raw := range c.QueryArray(name) {
+			for _, value := range strings.Split(raw, ",") {
+				if value = strings.TrimSpace(value); value != "" {
+					filters[name] = append(filters[name], value)
+				}
+			}
+		}
+	}
+	return filters
+}
+
+func searchPoems(c *gin.Context, esClient *elasticsearch.Client) {
+	query := c.Query("q")
+	filters := parseSearchFilters(c)
+	if query == "" && len(filters) == 0 {
+		c.JSON(400, gin.H{"error": "Query parameter 'q' or at least one filter is required"})
+		return
+	}
+
+	page, size, err := parsePagination(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := db.SearchData(esClient, db.SearchParams{
+		Query:   query,
+		Filters: filters,
+		Page:    page,
+		Size:    size,
+	})
+	if err != nil {
+		log.Printf("Search failed: %v", err)
+		c.JSON(500, gin.H{"error": "Search failed"})
+		return
+	}
+
+	c.JSON(200, result)
 }
 
 func Start() {
+	cfg := config.GetConfig()
+	if err := cfg.RequireElasticsearch(); err != nil {
+		log.Fatal(err)
+	}
+	workerConfig = cfg.Worker
+	workerClient = newWorkerClient(cfg.API.WorkerTimeout.Duration)
+
 	mongoDBConnection, err := db.NewMongoDBConnection()
 
 	if err != nil {
@@ -158,43 +367,99 @@ func Start() {
 	}
 	defer mongoDBConnection.Disconnect()
 
+	if err := db.EnsurePoemIndexes(context.Background(), mongoDBConnection); err != nil {
+		log.Fatalf("Failed to create duplicate detection indexes: %v", err)
+	}
+	if err := db.EnsureAPIKeyIndexes(context.Background(), mongoDBConnection); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.API.AdminAPIKey != "" {
+		if err := db.EnsureAPIKey(context.Background(), mongoDBConnection, "bootstrap admin", cfg.API.AdminAPIKey, db.RoleAdmin); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	esClient, err := db.ConnectElasticsearch()
 	if err != nil {
 		fmt.Printf("Error connecting to Elasticsearch: %v\n", err)
 		return
 	}
 
+	lookup := func(ctx context.Context, key string) (*db.APIKey, error) {
+		return db.FindAPIKey(ctx, mongoDBConnection, key)
+	}
+	reader := requireRole(lookup, db.RoleReader)
+	contributor := requireRole(lookup, db.RoleContributor)
+	admin := requireRole(lookup, db.RoleAdmin)
+	optionalKey := optionalAPIKey(lookup)
+
+	limits, err := newRateLimitStore(context.Background(), mongoDBConnection, cfg.API.RateLimitStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The auth limit runs before the API key is checked and is therefore
+	// keyed by client IP. The read and write limits run after it, per API
+	// key. The public read routes take an optional key: anonymous requests
+	// skip the auth limit and are limited per client IP.
+	authLimit := limitRate(limits, "auth", rateLimit{Rate: cfg.API.AuthLimit.RPS, Burst: cfg.API.AuthLimit.Burst})
+	keyedAuthLimit := withAPIKey(authLimit)
+	readLimit := limitRate(limits, "read", rateLimit{Rate: cfg.API.ReadLimit.RPS, Burst: cfg.API.ReadLimit.Burst})
+	writeLimit := limitRate(limits, "write", rateLimit{Rate: cfg.API.WriteLimit.RPS, Burst: cfg.API.WriteLimit.Burst})
+
 	r := gin.Default()
+	// Without trusted proxies ClientIP ignores X-Forwarded-For, which any
+	// client could set to dodge its IP limit.
+	if err := r.SetTrustedProxies(cfg.API.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "pong",
 		})
 	})
-	r.GET("/collections", func(c *gin.Context) {
+	r.GET("/collections", keyedAuthLimit, optionalKey, readLimit, func(c *gin.Context) {
 		getCollections(c, mongoDBConnection)
 	})
-	r.GET("/search", func(c *gin.Context) {
-		query := c.Query("q")
-		if query == "" {
-			c.JSON(400, gin.H{"error": "Query parameter 'q' is required"})
-			return
-		}
-
-		err := db.SearchData(esClient, query)
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
-		}
-
-		c.JSON(200, gin.H{"message": "Search successful"})
+	r.GET("/search", keyedAuthLimit, optionalKey, readLimit, func(c *gin.Context) {
+		searchPoems(c, esClient)
 	})
-	r.POST("/poem", func(c *gin.Context) {
+	r.POST("/poem", authLimit, contributor, writeLimit, func(c *gin.Context) {
 		addPoem(c, mongoDBConnection)
 	})
-	r.POST("/poems", func(c *gin.Context) {
+	r.POST("/poems", authLimit, contributor, writeLimit, func(c *gin.Context) {
 		addPoems(c)
 	})
-	err = r.Run()
+	r.GET("/poems", keyedAuthLimit, optionalKey, readLimit, func(c *gin.Context) {
+		listPoems(c, mongoDBConnection)
+	})
+	r.GET("/poems/:id", keyedAuthLimit, optionalKey, readLimit, func(c *gin.Context) {
+		getPoem(c, mongoDBConnection)
+	})
+	r.PUT("/poems/:id", authLimit, contributor, writeLimit, func(c *gin.Context) {
+		replacePoem(c, mongoDBConnection)
+	})
+	r.PATCH("/poems/:id", authLimit, contributor, writeLimit, func(c *gin.Context) {
+		updatePoem(c, mongoDBConnection)
+	})
+	r.DELETE("/poems/:id", authLimit, admin, writeLimit, func(c *gin.Context) {
+		deletePoem(c, mongoDBConnection)
+	})
+	r.GET("/jobs", authLimit, reader, readLimit, func(c *gin.Context) {
+		listJobs(c)
+	})
+	r.GET("/jobs/:id", authLimit, reader, readLimit, func(c *gin.Context) {
+		getJob(c)
+	})
+	r.POST("/api-keys", authLimit, admin, func(c *gin.Context) {
+		createAPIKey(c, mongoDBConnection)
+	})
+	r.GET("/api-keys", authLimit, admin, func(c *gin.Context) {
+		listAPIKeys(c, mongoDBConnection)
+	})
+	r.DELETE("/api-keys/:id", authLimit, admin, func(c *gin.Context) {
+		revokeAPIKey(c, mongoDBConnection)
+	})
+	err = r.Run(":" + cfg.API.Port)
 	if err != nil {
 		fmt.Printf("Error running the server: %v\n", err)
 		return
@@ -2,13 +2,18 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	db "poetry/db"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func setupRouter() *gin.Engine {
@@ -47,4 +52,92 @@ func TestAddPoem(t *testing.T) {
 	// Since DB is nil, it might panic, but in real, would be 200
 	// For simplicity, check if not 400
 	assert.NotEqual(t, http.StatusBadRequest, w.Code)
+
+	// Test unknown duplicate mode
+	jsonValue, _ = json.Marshal(poem)
+	req, _ = http.NewRequest("POST", "/poem?on_duplicate=replace", bytes.NewBuffer(jsonValue))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSearchPoemsValidation(t *testing.T) {
+	router := gin.Default()
+	router.GET("/search", func(c *gin.Context) {
+		searchPoems(c, nil) // Validation fails before Elasticsearch is used
+	})
+
+	for _, url := range []string{"/search", "/search?language=", "/search?q=moon&page=0", "/search?q=moon&size=1000", "/search?q=moon&page=abc", "/search?q=moon&page=101&size=100"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+	}
+}
+
+func TestParsePaginationResultWindow(t *testing.T) {
+	tests := []struct {
+		query string
+		valid bool
+	}{
+		{"page=100&size=100", true},
+		{"page=101&size=100", false},
+		{"page=1000", true},
+		{"page=1001", false},
+		{"page=3333&size=3", true},
+		{"page=3334&size=3", false},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/search?"+tt.query, nil)
+		_, _, err := parsePagination(c)
+		assert.Equal(t, tt.valid, err == nil, tt.query)
+	}
+}
+
+func TestParseSearchFilters(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("GET", "/search?language=russian,arabic&tags=love&tags=war&dataset=", nil)
+
+	filters := parseSearchFilters(c)
+
+	assert.Equal(t, map[string][]string{
+		"language": {"russian", "arabic"},
+		"tags":     {"love", "war"},
+	}, filters)
+}
+
+// unreachableConnection returns a connection whose server can never be
+// selected, so every database call fails quickly.
+func unreachableConnection(t *testing.T) *db.MongoDBConnection {
+	client, err := mongo.Connect(context.Background(), options.Client().
+		ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return &db.MongoDBConnection{Client: client}
+}
+
+func TestDatabaseErrorsReturn500(t *testing.T) {
+	connection := unreachableConnection(t)
+	router := gin.Default()
+	router.POST("/poem", func(c *gin.Context) {
+		addPoem(c, connection)
+	})
+	router.GET("/collections", func(c *gin.Context) {
+		getCollections(c, connection)
+	})
+
+	body := `{"title": "Test Title", "poem": "Test Poem", "language": "english"}`
+	req, _ := http.NewRequest("POST", "/poem", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	req, _ = http.NewRequest("GET", "/collections", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
 }
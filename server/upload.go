@@ -0,0 +1,289 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// uploadFormat is the file format of a POST /poems upload
+type uploadFormat string
+
+const (
+	formatJSON   uploadFormat = "json"
+	formatNDJSON uploadFormat = "ndjson"
+	formatCSV    uploadFormat = "csv"
+)
+
+var (
+	uploadContentTypes = map[string]uploadFormat{
+		"application/json":     formatJSON,
+		"application/x-ndjson": formatNDJSON,
+		"application/ndjson":   formatNDJSON,
+		"application/jsonl":    formatNDJSON,
+		"application/x-jsonl":  formatNDJSON,
+		"text/csv":             formatCSV,
+		"application/csv":      formatCSV,
+	}
+	uploadExtensions = map[string]uploadFormat{
+		".json":   formatJSON,
+		".ndjson": formatNDJSON,
+		".jsonl":  formatNDJSON,
+		".csv":    formatCSV,
+	}
+)
+
+// detectUploadFormat picks the format of an uploaded file. An explicit
+// format wins, then the content type of the file, then its extension.
+// Files that match none of them are read as a JSON array.
+func detectUploadFormat(explicit, contentType, filename string) (uploadFormat, error) {
+	if explicit != "" {
+		for _, format := range []uploadFormat{formatJSON, formatNDJSON, formatCSV} {
+			if uploadFormat(explicit) == format {
+				return format, nil
+			}
+		}
+		return "", fmt.Errorf("unknown upload format %q, expected %q, %q or %q", explicit, formatJSON, formatNDJSON, formatCSV)
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if format, ok := uploadContentTypes[mediaType]; ok {
+			return format, nil
+		}
+	}
+	if format, ok := uploadExtensions[strings.ToLower(filepath.Ext(filename))]; ok {
+		return format, nil
+	}
+	return formatJSON, nil
+}
+
+// poemDecoder reads the poems of an upload one at a time. Next returns
+// io.EOF once every poem has been read.
+type poemDecoder interface {
+	Next() (AddPoemRequest, error)
+}
+
+// newPoemDecoder returns the decoder for format. mapping only applies to
+// CSV files; see newCSVDecoder.
+func newPoemDecoder(format uploadFormat, upload io.Reader, mapping map[string]string) (poemDecoder, error) {
+	switch format {
+	case formatNDJSON:
+		return &ndjsonDecoder{decoder: json.NewDecoder(upload)}, nil
+	case formatCSV:
+		return newCSVDecoder(upload, mapping)
+	default:
+		return &jsonArrayDecoder{decoder: json.NewDecoder(upload)}, nil
+	}
+}
+
+// errNotPoemArray is returned for JSON uploads that are not an array
+var errNotPoemArray = errors.New("expected a JSON array of poems")
+
+// jsonArrayDecoder reads the elements of a JSON array of poems
+type jsonArrayDecoder struct {
+	decoder *json.Decoder
+	started bool
+}
+
+func (d *jsonArrayDecoder) Next() (AddPoemRequest, error) {
+	var req AddPoemRequest
+	if !d.started {
+		token, err := d.decoder.Token()
+		if err == io.EOF {
+			return req, errNotPoemArray
+		}
+		if err != nil {
+			return req, err
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return req, errNotPoemArray
+		}
+		d.started = true
+	}
+
+	if !d.decoder.More() {
+		if _, err := d.decoder.Token(); err != nil {
+			return req, err
+		}
+		return req, io.EOF
+	}
+	err := d.decoder.Decode(&req)
+	return req, err
+}
+
+// ndjsonDecoder reads one JSON object per line
+type ndjsonDecoder struct {
+	decoder *json.Decoder
+}
+
+func (d *ndjsonDecoder) Next() (AddPoemRequest, error) {
+	var req AddPoemRequest
+	err := d.decoder.Decode(&req)
+	return req, err
+}
+
+// csvColumns sets the AddPoemRequest field named by its JSON key from a
+// CSV column
+var csvColumns = map[string]func(req *AddPoemRequest, value string){
+	"dataset":    func(req *AddPoemRequest, value string) { req.Dataset = value },
+	"dataset_id": func(req *AddPoemRequest, value string) { req.DatasetId = value },
+	"title":      func(req *AddPoemRequest, value string) { req.Title = value },
+	"poem":       func(req *AddPoemRequest, value string) { req.Poem = value },
+	"poet":       func(req *AddPoemRequest, value string) { req.Poet = value },
+	"tags":       func(req *AddPoemRequest, value string) { req.Tags = value },
+	"language":   func(req *AddPoemRequest, value string) { req.Language = value },
+}
+
+// csvDecoder reads one poem per CSV row. A column may feed several fields.
+type csvDecoder struct {
+	reader  *csv.Reader
+	columns map[int][]func(req *AddPoemRequest, value string)
+}
+
+// newCSVDecoder reads the header row of upload. mapping maps AddPoemRequest
+// fields, by their JSON keys, to the header of the column holding them.
+// Fields missing from mapping are read from a column named like the field,
+// if there is one.
+func newCSVDecoder(upload io.Reader, mapping map[string]string) (*csvDecoder, error) {
+	for field := range mapping {
+		if _, ok := csvColumns[field]; !ok {
+			return nil, fmt.Errorf("unknown field %q in column mapping", field)
+		}
+	}
+
+	reader := csv.NewReader(upload)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV file has no header row")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	d := &csvDecoder{reader: reader, columns: make(map[int][]func(*AddPoemRequest, string))}
+	for field, set := range csvColumns {
+		column, mapped := mapping[field]
+		if !mapped {
+			column = field
+		}
+		position, ok := positions[strings.ToLower(strings.TrimSpace(column))]
+		if !ok {
+			if mapped {
+				return nil, fmt.Errorf("column %q mapped to %s is not in the CSV header", column, field)
+			}
+			continue
+		}
+		d.columns[position] = append(d.columns[position], set)
+	}
+	if len(d.columns) == 0 {
+		return nil, errors.New("no CSV column matches a poem field, provide a column mapping")
+	}
+	return d, nil
+}
+
+func (d *csvDecoder) Next() (AddPoemRequest, error) {
+	var req AddPoemRequest
+	record, err := d.reader.Read()
+	if err != nil {
+		return req, err
+	}
+	for position, setters := range d.columns {
+		if position >= len(record) {
+			continue
+		}
+		for _, set := range setters {
+			set(&req, record[position])
+		}
+	}
+	return req, nil
+}
+
+// encodePoems reads every poem from decoder and writes its stored form to w
+// as a JSON array. Large files therefore pass through without being held in
+// memory. It returns the number of poems written.
+func encodePoems(decoder poemDecoder, w io.Writer) (int, error) {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return 0, err
+	}
+	encoder := json.NewEncoder(w)
+
+	count := 0
+	for {
+		req, err := decoder.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("poem %d: %v", count, err)
+		}
+		if count > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return count, err
+			}
+		}
+		if err := encoder.Encode(req.toPoem()); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	if _, err := io.WriteString(w, "]"); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+// uploadStream feeds the poems of an upload to the worker through a pipe
+type uploadStream struct {
+	reader *io.PipeReader
+	done   chan struct{}
+	count  int
+	err    error
+}
+
+// streamPoems starts encoding the poems of decoder in the background. The
+// returned stream must be closed once the worker request has finished.
+func streamPoems(decoder poemDecoder) *uploadStream {
+	reader, writer := io.Pipe()
+	stream := &uploadStream{reader: reader, done: make(chan struct{})}
+
+	go func() {
+		defer close(stream.done)
+		stream.count, stream.err = encodePoems(decoder, writer)
+		writer.CloseWithError(stream.err)
+	}()
+	return stream
+}
+
+func (s *uploadStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+// errUploadInterrupted is returned by uploadStream.Close when the worker
+// request ended before the whole upload was sent
+var errUploadInterrupted = errors.New("upload interrupted before it was sent")
+
+// Close stops the encoding and returns the number of poems read from the
+// upload, along with the error that made it invalid, if any. An upload the
+// worker stopped reading returns errUploadInterrupted, as its poems were
+// not all counted.
+func (s *uploadStream) Close() (int, error) {
+	s.reader.Close()
+	<-s.done
+
+	if errors.Is(s.err, io.ErrClosedPipe) {
+		return s.count, errUploadInterrupted
+	}
+	return s.count, s.err
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	db "poetry/db"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodePoems(t *testing.T) {
+	upload := `[{"title": "A", "poem": "a", "language": "english", "tags": "x,y"}, {"title": "B", "poem": "b", "language": "english"}]`
+
+	var out bytes.Buffer
+	count, err := encodePoems(&jsonArrayDecoder{decoder: json.NewDecoder(strings.NewReader(upload))}, &out)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	var poems []db.Poem
+	require.NoError(t, json.Unmarshal(out.Bytes(), &poems))
+	require.Len(t, poems, 2)
+	assert.Equal(t, "A", poems[0].Title)
+	assert.Equal(t, []string{"x", "y"}, poems[0].Tags)
+	assert.Equal(t, "B", poems[1].Title)
+}
+
+func TestEncodePoemsErrors(t *testing.T) {
+	for name, upload := range map[string]string{
+		"not an array":  `{"title": "A"}`,
+		"bad element":   `[{"title": "A"}, {"title": 5}]`,
+		"truncated":     `[{"title": "A"}`,
+		"empty payload": ``,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := encodePoems(&jsonArrayDecoder{decoder: json.NewDecoder(strings.NewReader(upload))}, io.Discard)
+			assert.Error(t, err)
+		})
+	}
+
+	var out bytes.Buffer
+	count, err := encodePoems(&jsonArrayDecoder{decoder: json.NewDecoder(strings.NewReader(`[]`))}, &out)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, "[]", out.String())
+}
+
+// decodeAll reads every poem of an upload in format
+func decodeAll(t *testing.T, format uploadFormat, upload string, mapping map[string]string) ([]AddPoemRequest, error) {
+	decoder, err := newPoemDecoder(format, strings.NewReader(upload), mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	var reqs []AddPoemRequest
+	for {
+		req, err := decoder.Next()
+		if err == io.EOF {
+			return reqs, nil
+		}
+		if err != nil {
+			return reqs, err
+		}
+		reqs = append(reqs, req)
+	}
+}
+
+func TestDetectUploadFormat(t *testing.T) {
+	tests := []struct {
+		explicit, contentType, filename string
+		expected                        uploadFormat
+	}{
+		{"", "application/json", "poems", formatJSON},
+		{"", "application/x-ndjson", "poems", formatNDJSON},
+		{"", "text/csv; charset=utf-8", "poems", formatCSV},
+		{"", "application/octet-stream", "poems.jsonl", formatNDJSON},
+		{"", "", "Poems.CSV", formatCSV},
+		{"", "", "poems.txt", formatJSON},
+		{"csv", "application/json", "poems.json", formatCSV},
+	}
+	for _, tt := range tests {
+		format, err := detectUploadFormat(tt.explicit, tt.contentType, tt.filename)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, format, "%+v", tt)
+	}
+
+	_, err := detectUploadFormat("xml", "", "poems.xml")
+	assert.Error(t, err)
+}
+
+func TestNDJSONDecoder(t *testing.T) {
+	upload := "{\"title\": \"A\", \"language\": \"english\"}\n\n{\"title\": \"B\", \"language\": \"russian\"}\n"
+	reqs, err := decodeAll(t, formatNDJSON, upload, nil)
+	require.NoError(t, err)
+	require.Len(t, reqs, 2)
+	assert.Equal(t, "B", reqs[1].Title)
+	assert.Equal(t, "russian", reqs[1].Language)
+
+	_, err = decodeAll(t, formatNDJSON, "{\"title\": \"A\"}\nnot json\n", nil)
+	assert.Error(t, err)
+}
+
+func TestCSVDecoder(t *testing.T) {
+	upload := "Title,Poem,Language,Extra\nA,\"line one\nline two\",english,x\nB,b,russian,y\n"
+	reqs, err := decodeAll(t, formatCSV, upload, nil)
+	require.NoError(t, err)
+	require.Len(t, reqs, 2)
+	assert.Equal(t, AddPoemRequest{Title: "A", Poem: "line one\nline two", Language: "english"}, reqs[0])
+
+	upload = "Name,Content,Author,Lang\nA,a,Someone,english\n"
+	reqs, err = decodeAll(t, formatCSV, upload, map[string]string{"title": "Name", "poem": "Content", "poet": "author", "language": "Lang"})
+	require.NoError(t, err)
+	assert.Equal(t, []AddPoemRequest{{Title: "A", Poem: "a", Poet: "Someone", Language: "english"}}, reqs)
+
+	// Several fields may read the same column.
+	reqs, err = decodeAll(t, formatCSV, upload, map[string]string{"title": "Name", "poem": "Name", "poet": "Name"})
+	require.NoError(t, err)
+	assert.Equal(t, []AddPoemRequest{{Title: "A", Poem: "A", Poet: "A"}}, reqs)
+	reqs, err = decodeAll(t, formatCSV, "Title,Poem\nA,a\n", map[string]string{"poet": "Title"})
+	require.NoError(t, err)
+	assert.Equal(t, []AddPoemRequest{{Title: "A", Poem: "a", Poet: "A"}}, reqs)
+
+	_, err = decodeAll(t, formatCSV, upload, map[string]string{"author": "Author"})
+	assert.ErrorContains(t, err, "unknown field")
+	_, err = decodeAll(t, formatCSV, upload, map[string]string{"title": "Heading"})
+	assert.ErrorContains(t, err, "not in the CSV header")
+	_, err = decodeAll(t, formatCSV, upload, nil)
+	assert.ErrorContains(t, err, "column mapping")
+	_, err = decodeAll(t, formatCSV, "", nil)
+	assert.Error(t, err)
+}
+
+// uploadRequest builds a POST /poems request uploading content as file
+func uploadRequest(t *testing.T, content string) *http.Request {
+	return uploadFileRequest(t, "poems.json", content, nil)
+}
+
+// uploadFileRequest builds a POST /poems request uploading content as a file
+// named filename, along with the given form fields
+func uploadFileRequest(t *testing.T, filename, content string, fields map[string]string) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		require.NoError(t, form.WriteField(name, value))
+	}
+	part, err := form.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	_, err = part.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, form.Close())
+
+	req := httptest.NewRequest("POST", "/poems", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestAddPoemsWorkerUnavailable(t *testing.T) {
+	router := gin.New()
+	router.POST("/poems", addPoems)
+	upload := `[{"title": "A", "poem": "a", "language": "english"}]`
+
+	useWorker(t, "http://127.0.0.1:1", "")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, upload))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// A worker answering before it reads the upload is unavailable too.
+	workerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer workerServer.Close()
+	useWorker(t, workerServer.URL, "")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, upload))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestAddPoemsStreamsToWorker(t *testing.T) {
+	var received []db.Poem
+	workerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"job_id": "job-1"}`))
+	}))
+	defer workerServer.Close()
+
+	useWorker(t, workerServer.URL, "")
+
+	router := gin.New()
+	router.POST("/poems", addPoems)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, `[{"title": "A", "poem": "a", "language": "english"}, {"title": "B", "poem": "b", "language": "english"}]`))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Contains(t, w.Body.String(), `"job_id":"job-1"`)
+	assert.Contains(t, w.Body.String(), `"poem_count":2`)
+	require.Len(t, received, 2)
+	assert.Equal(t, "B", received[1].Title)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, `[{"title": "A"}, {"title": `))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid json upload")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, `[]`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, uploadFileRequest(t, "poems.csv", "Name,Text,language\nC,c,english\n",
+		map[string]string{"mapping": `{"title": "Name", "poem": "Text"}`}))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	require.Len(t, received, 1)
+	assert.Equal(t, db.Poem{Title: "C", Poem: "c", Language: "english", Tags: []string{}}, received[0])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, uploadFileRequest(t, "poems.ndjson", "{\"title\": \"D\", \"poem\": \"d\", \"language\": \"english\"}\n{\"title\": \"E\", \"poem\": \"e\", \"language\": \"english\"}\n", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Len(t, received, 2)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, uploadFileRequest(t, "poems.csv", "a,b\n", map[string]string{"mapping": `["title"]`}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// invalidMode decides what happens to a bulk upload containing poems that
+// fail validation.
+type invalidMode string
+
+const (
+	// rejectInvalid refuses the whole file.
+	rejectInvalid invalidMode = "reject"
+	// skipInvalid stores the valid poems and reports the others.
+	skipInvalid invalidMode = "skip"
+)
+
+// maxReportedErrors bounds the errors listed in a validation report
+const maxReportedErrors = 100
+
+func parseInvalidMode(value string) (invalidMode, error) {
+	switch invalidMode(value) {
+	case "", rejectInvalid:
+		return rejectInvalid, nil
+	case skipInvalid:
+		return skipInvalid, nil
+	default:
+		return "", fmt.Errorf("unknown on_invalid mode %q, expected %q or %q", value, rejectInvalid, skipInvalid)
+	}
+}
+
+// RecordError describes why one poem of an upload was rejected
+type RecordError struct {
+	Index  int    `json:"index"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// validationReport lists the poems of an upload that failed validation
+type validationReport struct {
+	Rejected  int           `json:"rejected"`
+	Errors    []RecordError `json:"errors"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+func (r *validationReport) add(errs []RecordError) {
+	r.Rejected++
+	for _, err := range errs {
+		if len(r.Errors) == maxReportedErrors {
+			r.Truncated = true
+			return
+		}
+		r.Errors = append(r.Errors, err)
+	}
+}
+
+// jsonFieldName returns the JSON key of the AddPoemRequest field name
+func jsonFieldName(name string) string {
+	field, ok := reflect.TypeOf(AddPoemRequest{}).FieldByName(name)
+	if !ok {
+		return name
+	}
+	if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" {
+		return tag
+	}
+	return name
+}
+
+// validatePoem checks req against the binding rules that addPoem enforces
+// through ShouldBindJSON, reporting one error per invalid field.
+func validatePoem(index int, req AddPoemRequest) []RecordError {
+	err := binding.Validator.ValidateStruct(req)
+	if err == nil {
+		return nil
+	}
+
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return []RecordError{{Index: index, Reason: err.Error()}}
+	}
+
+	errs := make([]RecordError, 0, len(fieldErrs))
+	for _, fieldErr := range fieldErrs {
+		reason := fmt.Sprintf("failed the %q rule", fieldErr.Tag())
+		if fieldErr.Tag() == "required" {
+			reason = "is required"
+		}
+		errs = append(errs, RecordError{Index: index, Field: jsonFieldName(fieldErr.StructField()), Reason: reason})
+	}
+	return errs
+}
+
+// validatingDecoder passes on the valid poems of decoder and records the
+// invalid ones in report. Indexes count every record of the upload.
+type validatingDecoder struct {
+	decoder poemDecoder
+	report  *validationReport
+	index   int
+}
+
+func (d *validatingDecoder) Next() (AddPoemRequest, error) {
+	for {
+		req, err := d.decoder.Next()
+		if err != nil {
+			return req, err
+		}
+
+		index := d.index
+		d.index++
+		if errs := validatePoem(index, req); len(errs) > 0 {
+			d.report.add(errs)
+			continue
+		}
+		return req, nil
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	db "poetry/db"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePoem(t *testing.T) {
+	assert.Empty(t, validatePoem(0, AddPoemRequest{Title: "A", Poem: "a", Language: "english"}))
+
+	errs := validatePoem(3, AddPoemRequest{Poem: "a"})
+	assert.Equal(t, []RecordError{
+		{Index: 3, Field: "title", Reason: "is required"},
+		{Index: 3, Field: "language", Reason: "is required"},
+	}, errs)
+}
+
+func TestValidationReportTruncates(t *testing.T) {
+	report := &validationReport{}
+	for i := 0; i < maxReportedErrors+1; i++ {
+		report.add(validatePoem(i, AddPoemRequest{Title: "A", Poem: "a"}))
+	}
+	assert.Equal(t, maxReportedErrors+1, report.Rejected)
+	assert.Len(t, report.Errors, maxReportedErrors)
+	assert.True(t, report.Truncated)
+}
+
+func TestParseInvalidMode(t *testing.T) {
+	mode, err := parseInvalidMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, rejectInvalid, mode)
+
+	mode, err = parseInvalidMode("skip")
+	assert.NoError(t, err)
+	assert.Equal(t, skipInvalid, mode)
+
+	_, err = parseInvalidMode("ignore")
+	assert.Error(t, err)
+}
+
+func TestAddPoemsValidation(t *testing.T) {
+	var received []db.Poem
+	requests := 0
+	workerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		received = nil
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"job_id": "job-1"}`))
+	}))
+	defer workerServer.Close()
+
+	useWorker(t, workerServer.URL, "")
+
+	router := gin.New()
+	router.POST("/poems", addPoems)
+
+	upload := `[
+		{"title": "A", "poem": "a", "language": "english"},
+		{"title": "B", "language": "english"},
+		{"title": "C", "poem": "c", "language": "english"},
+		{"poem": "d"}
+	]`
+
+	var body struct {
+		Validation validationReport `json:"validation"`
+	}
+
+	// The default rejects the whole file without contacting the worker.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, upload))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 0, requests)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, 2, body.Validation.Rejected)
+	assert.Equal(t, []RecordError{
+		{Index: 1, Field: "poem", Reason: "is required"},
+		{Index: 3, Field: "title", Reason: "is required"},
+		{Index: 3, Field: "language", Reason: "is required"},
+	}, body.Validation.Errors)
+
+	// Skipping sends the valid poems and reports the others.
+	req := uploadRequest(t, upload)
+	req.URL.RawQuery = "on_invalid=skip"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	require.Len(t, received, 2)
+	assert.Equal(t, "C", received[1].Title)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, 2, body.Validation.Rejected)
+
+	// A file of valid poems passes both checks.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, `[{"title": "A", "poem": "a", "language": "english"}]`))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Len(t, received, 1)
+
+	// Nothing to send when every poem is invalid.
+	req = uploadRequest(t, `[{"title": "A"}]`)
+	req.URL.RawQuery = "on_invalid=skip"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "No valid poems")
+}
@@ -3,6 +3,9 @@
 echo "Poetry Management System - Integration Test"
 echo "==========================================="
 
+# Write endpoints need an API key, e.g. the ADMIN_API_KEY the API started with
+API_KEY=${API_KEY:-$ADMIN_API_KEY}
+
 # Test API server health
 echo "Testing API server..."
 curl -s http://localhost:8080/ping && echo " ✓ API server is healthy" || echo " ✗ API server is not responding"
@@ -19,10 +22,16 @@ curl -s http://localhost:8082/status | jq '.' && echo " ✓ Worker status retrie
 echo "Testing collections endpoint..."
 curl -s http://localhost:8080/collections | jq '.' && echo " ✓ Collections endpoint working" || echo " ✗ Collections endpoint failed"
 
+# Test that writes without an API key are refused
+echo "Testing unauthenticated poem submission..."
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8080/poem -H "Content-Type: application/json" -d '{}')
+[ "$STATUS" = "401" ] && echo " ✓ Unauthenticated write refused" || echo " ✗ Unauthenticated write returned $STATUS"
+
 # Test adding a single poem
 echo "Testing single poem submission..."
 curl -X POST http://localhost:8080/poem \
   -H "Content-Type: application/json" \
+  -H "X-API-Key: $API_KEY" \
   -d '{
     "title": "Test Integration Poem",
     "poem": "This is a test poem for integration testing",
@@ -54,12 +63,18 @@ EOF
 
 # Test bulk poem upload
 echo "Testing bulk poem submission..."
-curl -X POST http://localhost:8080/poems \
-  -F "file=@/tmp/test_poems.json" && echo " ✓ Bulk poem submission working" || echo " ✗ Bulk poem submission failed"
+JOB_ID=$(curl -s -X POST http://localhost:8080/poems \
+  -H "X-API-Key: $API_KEY" \
+  -F "file=@/tmp/test_poems.json" | jq -r '.job_id')
+[ -n "$JOB_ID" ] && [ "$JOB_ID" != "null" ] && echo " ✓ Bulk poem submission working (job $JOB_ID)" || echo " ✗ Bulk poem submission failed"
 
 # Check worker status after bulk upload
 echo "Checking worker status after bulk upload..."
 sleep 2
 curl -s http://localhost:8082/status | jq '.'
 
+# Check the state of the bulk upload job
+echo "Checking bulk upload job..."
+curl -s -H "X-API-Key: $API_KEY" http://localhost:8080/jobs/$JOB_ID | jq '.' && echo " ✓ Job status retrieved" || echo " ✗ Could not get job status"
+
 echo "Integration test completed!"
@@ -0,0 +1,26 @@
+package worker
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// SecretHeader carries the secret shared between the API and the worker
+const SecretHeader = "X-Worker-Secret"
+
+// RequireSecret only lets requests carrying secret in SecretHeader through
+// to next. An empty secret disables the check.
+func RequireSecret(secret string, next http.HandlerFunc) http.HandlerFunc {
+	if secret == "" {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		presented := r.Header.Get(SecretHeader)
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(secret)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,38 @@
+package worker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireSecret(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		presented string
+		status    int
+	}{
+		{"matching secret", "s3cret", "s3cret", http.StatusAccepted},
+		{"wrong secret", "s3cret", "guess", http.StatusUnauthorized},
+		{"missing secret", "s3cret", "", http.StatusUnauthorized},
+		{"check disabled", "", "", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/jobs", nil)
+			if tt.presented != "" {
+				req.Header.Set(SecretHeader, tt.presented)
+			}
+			w := httptest.NewRecorder()
+			RequireSecret(tt.secret, ok)(w, req)
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"poetry/db"
+	"testing"
+	"time"
+)
+
+func TestSplitBatches(t *testing.T) {
+	poems := make([]db.Poem, 5)
+
+	batches := splitBatches(poems, 2)
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[2]) != 1 {
+		t.Errorf("Unexpected batches: %d", len(batches))
+	}
+	if batches := splitBatches(poems, 0); len(batches) != 1 || len(batches[0]) != 5 {
+		t.Errorf("Expected a single batch without a batch size, got %d", len(batches))
+	}
+	if batches := splitBatches(nil, 2); len(batches) != 0 {
+		t.Errorf("Expected no batches without poems, got %d", len(batches))
+	}
+}
+
+func TestProcessJobReportsBatches(t *testing.T) {
+	worker := NewWorker(&db.MongoDBConnection{}, 1, 1,
+		WithBatchSize(2),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}))
+
+	calls := map[string]int{}
+	worker.upsert = func(ctx context.Context, poems []db.Poem, mode db.DuplicateMode) (db.UpsertResult, error) {
+		first := poems[0].Title
+		calls[first]++
+		switch first {
+		case "Poem 2":
+			// The database keeps failing for this batch.
+			return db.UpsertResult{}, errors.New("connection reset")
+		case "Poem 4":
+			return db.UpsertResult{}, &db.PoemWriteError{Indexes: []int{0}, Messages: []string{"poem 0: too large"}}
+		}
+		return db.UpsertResult{New: int64(len(poems))}, nil
+	}
+
+	var poems []db.Poem
+	for i := 0; i < 5; i++ {
+		poems = append(poems, db.Poem{Title: fmt.Sprintf("Poem %d", i)})
+	}
+	job, _ := worker.Submit(Job{Poems: poems})
+	queued, _ := worker.queue.Dequeue(context.Background())
+	if err := worker.processJob(1, queued); err == nil {
+		t.Fatal("Expected the job to report failed batches")
+	}
+
+	stored, _ := worker.GetJob(context.Background(), job.ID)
+	if stored.State != JobPartial {
+		t.Errorf("Expected state %s, got %s", JobPartial, stored.State)
+	}
+	if len(stored.Batches) != 3 {
+		t.Fatalf("Expected 3 batches, got %d", len(stored.Batches))
+	}
+	if stored.Batches[0].Error != "" || stored.Batches[1].Error == "" || stored.Batches[2].Error == "" {
+		t.Errorf("Unexpected batch results: %+v", stored.Batches)
+	}
+	if stored.Result.New != 2 {
+		t.Errorf("Expected 2 new poems, got %d", stored.Result.New)
+	}
+
+	if calls["Poem 2"] != 2 || calls["Poem 4"] != 1 {
+		t.Errorf("Expected only the failing batch to be retried, got calls %v", calls)
+	}
+
+	letters, _ := worker.ListDeadLetters(context.Background(), 10)
+	if len(letters) != 1 || letters[0].PoemCount != 2 {
+		t.Fatalf("Expected the failing batch to be dead-lettered, got %+v", letters)
+	}
+	letter, _ := worker.deadLetters.Get(context.Background(), job.ID)
+	if letter.Poems[0].Title != "Poem 2" || letter.Poems[1].Title != "Poem 3" {
+		t.Errorf("Unexpected dead-lettered poems: %+v", letter.Poems)
+	}
+}
@@ -0,0 +1,96 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"poetry/db"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrDeadLetterNotFound is returned by a DeadLetterStore for unknown job IDs
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a job that kept failing after every retry. It keeps the
+// poems of the job so it can be queued again once the cause is fixed.
+type DeadLetter struct {
+	JobID       string           `json:"job_id" bson:"_id"`
+	OnDuplicate db.DuplicateMode `json:"on_duplicate" bson:"on_duplicate"`
+	PoemCount   int              `json:"poem_count" bson:"poem_count"`
+	Attempts    int              `json:"attempts" bson:"attempts"`
+	Error       string           `json:"error" bson:"error"`
+	FailedAt    time.Time        `json:"failed_at" bson:"failed_at"`
+	Poems       []db.Poem        `json:"-" bson:"-"`
+}
+
+// DeadLetterStore keeps the jobs that exhausted their retries.
+type DeadLetterStore interface {
+	Add(ctx context.Context, letter DeadLetter) error
+	// Get returns the dead letter of job id along with its poems
+	Get(ctx context.Context, id string) (DeadLetter, error)
+	// List returns the most recent dead letters first, without their poems
+	List(ctx context.Context, limit int) ([]DeadLetter, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// memoryDeadLetterStore is the DeadLetterStore used when none is configured
+type memoryDeadLetterStore struct {
+	mu      sync.Mutex
+	letters map[string]DeadLetter
+}
+
+func NewMemoryDeadLetterStore() DeadLetterStore {
+	return &memoryDeadLetterStore{letters: make(map[string]DeadLetter)}
+}
+
+func (s *memoryDeadLetterStore) Add(ctx context.Context, letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.letters[letter.JobID] = letter
+	return nil
+}
+
+func (s *memoryDeadLetterStore) Get(ctx context.Context, id string) (DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letter, ok := s.letters[id]
+	if !ok {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return letter, nil
+}
+
+func (s *memoryDeadLetterStore) List(ctx context.Context, limit int) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := []DeadLetter{}
+	for _, letter := range s.letters {
+		letter.Poems = nil
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].FailedAt.Equal(letters[j].FailedAt) {
+			return letters[i].JobID > letters[j].JobID
+		}
+		return letters[i].FailedAt.After(letters[j].FailedAt)
+	})
+	if limit > 0 && len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+func (s *memoryDeadLetterStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.letters[id]; !ok {
+		return ErrDeadLetterNotFound
+	}
+	delete(s.letters, id)
+	return nil
+}
@@ -0,0 +1,167 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"poetry/db"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	// JobPartial marks a job where some poems were saved before it failed
+	JobPartial JobState = "partial"
+)
+
+// ErrJobNotFound is returned by a JobStore for unknown job IDs
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrNoPoems is returned by SubmitStream for a job without poems
+var ErrNoPoems = errors.New("job has no poems")
+
+type Job struct {
+	ID          string           `json:"id" bson:"_id"`
+	State       JobState         `json:"state" bson:"state"`
+	OnDuplicate db.DuplicateMode `json:"on_duplicate" bson:"on_duplicate"`
+	PoemCount   int              `json:"poem_count" bson:"poem_count"`
+	Attempts    int              `json:"attempts" bson:"attempts"`
+	Retries     int              `json:"retries" bson:"retries"`
+	RetryOf     string           `json:"retry_of,omitempty" bson:"retry_of,omitempty"`
+	Result      db.UpsertResult  `json:"result" bson:"result"`
+	Batches     []BatchResult    `json:"batches,omitempty" bson:"batches,omitempty"`
+	Errors      []string         `json:"errors,omitempty" bson:"errors,omitempty"`
+	CreatedAt   time.Time        `json:"created_at" bson:"created_at"`
+	StartedAt   *time.Time       `json:"started_at,omitempty" bson:"started_at,omitempty"`
+	FinishedAt  *time.Time       `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+	Poems       []db.Poem        `json:"-" bson:"-"`
+	// Lease is the token of the queue lease held while the job is processed,
+	// empty for queues without leases
+	Lease string `json:"-" bson:"-"`
+	// staged counts the poem chunks a stager stored before the job was
+	// queued
+	staged int
+}
+
+// BatchResult reports how one batch of a job's poems was saved
+type BatchResult struct {
+	Index  int             `json:"index" bson:"index"`
+	Size   int             `json:"size" bson:"size"`
+	Result db.UpsertResult `json:"result" bson:"result"`
+	Error  string          `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// newJobID returns a unique, roughly time-ordered job ID
+func newJobID() string {
+	return primitive.NewObjectID().Hex()
+}
+
+// Finished reports whether the job has reached a final state
+func (j Job) Finished() bool {
+	return j.State == JobSucceeded || j.State == JobFailed || j.State == JobPartial
+}
+
+// JobStore keeps the lifecycle records of jobs so they can be polled after
+// submission. Stored jobs never carry their poems.
+type JobStore interface {
+	Save(ctx context.Context, job Job) error
+	Get(ctx context.Context, id string) (Job, error)
+	// List returns the most recent jobs first, optionally only those in state
+	List(ctx context.Context, state JobState, limit int) ([]Job, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// maxMemoryJobs bounds how many finished jobs a memoryJobStore remembers
+const maxMemoryJobs = 1000
+
+// memoryJobStore is the JobStore used when none is configured; its records
+// are lost when the worker restarts.
+type memoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+func NewMemoryJobStore() JobStore {
+	return &memoryJobStore{jobs: make(map[string]Job)}
+}
+
+func (s *memoryJobStore) Save(ctx context.Context, job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.Poems = nil
+	s.jobs[job.ID] = job
+	s.prune()
+	return nil
+}
+
+// prune forgets the oldest finished jobs once the store is over capacity
+func (s *memoryJobStore) prune() {
+	if len(s.jobs) <= maxMemoryJobs {
+		return
+	}
+
+	var finished []Job
+	for _, job := range s.jobs {
+		if job.Finished() {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.Before(finished[j].CreatedAt) })
+
+	for _, job := range finished {
+		if len(s.jobs) <= maxMemoryJobs {
+			return
+		}
+		delete(s.jobs, job.ID)
+	}
+}
+
+func (s *memoryJobStore) Get(ctx context.Context, id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return job, nil
+}
+
+func (s *memoryJobStore) List(ctx context.Context, state JobState, limit int) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := []Job{}
+	for _, job := range s.jobs {
+		if state == "" || job.State == state {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].ID > jobs[j].ID
+		}
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+func (s *memoryJobStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.jobs, id)
+	return nil
+}
@@ -0,0 +1,128 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"poetry/db"
+	"testing"
+)
+
+func TestSubmitRecordsQueuedJob(t *testing.T) {
+	worker := NewWorker(&db.MongoDBConnection{}, 1, 1)
+
+	job, err := worker.Submit(Job{Poems: []db.Poem{{Title: "Poem", Language: "en"}}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if job.ID == "" {
+		t.Fatal("Expected the job to be assigned an ID")
+	}
+
+	stored, err := worker.GetJob(context.Background(), job.ID)
+	if err != nil {
+		t.Fatalf("Expected the job to be stored, got %v", err)
+	}
+	if stored.State != JobQueued {
+		t.Errorf("Expected state %s, got %s", JobQueued, stored.State)
+	}
+	if stored.PoemCount != 1 || stored.OnDuplicate != db.SkipDuplicates {
+		t.Errorf("Unexpected job record: %+v", stored)
+	}
+	if stored.Poems != nil {
+		t.Error("Stored jobs should not keep their poems")
+	}
+}
+
+func TestSubmitForgetsRejectedJob(t *testing.T) {
+	worker := NewWorker(&db.MongoDBConnection{}, 1, 1)
+
+	if _, err := worker.Submit(Job{Poems: []db.Poem{{Title: "Poem 1"}}}); err != nil {
+		t.Fatalf("First job should succeed, got error: %v", err)
+	}
+	if _, err := worker.Submit(Job{Poems: []db.Poem{{Title: "Poem 2"}}}); err == nil {
+		t.Fatal("Expected error when queue is full, got nil")
+	}
+
+	jobs, err := worker.ListJobs(context.Background(), "", 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("Expected only the accepted job to be recorded, got %d jobs", len(jobs))
+	}
+}
+
+func TestGetJobNotFound(t *testing.T) {
+	worker := NewWorker(&db.MongoDBConnection{}, 1, 1)
+
+	if _, err := worker.GetJob(context.Background(), "missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestProcessJobStates(t *testing.T) {
+	tests := []struct {
+		name   string
+		result db.UpsertResult
+		err    error
+		state  JobState
+	}{
+		{name: "succeeded", result: db.UpsertResult{New: 2}, state: JobSucceeded},
+		{name: "failed", err: errors.New("connection refused"), state: JobFailed},
+		{name: "partial", result: db.UpsertResult{New: 1}, err: errors.New("write failed"), state: JobPartial},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worker := NewWorker(&db.MongoDBConnection{}, 1, 1, WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+			worker.upsert = func(ctx context.Context, poems []db.Poem, mode db.DuplicateMode) (db.UpsertResult, error) {
+				return tt.result, tt.err
+			}
+
+			job, err := worker.Submit(Job{Poems: []db.Poem{{Title: "Poem 1"}, {Title: "Poem 2"}}})
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			queued, err := worker.queue.Dequeue(context.Background())
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			worker.processJob(1, queued)
+
+			stored, err := worker.GetJob(context.Background(), job.ID)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if stored.State != tt.state {
+				t.Errorf("Expected state %s, got %s", tt.state, stored.State)
+			}
+			if stored.Result != tt.result {
+				t.Errorf("Expected result %+v, got %+v", tt.result, stored.Result)
+			}
+			if stored.Attempts != 1 {
+				t.Errorf("Expected 1 attempt, got %d", stored.Attempts)
+			}
+			if stored.StartedAt == nil || stored.FinishedAt == nil {
+				t.Error("Expected start and finish times to be recorded")
+			}
+			if (tt.err != nil) != (len(stored.Errors) > 0) {
+				t.Errorf("Unexpected errors recorded: %v", stored.Errors)
+			}
+		})
+	}
+}
+
+func TestListJobsFiltersByState(t *testing.T) {
+	store := NewMemoryJobStore()
+	ctx := context.Background()
+	store.Save(ctx, Job{ID: "a", State: JobSucceeded})
+	store.Save(ctx, Job{ID: "b", State: JobFailed})
+
+	jobs, err := store.List(ctx, JobFailed, 10)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != "b" {
+		t.Errorf("Expected only job b, got %+v", jobs)
+	}
+}
@@ -0,0 +1,281 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"poetry/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// payloadCollection holds the poems of queued jobs, split into chunks so
+	// that large uploads stay under the MongoDB document size limit.
+	payloadCollection = "job_payloads"
+	payloadChunkSize  = 500
+)
+
+// MongoQueueOptions tunes a Mongo-backed queue. Zero values select the
+// defaults.
+type MongoQueueOptions struct {
+	// VisibilityTimeout is how long a dequeued job stays hidden from other
+	// consumers. A job that is not acknowledged in time, because its worker
+	// died, is delivered again. Defaults to 5 minutes.
+	VisibilityTimeout time.Duration
+	// PollInterval is how often an idle consumer checks for new jobs.
+	// Defaults to 1 second.
+	PollInterval time.Duration
+}
+
+// mongoQueue keeps queued jobs in the jobs collection, next to the records
+// written by mongoJobStore, so accepted jobs survive restarts and can be
+// shared by several worker replicas. A job is leased by pushing its
+// available_at time forward by the visibility timeout and storing a lease
+// token in lease_owner; the worker renews the lease while the job runs, and
+// only the holder of the token may update or acknowledge the job.
+type mongoQueue struct {
+	jobs     *mongo.Collection
+	payloads *mongo.Collection
+	owner    string
+	options  MongoQueueOptions
+}
+
+// NewMongoQueue returns a durable Queue. Its jobs must be recorded with the
+// store returned by NewMongoJobStore.
+func NewMongoQueue(ctx context.Context, connection *db.MongoDBConnection, opts MongoQueueOptions) (Queue, error) {
+	if opts.VisibilityTimeout <= 0 {
+		opts.VisibilityTimeout = 5 * time.Minute
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+
+	database := connection.Client.Database(connection.Database)
+	q := &mongoQueue{
+		jobs:     database.Collection("jobs"),
+		payloads: database.Collection(payloadCollection),
+		owner:    leaseOwner(),
+		options:  opts,
+	}
+
+	_, err := q.jobs.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "available_at", Value: 1}, {Key: "created_at", Value: 1}},
+		Options: options.Index().
+			SetName("queue_available_at").
+			SetPartialFilterExpression(bson.D{{Key: "available_at", Value: bson.D{{Key: "$exists", Value: true}}}}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job queue index: %v", err)
+	}
+	_, err = q.payloads.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "job_id", Value: 1}, {Key: "seq", Value: 1}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job payload index: %v", err)
+	}
+	return q, nil
+}
+
+// leaseOwner identifies this process in the lease tokens of the jobs it
+// holds, which helps tracing jobs that were redelivered.
+func leaseOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), primitive.NewObjectID().Hex())
+}
+
+type jobPayload struct {
+	JobID string    `bson:"job_id"`
+	Seq   int       `bson:"seq"`
+	Poems []db.Poem `bson:"poems"`
+}
+
+// payloadChunks splits poems into the chunks stored for a job, numbering
+// them from seq
+func payloadChunks(jobID string, seq int, poems []db.Poem) []interface{} {
+	var chunks []interface{}
+	for start := 0; start < len(poems); start += payloadChunkSize {
+		end := start + payloadChunkSize
+		if end > len(poems) {
+			end = len(poems)
+		}
+		chunks = append(chunks, jobPayload{JobID: jobID, Seq: seq + len(chunks), Poems: poems[start:end]})
+	}
+	return chunks
+}
+
+// Stage stores poems of job ahead of Enqueue, after those staged before.
+func (q *mongoQueue) Stage(ctx context.Context, job *Job, poems []db.Poem) error {
+	chunks := payloadChunks(job.ID, job.staged, poems)
+	if len(chunks) == 0 {
+		return nil
+	}
+	if _, err := q.payloads.InsertMany(ctx, chunks); err != nil {
+		return fmt.Errorf("failed to store poems of job %s: %v", job.ID, err)
+	}
+	job.staged += len(chunks)
+	return nil
+}
+
+// Discard drops the poems staged for job.
+func (q *mongoQueue) Discard(ctx context.Context, job *Job) error {
+	if _, err := q.payloads.DeleteMany(ctx, bson.D{{Key: "job_id", Value: job.ID}}); err != nil {
+		return fmt.Errorf("failed to delete poems of job %s: %v", job.ID, err)
+	}
+	return nil
+}
+
+// Enqueue stores the poems of job and then makes it available. The job
+// record itself must already have been saved.
+func (q *mongoQueue) Enqueue(ctx context.Context, job *Job) error {
+	if err := q.Stage(ctx, job, job.Poems); err != nil {
+		return err
+	}
+
+	result, err := q.jobs.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: job.ID}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "available_at", Value: time.Now()}}}},
+	)
+	if err == nil && result.MatchedCount == 0 {
+		err = ErrJobNotFound
+	}
+	if err != nil {
+		q.Discard(ctx, job)
+		return fmt.Errorf("failed to queue job %s: %v", job.ID, err)
+	}
+	return nil
+}
+
+// availableFilter matches unfinished jobs that nobody holds a lease on
+func availableFilter(now time.Time) bson.D {
+	return bson.D{
+		{Key: "available_at", Value: bson.D{{Key: "$lte", Value: now}}},
+		{Key: "state", Value: bson.D{{Key: "$in", Value: bson.A{JobQueued, JobRunning}}}},
+	}
+}
+
+// Dequeue leases the oldest available job, polling until one shows up or
+// ctx is done.
+func (q *mongoQueue) Dequeue(ctx context.Context) (*Job, error) {
+	for {
+		job, err := q.lease(ctx)
+		if err != nil || job != nil {
+			return job, err
+		}
+
+		select {
+		case <-time.After(q.options.PollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// lease claims the oldest available job, returning nil when there is none.
+func (q *mongoQueue) lease(ctx context.Context) (*Job, error) {
+	now := time.Now()
+	// Each lease gets its own token, so a job leased again by this same
+	// process after its lease expired is still told apart.
+	token := q.owner + "/" + primitive.NewObjectID().Hex()
+
+	var job Job
+	err := q.jobs.FindOneAndUpdate(ctx,
+		availableFilter(now),
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "available_at", Value: now.Add(q.options.VisibilityTimeout)},
+				{Key: "lease_owner", Value: token},
+			}},
+			{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "available_at", Value: 1}, {Key: "created_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease job: %v", err)
+	}
+	job.Lease = token
+
+	cursor, err := q.payloads.Find(ctx,
+		bson.D{{Key: "job_id", Value: job.ID}},
+		options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load poems of job %s: %v", job.ID, err)
+	}
+	var chunks []jobPayload
+	if err := cursor.All(ctx, &chunks); err != nil {
+		return nil, fmt.Errorf("failed to read poems of job %s: %v", job.ID, err)
+	}
+	for _, chunk := range chunks {
+		job.Poems = append(job.Poems, chunk.Poems...)
+	}
+	return &job, nil
+}
+
+// leaseFilter matches job while the caller still holds its lease
+func leaseFilter(job *Job) bson.D {
+	return bson.D{{Key: "_id", Value: job.ID}, {Key: "lease_owner", Value: job.Lease}}
+}
+
+// Renew pushes the lease on job forward by the visibility timeout.
+func (q *mongoQueue) Renew(ctx context.Context, job *Job) error {
+	result, err := q.jobs.UpdateOne(ctx,
+		leaseFilter(job),
+		bson.D{{Key: "$set", Value: bson.D{{Key: "available_at", Value: time.Now().Add(q.options.VisibilityTimeout)}}}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to renew lease of job %s: %v", job.ID, err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// RenewInterval leaves room for two failed renewals before a lease expires
+func (q *mongoQueue) RenewInterval() time.Duration {
+	return q.options.VisibilityTimeout / 3
+}
+
+// Ack removes the job from the queue and drops its poems. The job record
+// stays in place for status queries. A job whose lease was lost is left to
+// its new holder.
+func (q *mongoQueue) Ack(ctx context.Context, job *Job) error {
+	result, err := q.jobs.UpdateOne(ctx,
+		leaseFilter(job),
+		bson.D{{Key: "$unset", Value: bson.D{
+			{Key: "available_at", Value: ""},
+			{Key: "lease_owner", Value: ""},
+		}}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to acknowledge job %s: %v", job.ID, err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	if _, err := q.payloads.DeleteMany(ctx, bson.D{{Key: "job_id", Value: job.ID}}); err != nil {
+		return fmt.Errorf("failed to delete poems of job %s: %v", job.ID, err)
+	}
+	return nil
+}
+
+func (q *mongoQueue) Len(ctx context.Context) (int, error) {
+	count, err := q.jobs.CountDocuments(ctx, bson.D{
+		{Key: "available_at", Value: bson.D{{Key: "$exists", Value: true}}},
+		{Key: "state", Value: JobQueued},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count queued jobs: %v", err)
+	}
+	return int(count), nil
+}
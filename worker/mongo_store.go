@@ -0,0 +1,195 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"poetry/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoJobStore keeps job records in the jobs collection, so they survive
+// restarts and are visible to every worker replica.
+type mongoJobStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoJobStore(connection *db.MongoDBConnection) JobStore {
+	collection, _ := db.GetCollection(connection.Database, "jobs", connection)
+	return &mongoJobStore{collection: collection}
+}
+
+// Save updates the record fields of job, leaving any other fields of the
+// document untouched. A job being processed is only updated while its lease
+// is still held, otherwise ErrLeaseLost is returned.
+func (s *mongoJobStore) Save(ctx context.Context, job Job) error {
+	data, err := bson.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode job %s: %v", job.ID, err)
+	}
+	var fields bson.M
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("failed to encode job %s: %v", job.ID, err)
+	}
+	delete(fields, "_id")
+
+	filter := bson.D{{Key: "_id", Value: job.ID}}
+	updateOptions := options.Update().SetUpsert(true)
+	if job.Lease != "" {
+		filter = leaseFilter(&job)
+		updateOptions.SetUpsert(false)
+	}
+
+	result, err := s.collection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: fields}}, updateOptions)
+	if err != nil {
+		return fmt.Errorf("failed to save job %s: %v", job.ID, err)
+	}
+	if job.Lease != "" && result.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (s *mongoJobStore) Get(ctx context.Context, id string) (Job, error) {
+	var job Job
+	err := s.collection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return Job{}, ErrJobNotFound
+	}
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to load job %s: %v", id, err)
+	}
+	return job, nil
+}
+
+func (s *mongoJobStore) List(ctx context.Context, state JobState, limit int) ([]Job, error) {
+	filter := bson.D{}
+	if state != "" {
+		filter = append(filter, bson.E{Key: "state", Value: state})
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}})
+	if limit > 0 {
+		findOptions.SetLimit(int64(limit))
+	}
+
+	cursor, err := s.collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	jobs := []Job{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, fmt.Errorf("failed to read jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+func (s *mongoJobStore) Delete(ctx context.Context, id string) error {
+	if _, err := s.collection.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}}); err != nil {
+		return fmt.Errorf("failed to delete job %s: %v", id, err)
+	}
+	return nil
+}
+
+// deadLetterPayloadCollection holds the poems of dead letters, chunked like
+// the payloads of queued jobs
+const deadLetterPayloadCollection = "dead_letter_payloads"
+
+// mongoDeadLetterStore keeps dead letters in the dead_letters collection
+type mongoDeadLetterStore struct {
+	letters  *mongo.Collection
+	payloads *mongo.Collection
+}
+
+func NewMongoDeadLetterStore(connection *db.MongoDBConnection) DeadLetterStore {
+	database := connection.Client.Database(connection.Database)
+	return &mongoDeadLetterStore{
+		letters:  database.Collection("dead_letters"),
+		payloads: database.Collection(deadLetterPayloadCollection),
+	}
+}
+
+// Add stores the poems of letter before the letter itself, so a listed dead
+// letter can always be queued again.
+func (s *mongoDeadLetterStore) Add(ctx context.Context, letter DeadLetter) error {
+	if _, err := s.payloads.DeleteMany(ctx, bson.D{{Key: "job_id", Value: letter.JobID}}); err != nil {
+		return fmt.Errorf("failed to clear poems of dead letter %s: %v", letter.JobID, err)
+	}
+	if chunks := payloadChunks(letter.JobID, 0, letter.Poems); len(chunks) > 0 {
+		if _, err := s.payloads.InsertMany(ctx, chunks); err != nil {
+			return fmt.Errorf("failed to store poems of dead letter %s: %v", letter.JobID, err)
+		}
+	}
+
+	_, err := s.letters.ReplaceOne(ctx,
+		bson.D{{Key: "_id", Value: letter.JobID}},
+		letter,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save dead letter %s: %v", letter.JobID, err)
+	}
+	return nil
+}
+
+func (s *mongoDeadLetterStore) Get(ctx context.Context, id string) (DeadLetter, error) {
+	var letter DeadLetter
+	err := s.letters.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&letter)
+	if err == mongo.ErrNoDocuments {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("failed to load dead letter %s: %v", id, err)
+	}
+
+	cursor, err := s.payloads.Find(ctx,
+		bson.D{{Key: "job_id", Value: id}},
+		options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}),
+	)
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("failed to load poems of dead letter %s: %v", id, err)
+	}
+	var chunks []jobPayload
+	if err := cursor.All(ctx, &chunks); err != nil {
+		return DeadLetter{}, fmt.Errorf("failed to read poems of dead letter %s: %v", id, err)
+	}
+	for _, chunk := range chunks {
+		letter.Poems = append(letter.Poems, chunk.Poems...)
+	}
+	return letter, nil
+}
+
+func (s *mongoDeadLetterStore) List(ctx context.Context, limit int) ([]DeadLetter, error) {
+	findOptions := options.Find().SetSort(bson.D{{Key: "failed_at", Value: -1}, {Key: "_id", Value: -1}})
+	if limit > 0 {
+		findOptions.SetLimit(int64(limit))
+	}
+
+	cursor, err := s.letters.Find(ctx, bson.D{}, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %v", err)
+	}
+
+	letters := []DeadLetter{}
+	if err := cursor.All(ctx, &letters); err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %v", err)
+	}
+	return letters, nil
+}
+
+func (s *mongoDeadLetterStore) Delete(ctx context.Context, id string) error {
+	result, err := s.letters.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		return fmt.Errorf("failed to delete dead letter %s: %v", id, err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrDeadLetterNotFound
+	}
+	if _, err := s.payloads.DeleteMany(ctx, bson.D{{Key: "job_id", Value: id}}); err != nil {
+		return fmt.Errorf("failed to delete poems of dead letter %s: %v", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"poetry/db"
+	"time"
+)
+
+// ErrQueueFull is returned by Queue.Enqueue when the queue cannot accept
+// another job
+var ErrQueueFull = errors.New("worker queue is full, job rejected")
+
+// ErrLeaseLost is returned when a job's lease expired and another worker
+// took the job over, so this worker must not record anything for it.
+var ErrLeaseLost = errors.New("job lease lost to another worker")
+
+// Queue hands submitted jobs to the worker goroutines. A job taken with
+// Dequeue stays owned by the caller until it is acknowledged; durable
+// implementations deliver it again if it is not acknowledged in time.
+type Queue interface {
+	Enqueue(ctx context.Context, job *Job) error
+	// Dequeue blocks until a job is available or ctx is done
+	Dequeue(ctx context.Context) (*Job, error)
+	// Ack removes a finished job from the queue
+	Ack(ctx context.Context, job *Job) error
+	// Len returns the number of jobs waiting to be picked up
+	Len(ctx context.Context) (int, error)
+}
+
+// leaser is implemented by queues whose jobs are leased for a limited
+// time. The worker renews the lease every RenewInterval while the job runs.
+type leaser interface {
+	Renew(ctx context.Context, job *Job) error
+	RenewInterval() time.Duration
+}
+
+// stager is implemented by queues that keep the poems of a job outside the
+// process. Poems staged before the job is enqueued become part of it, so a
+// large upload is stored chunk by chunk rather than held in memory.
+type stager interface {
+	Stage(ctx context.Context, job *Job, poems []db.Poem) error
+	// Discard drops the staged poems of a job that was not enqueued
+	Discard(ctx context.Context, job *Job) error
+}
+
+// channelQueue is the Queue used when none is configured. It is bounded by
+// its buffer size and loses its jobs when the worker restarts.
+type channelQueue struct {
+	jobs chan *Job
+}
+
+func NewChannelQueue(bufferSize int) Queue {
+	return &channelQueue{jobs: make(chan *Job, bufferSize)}
+}
+
+func (q *channelQueue) Enqueue(ctx context.Context, job *Job) error {
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (q *channelQueue) Dequeue(ctx context.Context) (*Job, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case job := <-q.jobs:
+		job.Attempts++
+		return job, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q *channelQueue) Ack(ctx context.Context, job *Job) error {
+	return nil
+}
+
+func (q *channelQueue) Len(ctx context.Context) (int, error) {
+	return len(q.jobs), nil
+}
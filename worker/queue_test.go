@@ -0,0 +1,368 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"poetry/db"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestChannelQueue(t *testing.T) {
+	queue := NewChannelQueue(1)
+	ctx := context.Background()
+
+	if err := queue.Enqueue(ctx, &Job{ID: "a"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := queue.Enqueue(ctx, &Job{ID: "b"}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if size, _ := queue.Len(ctx); size != 1 {
+		t.Errorf("Expected queue size 1, got %d", size)
+	}
+
+	job, err := queue.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if job.ID != "a" || job.Attempts != 1 {
+		t.Errorf("Unexpected job %+v", job)
+	}
+}
+
+func TestChannelQueueDequeueStopsWithContext(t *testing.T) {
+	queue := NewChannelQueue(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := queue.Dequeue(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestPayloadChunks(t *testing.T) {
+	poems := make([]db.Poem, payloadChunkSize*2+1)
+	chunks := payloadChunks("job", 0, poems)
+
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		payload := chunk.(jobPayload)
+		if payload.JobID != "job" || payload.Seq != i {
+			t.Errorf("Unexpected chunk %d: job %q, seq %d", i, payload.JobID, payload.Seq)
+		}
+	}
+	if last := chunks[2].(jobPayload); len(last.Poems) != 1 {
+		t.Errorf("Expected 1 poem in the last chunk, got %d", len(last.Poems))
+	}
+
+	if chunks := payloadChunks("job", 0, nil); len(chunks) != 0 {
+		t.Errorf("Expected no chunks without poems, got %d", len(chunks))
+	}
+}
+
+// updateResponse mocks the reply to an update matching n documents
+func updateResponse(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+}
+
+func TestMongoQueueLease(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	job := &Job{ID: "job", Lease: "host-1/abc"}
+
+	mt.Run("renew", func(mt *mtest.T) {
+		queue := &mongoQueue{jobs: mt.Coll, options: MongoQueueOptions{VisibilityTimeout: time.Minute}}
+		mt.AddMockResponses(updateResponse(1))
+		if err := queue.Renew(context.Background(), job); err != nil {
+			mt.Fatalf("Expected no error, got %v", err)
+		}
+
+		filter := mt.GetStartedEvent().Command.Lookup("updates", "0", "q")
+		if owner, _ := filter.Document().Lookup("lease_owner").StringValueOK(); owner != job.Lease {
+			mt.Errorf("Expected the renewal to require lease %q, got %s", job.Lease, filter)
+		}
+		if interval := queue.RenewInterval(); interval != 20*time.Second {
+			mt.Errorf("Expected a renew interval of 20s, got %v", interval)
+		}
+	})
+
+	mt.Run("renew lost", func(mt *mtest.T) {
+		queue := &mongoQueue{jobs: mt.Coll, options: MongoQueueOptions{VisibilityTimeout: time.Minute}}
+		mt.AddMockResponses(updateResponse(0))
+		if err := queue.Renew(context.Background(), job); !errors.Is(err, ErrLeaseLost) {
+			mt.Errorf("Expected ErrLeaseLost, got %v", err)
+		}
+	})
+
+	mt.Run("ack lost", func(mt *mtest.T) {
+		queue := &mongoQueue{jobs: mt.Coll, payloads: mt.DB.Collection(payloadCollection)}
+		mt.AddMockResponses(updateResponse(0))
+		if err := queue.Ack(context.Background(), job); !errors.Is(err, ErrLeaseLost) {
+			mt.Errorf("Expected ErrLeaseLost, got %v", err)
+		}
+		// The payloads belong to the new lease holder and must survive.
+		if events := mt.GetAllStartedEvents(); len(events) != 1 {
+			mt.Errorf("Expected only the lease update, got %d commands", len(events))
+		}
+	})
+
+	mt.Run("save lost", func(mt *mtest.T) {
+		store := &mongoJobStore{collection: mt.Coll}
+		mt.AddMockResponses(updateResponse(0))
+		if err := store.Save(context.Background(), *job); !errors.Is(err, ErrLeaseLost) {
+			mt.Errorf("Expected ErrLeaseLost, got %v", err)
+		}
+
+		update := mt.GetStartedEvent().Command.Lookup("updates", "0").Document()
+		if upsert, _ := update.Lookup("upsert").BooleanOK(); upsert {
+			mt.Errorf("Expected a leased job not to be upserted")
+		}
+	})
+
+	mt.Run("save unleased", func(mt *mtest.T) {
+		store := &mongoJobStore{collection: mt.Coll}
+		mt.AddMockResponses(updateResponse(0))
+		if err := store.Save(context.Background(), Job{ID: "new"}); err != nil {
+			mt.Errorf("Expected no error, got %v", err)
+		}
+	})
+}
+
+// leasedQueue is a channel queue that leases jobs and counts renewals. Once
+// lost is set, renewals and saves through leasedStore fail.
+type leasedQueue struct {
+	Queue
+	renewals atomic.Int32
+	lost     atomic.Bool
+	acked    atomic.Int32
+}
+
+func (q *leasedQueue) Dequeue(ctx context.Context) (*Job, error) {
+	job, err := q.Queue.Dequeue(ctx)
+	if job != nil {
+		job.Lease = "lease"
+	}
+	return job, err
+}
+
+func (q *leasedQueue) Ack(ctx context.Context, job *Job) error {
+	q.acked.Add(1)
+	return q.Queue.Ack(ctx, job)
+}
+
+func (q *leasedQueue) Renew(ctx context.Context, job *Job) error {
+	q.renewals.Add(1)
+	if q.lost.Load() {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (q *leasedQueue) RenewInterval() time.Duration {
+	return 5 * time.Millisecond
+}
+
+type leasedStore struct {
+	JobStore
+	queue *leasedQueue
+	mu    sync.Mutex
+	saves []JobState
+}
+
+func (s *leasedStore) Save(ctx context.Context, job Job) error {
+	if job.Lease != "" && s.queue.lost.Load() {
+		return ErrLeaseLost
+	}
+	s.mu.Lock()
+	s.saves = append(s.saves, job.State)
+	s.mu.Unlock()
+	return s.JobStore.Save(ctx, job)
+}
+
+func TestWorkerRenewsLeaseWhileProcessing(t *testing.T) {
+	queue := &leasedQueue{Queue: NewChannelQueue(1)}
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	worker := NewWorker(&db.MongoDBConnection{}, 1, 1, WithQueue(queue))
+	worker.upsert = blockingUpsert(started, release)
+	worker.Start()
+
+	job, err := worker.Submit(Job{Poems: []db.Poem{{Title: "Long"}}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	<-started
+	time.Sleep(30 * time.Millisecond)
+	close(release)
+	worker.Stop()
+
+	if stored, _ := worker.GetJob(context.Background(), job.ID); stored.State != JobSucceeded {
+		t.Errorf("Expected the job to succeed, got state %s", stored.State)
+	}
+	if renewals := queue.renewals.Load(); renewals < 2 {
+		t.Errorf("Expected the lease to be renewed while the job ran, got %d renewals", renewals)
+	}
+	settled := queue.renewals.Load()
+	time.Sleep(20 * time.Millisecond)
+	if renewals := queue.renewals.Load(); renewals != settled {
+		t.Errorf("Expected renewals to stop with the job, got %d more", renewals-settled)
+	}
+}
+
+func TestWorkerGivesUpLostLease(t *testing.T) {
+	queue := &leasedQueue{Queue: NewChannelQueue(1)}
+	store := &leasedStore{JobStore: NewMemoryJobStore(), queue: queue}
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	worker := NewWorker(&db.MongoDBConnection{}, 1, 1, WithQueue(queue), WithJobStore(store), WithBatchSize(1))
+	worker.upsert = blockingUpsert(started, release)
+	worker.Start()
+
+	_, err := worker.Submit(Job{Poems: []db.Poem{{Title: "First"}, {Title: "Second"}}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	<-started
+	queue.lost.Store(true)
+	close(release)
+	worker.Stop()
+
+	if acked := queue.acked.Load(); acked != 0 {
+		t.Errorf("Expected a job with a lost lease not to be acknowledged, got %d acks", acked)
+	}
+	if completed, failed := worker.GetCompletedJobs(), worker.GetFailedJobs(); completed != 0 || failed != 0 {
+		t.Errorf("Expected the job not to be counted, got %d completed and %d failed", completed, failed)
+	}
+	for _, state := range store.saves {
+		if state == JobSucceeded || state == JobFailed || state == JobPartial {
+			t.Errorf("Expected no final state to be saved after losing the lease, got %s", state)
+		}
+	}
+}
+
+// poemChunks returns a SubmitStream reader yielding chunks and then err,
+// io.EOF when err is nil
+func poemChunks(err error, chunks ...[]db.Poem) func() ([]db.Poem, error) {
+	return func() ([]db.Poem, error) {
+		if len(chunks) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		chunk := chunks[0]
+		chunks = chunks[1:]
+		return chunk, nil
+	}
+}
+
+func TestWorkerSubmitStream(t *testing.T) {
+	queue := NewChannelQueue(2)
+	worker := NewWorker(&db.MongoDBConnection{}, 2, 1, WithQueue(queue))
+
+	job, err := worker.SubmitStream(Job{}, poemChunks(nil, []db.Poem{{Title: "A"}, {Title: "B"}}, []db.Poem{{Title: "C"}}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if job.PoemCount != 3 || job.State != JobQueued {
+		t.Errorf("Expected a queued job with 3 poems, got %d poems in state %s", job.PoemCount, job.State)
+	}
+	queued, err := queue.Dequeue(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(queued.Poems) != 3 {
+		t.Errorf("Expected the queued job to hold 3 poems, got %d", len(queued.Poems))
+	}
+
+	if _, err := worker.SubmitStream(Job{}, poemChunks(nil)); !errors.Is(err, ErrNoPoems) {
+		t.Errorf("Expected ErrNoPoems, got %v", err)
+	}
+	invalid := errors.New("invalid poem")
+	if _, err := worker.SubmitStream(Job{}, poemChunks(invalid, []db.Poem{{Title: "A"}})); !errors.Is(err, invalid) {
+		t.Errorf("Expected the reader error, got %v", err)
+	}
+	if size := worker.GetQueueSize(); size != 0 {
+		t.Errorf("Expected rejected jobs not to be queued, got queue size %d", size)
+	}
+}
+
+// stagingQueue is a channel queue that stages poems instead of queueing them
+// with the job
+type stagingQueue struct {
+	Queue
+	staged    []int
+	discarded []string
+}
+
+func (q *stagingQueue) Stage(ctx context.Context, job *Job, poems []db.Poem) error {
+	q.staged = append(q.staged, len(poems))
+	job.staged++
+	return nil
+}
+
+func (q *stagingQueue) Discard(ctx context.Context, job *Job) error {
+	q.discarded = append(q.discarded, job.ID)
+	return nil
+}
+
+func TestWorkerSubmitStreamStagesChunks(t *testing.T) {
+	queue := &stagingQueue{Queue: NewChannelQueue(2)}
+	worker := NewWorker(&db.MongoDBConnection{}, 2, 1, WithQueue(queue))
+
+	job, err := worker.SubmitStream(Job{}, poemChunks(nil, []db.Poem{{Title: "A"}, {Title: "B"}}, []db.Poem{{Title: "C"}}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if job.PoemCount != 3 || len(job.Poems) != 0 {
+		t.Errorf("Expected 3 staged poems and none held by the job, got %d and %d", job.PoemCount, len(job.Poems))
+	}
+	if len(queue.staged) != 2 || queue.staged[0] != 2 || queue.staged[1] != 1 {
+		t.Errorf("Expected chunks of 2 and 1 poems to be staged, got %v", queue.staged)
+	}
+
+	_, err = worker.SubmitStream(Job{}, poemChunks(errors.New("invalid poem"), []db.Poem{{Title: "A"}}))
+	if err == nil {
+		t.Fatal("Expected the reader error")
+	}
+	if len(queue.discarded) != 1 {
+		t.Errorf("Expected the poems of the rejected job to be discarded, got %v", queue.discarded)
+	}
+}
+
+func TestMongoQueueStage(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("numbers chunks across calls", func(mt *mtest.T) {
+		queue := &mongoQueue{payloads: mt.Coll}
+		job := &Job{ID: "job"}
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
+
+		if err := queue.Stage(context.Background(), job, make([]db.Poem, payloadChunkSize+1)); err != nil {
+			mt.Fatalf("Expected no error, got %v", err)
+		}
+		if err := queue.Stage(context.Background(), job, make([]db.Poem, 1)); err != nil {
+			mt.Fatalf("Expected no error, got %v", err)
+		}
+		if job.staged != 3 {
+			mt.Errorf("Expected 3 staged chunks, got %d", job.staged)
+		}
+
+		events := mt.GetAllStartedEvents()
+		if len(events) != 2 {
+			mt.Fatalf("Expected 2 inserts, got %d commands", len(events))
+		}
+		seq, _ := events[1].Command.Lookup("documents", "0", "seq").AsInt64OK()
+		if seq != 2 {
+			mt.Errorf("Expected the second insert to continue at seq 2, got %d", seq)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"poetry/db"
+	"time"
+)
+
+// RetryPolicy decides how often a failing job is attempted again before it
+// is moved to the dead-letter store.
+type RetryPolicy struct {
+	// MaxAttempts counts every attempt, including the first. Values below 1
+	// mean a single attempt.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry; it doubles after
+	// every further failure, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is used by workers created without WithRetryPolicy
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// WithRetryPolicy sets how failing jobs are retried
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(w *Worker) {
+		w.retry = policy
+	}
+}
+
+// WithDeadLetterStore keeps jobs that exhausted their retries in store
+// instead of in memory
+func WithDeadLetterStore(store DeadLetterStore) Option {
+	return func(w *Worker) {
+		w.deadLetters = store
+	}
+}
+
+// backoff returns the wait after the given failed attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		wait *= 2
+		if p.MaxBackoff > 0 && wait >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return wait
+}
+
+// saveWithRetry saves one batch of job, retrying failures with exponential
+// backoff, and returns the number of attempts made. Poems rejected by
+// MongoDB are not retried. Saving is idempotent, so poems stored by a failed
+// attempt count as skipped or updated in the result of the next one.
+func (w *Worker) saveWithRetry(workerID int, job *Job, batch int, poems []db.Poem) (db.UpsertResult, int, error) {
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		result, err := w.upsert(ctx, poems, job.OnDuplicate)
+		cancel()
+
+		var rejected *db.PoemWriteError
+		if err == nil || errors.As(err, &rejected) || attempt >= w.retry.MaxAttempts {
+			return result, attempt, err
+		}
+
+		wait := w.retry.backoff(attempt)
+		log.Printf("Worker %d attempt %d of job %s batch %d failed, retrying in %v: %v", workerID, attempt, job.ID, batch, wait, err)
+		job.Retries++
+		job.Errors = append(job.Errors, fmt.Sprintf("batch %d attempt %d: %v", batch, attempt, err))
+		if err := w.saveJob(job); err != nil {
+			return result, attempt, err
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-w.ctx.Done():
+			return result, attempt, fmt.Errorf("worker stopped before retrying: %v", err)
+		}
+	}
+}
+
+// deadLetter moves the poems of job that could not be saved within their
+// retries to the dead-letter store
+func (w *Worker) deadLetter(job *Job, poems []db.Poem, attempts int, cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := w.deadLetters.Add(ctx, DeadLetter{
+		JobID:       job.ID,
+		OnDuplicate: job.OnDuplicate,
+		PoemCount:   len(poems),
+		Attempts:    attempts,
+		Error:       cause.Error(),
+		FailedAt:    time.Now(),
+		Poems:       poems,
+	})
+	if err != nil {
+		log.Printf("Failed to dead-letter job %s, its poems are lost: %v", job.ID, err)
+	}
+}
+
+// ListDeadLetters returns the most recent jobs that exhausted their retries
+func (w *Worker) ListDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	return w.deadLetters.List(ctx, limit)
+}
+
+// Requeue submits the poems of a dead-lettered job as a new job and removes
+// the dead letter.
+func (w *Worker) Requeue(ctx context.Context, id string) (Job, error) {
+	letter, err := w.deadLetters.Get(ctx, id)
+	if err != nil {
+		return Job{}, err
+	}
+
+	job, err := w.Submit(Job{Poems: letter.Poems, OnDuplicate: letter.OnDuplicate, RetryOf: letter.JobID})
+	if err != nil {
+		return Job{}, err
+	}
+
+	if err := w.deadLetters.Delete(ctx, id); err != nil {
+		log.Printf("Failed to remove requeued dead letter %s: %v", id, err)
+	}
+	return job, nil
+}
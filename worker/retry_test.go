@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"poetry/db"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, want := range expected {
+		if got := policy.backoff(i + 1); got != want {
+			t.Errorf("Attempt %d: expected backoff %v, got %v", i+1, want, got)
+		}
+	}
+}
+
+func TestProcessJobRetriesUntilSuccess(t *testing.T) {
+	worker := NewWorker(&db.MongoDBConnection{}, 1, 1,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	calls := 0
+	worker.upsert = func(ctx context.Context, poems []db.Poem, mode db.DuplicateMode) (db.UpsertResult, error) {
+		calls++
+		if calls < 3 {
+			return db.UpsertResult{}, errors.New("connection reset")
+		}
+		return db.UpsertResult{New: 1}, nil
+	}
+
+	job, _ := worker.Submit(Job{Poems: []db.Poem{{Title: "Poem"}}})
+	queued, _ := worker.queue.Dequeue(context.Background())
+	if err := worker.processJob(1, queued); err != nil {
+		t.Fatalf("Expected the job to succeed after retries, got %v", err)
+	}
+
+	stored, _ := worker.GetJob(context.Background(), job.ID)
+	if stored.State != JobSucceeded || stored.Retries != 2 || len(stored.Errors) != 2 {
+		t.Errorf("Unexpected job record: %+v", stored)
+	}
+	if letters, _ := worker.ListDeadLetters(context.Background(), 10); len(letters) != 0 {
+		t.Errorf("Expected no dead letters, got %d", len(letters))
+	}
+}
+
+func TestProcessJobDeadLettersAfterRetries(t *testing.T) {
+	worker := NewWorker(&db.MongoDBConnection{}, 2, 1,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}))
+	failing := true
+	worker.upsert = func(ctx context.Context, poems []db.Poem, mode db.DuplicateMode) (db.UpsertResult, error) {
+		if failing {
+			return db.UpsertResult{}, errors.New("not primary")
+		}
+		return db.UpsertResult{New: int64(len(poems))}, nil
+	}
+
+	job, _ := worker.Submit(Job{Poems: []db.Poem{{Title: "Poem 1"}, {Title: "Poem 2"}}, OnDuplicate: db.UpdateDuplicates})
+	queued, _ := worker.queue.Dequeue(context.Background())
+	if err := worker.processJob(1, queued); err == nil {
+		t.Fatal("Expected the job to fail")
+	}
+
+	letters, err := worker.ListDeadLetters(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(letters) != 1 || letters[0].JobID != job.ID || letters[0].Attempts != 2 || letters[0].PoemCount != 2 {
+		t.Fatalf("Unexpected dead letters: %+v", letters)
+	}
+
+	failing = false
+	requeued, err := worker.Requeue(context.Background(), job.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if requeued.ID == job.ID || requeued.RetryOf != job.ID || requeued.PoemCount != 2 || requeued.OnDuplicate != db.UpdateDuplicates {
+		t.Errorf("Unexpected requeued job: %+v", requeued)
+	}
+	if letters, _ := worker.ListDeadLetters(context.Background(), 10); len(letters) != 0 {
+		t.Errorf("Expected the dead letter to be removed, got %d", len(letters))
+	}
+
+	queued, _ = worker.queue.Dequeue(context.Background())
+	if len(queued.Poems) != 2 {
+		t.Errorf("Expected the requeued job to carry 2 poems, got %d", len(queued.Poems))
+	}
+	if err := worker.processJob(1, queued); err != nil {
+		t.Errorf("Expected the requeued job to succeed, got %v", err)
+	}
+}
+
+func TestRequeueUnknownDeadLetter(t *testing.T) {
+	worker := NewWorker(&db.MongoDBConnection{}, 1, 1)
+
+	if _, err := worker.Requeue(context.Background(), "missing"); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("Expected ErrDeadLetterNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ErrWorkerStopped is returned by Submit once Stop has been called
+var ErrWorkerStopped = errors.New("worker is shutting down, job rejected")
+
+// defaultShutdownTimeout bounds how long Stop waits for jobs to finish
+const defaultShutdownTimeout = 30 * time.Second
+
+// StopReport describes the work left undone when Stop returned.
+type StopReport struct {
+	// Drained is true when every job Stop waited for finished in time
+	Drained bool `json:"drained"`
+	// InFlight lists the jobs still being processed at the deadline
+	InFlight []string `json:"in_flight,omitempty"`
+	// Queued counts jobs still waiting in a durable queue, which another
+	// worker or the next start will pick up
+	Queued int `json:"queued"`
+	// Dropped lists queued jobs of an in-memory queue, which are lost
+	Dropped []string `json:"dropped,omitempty"`
+}
+
+// WithShutdownTimeout sets how long Stop waits for jobs to finish
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(w *Worker) {
+		w.shutdownTimeout = timeout
+	}
+}
+
+// WithDrainQueue makes Stop process the jobs still waiting in the queue
+// before returning, instead of only the ones already in flight
+func WithDrainQueue(drain bool) Option {
+	return func(w *Worker) {
+		w.drainQueue = drain
+	}
+}
+
+// WithHTTPServer has Stop shut down server before draining, so no new jobs
+// arrive while the worker winds down
+func WithHTTPServer(server *http.Server) Option {
+	return func(w *Worker) {
+		w.server = server
+	}
+}
+
+// drainer is implemented by queues whose jobs do not outlive the process.
+// Drain removes and returns every job still waiting.
+type drainer interface {
+	Drain() []*Job
+}
+
+func (q *channelQueue) Drain() []*Job {
+	var jobs []*Job
+	for {
+		select {
+		case job := <-q.jobs:
+			jobs = append(jobs, job)
+		default:
+			return jobs
+		}
+	}
+}
+
+// Stop stops accepting jobs and waits up to the shutdown timeout for the
+// jobs in flight, and with WithDrainQueue the queued ones, to finish. Jobs of
+// an in-memory queue that could not be run are recorded as failed.
+func (w *Worker) Stop() StopReport {
+	var report StopReport
+	w.stopOnce.Do(func() {
+		report = w.stop()
+	})
+	return report
+}
+
+func (w *Worker) stop() StopReport {
+	log.Println("Stopping worker...")
+	w.stopped.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.shutdownTimeout)
+	defer cancel()
+
+	if w.server != nil {
+		if err := w.server.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shut down HTTP server: %v", err)
+		}
+	}
+
+	if w.drainQueue {
+		w.waitForEmptyQueue(ctx)
+	}
+	w.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		w.running.Wait()
+		close(done)
+	}()
+
+	report := StopReport{Drained: true}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		report.Drained = false
+		report.InFlight = w.inFlightJobs()
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if queue, ok := w.queue.(drainer); ok {
+		for _, job := range queue.Drain() {
+			w.abandonJob(job, "worker stopped before the job ran")
+			report.Dropped = append(report.Dropped, job.ID)
+		}
+		for _, id := range report.InFlight {
+			job, err := w.store.Get(ctx, id)
+			if err == nil {
+				w.abandonJob(&job, "worker stopped before the job finished")
+			}
+		}
+	} else {
+		size, err := w.queue.Len(ctx)
+		if err != nil {
+			log.Printf("Failed to get queue size: %v", err)
+		}
+		report.Queued = size
+	}
+
+	if len(report.Dropped) > 0 || len(report.InFlight) > 0 {
+		report.Drained = false
+	}
+	return report
+}
+
+// waitForEmptyQueue returns once the queue is empty or ctx is done
+func (w *Worker) waitForEmptyQueue(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if size, err := w.queue.Len(ctx); err == nil && size == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// abandonJob records a job that will not be completed by this worker
+func (w *Worker) abandonJob(job *Job, reason string) {
+	finished := time.Now()
+	job.State = JobFailed
+	job.FinishedAt = &finished
+	job.Errors = append(job.Errors, reason)
+	w.saveJob(job)
+}
+
+func (w *Worker) trackJob(id string) {
+	w.inFlightMu.Lock()
+	defer w.inFlightMu.Unlock()
+	w.inFlight[id] = struct{}{}
+}
+
+func (w *Worker) untrackJob(id string) {
+	w.inFlightMu.Lock()
+	defer w.inFlightMu.Unlock()
+	delete(w.inFlight, id)
+}
+
+func (w *Worker) inFlightJobs() []string {
+	w.inFlightMu.Lock()
+	defer w.inFlightMu.Unlock()
+
+	ids := make([]string, 0, len(w.inFlight))
+	for id := range w.inFlight {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -1,31 +1,92 @@
 package worker
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"poetry/db"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Worker struct {
-	connection *db.MongoDBConnection
-	jobChan    chan Job
-	quit       chan bool
-	maxWorkers int
+	connection      *db.MongoDBConnection
+	queue           Queue
+	ctx             context.Context
+	cancel          context.CancelFunc
+	maxWorkers      int
+	store           JobStore
+	upsert          func(ctx context.Context, poems []db.Poem, mode db.DuplicateMode) (db.UpsertResult, error)
+	completedJobs   atomic.Int64
+	failedJobs      atomic.Int64
+	shutdownTimeout time.Duration
+	drainQueue      bool
+	server          *http.Server
+	stopped         atomic.Bool
+	stopOnce        sync.Once
+	running         sync.WaitGroup
+	inFlightMu      sync.Mutex
+	inFlight        map[string]struct{}
+	retry           RetryPolicy
+	deadLetters     DeadLetterStore
+	batchSize       int
 }
 
-type Job struct {
-	Poems []db.Poem
+// defaultBatchSize is how many poems a job saves per write
+const defaultBatchSize = 1000
+
+// WithBatchSize sets how many poems of a job are saved per write
+func WithBatchSize(size int) Option {
+	return func(w *Worker) {
+		w.batchSize = size
+	}
+}
+
+// Option configures optional Worker behaviour
+type Option func(*Worker)
+
+// WithJobStore records job lifecycles in store instead of in memory
+func WithJobStore(store JobStore) Option {
+	return func(w *Worker) {
+		w.store = store
+	}
+}
+
+// WithQueue takes jobs from queue instead of an in-memory channel of
+// bufferSize jobs. A durable queue needs a JobStore sharing its storage.
+func WithQueue(queue Queue) Option {
+	return func(w *Worker) {
+		w.queue = queue
+	}
 }
 
 // NewWorker creates a new worker instance
-func NewWorker(connection *db.MongoDBConnection, bufferSize int, maxWorkers int) *Worker {
-	return &Worker{
-		connection: connection,
-		jobChan:    make(chan Job, bufferSize),
-		quit:       make(chan bool),
-		maxWorkers: maxWorkers,
+func NewWorker(connection *db.MongoDBConnection, bufferSize int, maxWorkers int, opts ...Option) *Worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Worker{
+		connection:      connection,
+		queue:           NewChannelQueue(bufferSize),
+		ctx:             ctx,
+		cancel:          cancel,
+		maxWorkers:      maxWorkers,
+		store:           NewMemoryJobStore(),
+		shutdownTimeout: defaultShutdownTimeout,
+		inFlight:        make(map[string]struct{}),
+		retry:           DefaultRetryPolicy,
+		deadLetters:     NewMemoryDeadLetterStore(),
+		batchSize:       defaultBatchSize,
 	}
+	w.upsert = func(ctx context.Context, poems []db.Poem, mode db.DuplicateMode) (db.UpsertResult, error) {
+		return db.UpsertPoems(ctx, w.connection, poems, mode)
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
 }
 
 // Start begins the worker processing jobs
@@ -33,69 +94,342 @@ func (w *Worker) Start() {
 	log.Printf("Starting worker with %d goroutines", w.maxWorkers)
 
 	for i := 0; i < w.maxWorkers; i++ {
+		w.running.Add(1)
 		go w.processJobs(i)
 	}
 }
 
-// Stop gracefully shuts down the worker
-func (w *Worker) Stop() {
-	log.Println("Stopping worker...")
-	close(w.quit)
+// AddJob adds a new job to the queue, skipping poems that are already stored
+func (w *Worker) AddJob(poems []db.Poem) error {
+	_, err := w.Submit(Job{Poems: poems, OnDuplicate: db.SkipDuplicates})
+	return err
 }
 
-// AddJob adds a new job to the queue
-func (w *Worker) AddJob(poems []db.Poem) error {
-	job := Job{Poems: poems}
+// Submit assigns the job an ID, records it as queued and adds it to the
+// queue. It returns the accepted job, which can be polled with GetJob.
+func (w *Worker) Submit(job Job) (Job, error) {
+	if w.stopped.Load() {
+		return Job{}, ErrWorkerStopped
+	}
 
-	select {
-	case w.jobChan <- job:
-		log.Printf("Job added with %d poems", len(poems))
-		return nil
-	default:
-		return fmt.Errorf("worker queue is full, job rejected")
+	job.ID = newJobID()
+	job.PoemCount = len(job.Poems)
+	return w.enqueue(job)
+}
+
+// SubmitStream submits a job whose poems are read from next in chunks, next
+// returning io.EOF after the last one. A queue that keeps poems outside the
+// process stores each chunk as it is read, so a large upload is never held
+// in memory at once; other queues gather the chunks into the job. An error
+// from next is returned as is, and a job without poems is rejected with
+// ErrNoPoems.
+func (w *Worker) SubmitStream(job Job, next func() ([]db.Poem, error)) (Job, error) {
+	if w.stopped.Load() {
+		return Job{}, ErrWorkerStopped
+	}
+
+	job.ID = newJobID()
+	job.Poems, job.PoemCount = nil, 0
+	queue, staging := w.queue.(stager)
+	discard := func() {
+		if !staging {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := queue.Discard(ctx, &job); err != nil {
+			log.Printf("Failed to discard poems of rejected job %s: %v", job.ID, err)
+		}
+	}
+
+	for {
+		poems, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			discard()
+			return Job{}, err
+		}
+		job.PoemCount += len(poems)
+		if !staging {
+			job.Poems = append(job.Poems, poems...)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = queue.Stage(ctx, &job, poems)
+		cancel()
+		if err != nil {
+			discard()
+			return Job{}, err
+		}
+	}
+	if job.PoemCount == 0 {
+		return Job{}, ErrNoPoems
+	}
+
+	accepted, err := w.enqueue(job)
+	if err != nil {
+		discard()
 	}
+	return accepted, err
+}
+
+// enqueue records job as queued and adds it to the queue
+func (w *Worker) enqueue(job Job) (Job, error) {
+	job.State = JobQueued
+	job.CreatedAt = time.Now()
+	if job.OnDuplicate == "" {
+		job.OnDuplicate = db.SkipDuplicates
+	}
+
+	// Record the job before queueing it, so a worker goroutine picking it up
+	// immediately cannot have its progress overwritten by the queued state.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.store.Save(ctx, job); err != nil {
+		return Job{}, err
+	}
+
+	queued := job
+	if err := w.queue.Enqueue(ctx, &queued); err != nil {
+		if err := w.store.Delete(ctx, job.ID); err != nil {
+			log.Printf("Failed to forget rejected job %s: %v", job.ID, err)
+		}
+		return Job{}, err
+	}
+	log.Printf("Job %s added with %d poems", job.ID, job.PoemCount)
+	return job, nil
+}
+
+// GetJob returns the current record of a submitted job
+func (w *Worker) GetJob(ctx context.Context, id string) (Job, error) {
+	return w.store.Get(ctx, id)
+}
+
+// ListJobs returns the most recent jobs, optionally only those in state
+func (w *Worker) ListJobs(ctx context.Context, state JobState, limit int) ([]Job, error) {
+	return w.store.List(ctx, state, limit)
 }
 
 // GetQueueSize returns the current number of jobs in the queue
 func (w *Worker) GetQueueSize() int {
-	return len(w.jobChan)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	size, err := w.queue.Len(ctx)
+	if err != nil {
+		log.Printf("Failed to get queue size: %v", err)
+	}
+	return size
+}
+
+// GetCompletedJobs returns the number of jobs processed successfully
+func (w *Worker) GetCompletedJobs() int64 {
+	return w.completedJobs.Load()
+}
+
+// GetFailedJobs returns the number of jobs that could not be saved
+func (w *Worker) GetFailedJobs() int64 {
+	return w.failedJobs.Load()
 }
 
-// processJobs processes jobs from the job channel
+// processJobs processes jobs from the queue until the worker is stopped
 func (w *Worker) processJobs(workerID int) {
+	defer w.running.Done()
 	log.Printf("Worker %d started", workerID)
 
 	for {
-		select {
-		case job := <-w.jobChan:
-			w.processJob(workerID, job)
-		case <-w.quit:
+		job, err := w.queue.Dequeue(w.ctx)
+		if err != nil && w.ctx.Err() != nil {
 			log.Printf("Worker %d stopping", workerID)
 			return
 		}
+		if err != nil {
+			log.Printf("Worker %d failed to take a job: %v", workerID, err)
+			select {
+			case <-time.After(time.Second):
+			case <-w.ctx.Done():
+			}
+			continue
+		}
+
+		w.trackJob(job.ID)
+		stopRenewing := w.renewLease(workerID, job)
+		err = w.processJob(workerID, job)
+		stopRenewing()
+		switch {
+		case errors.Is(err, ErrLeaseLost):
+			// Another worker holds the job now and will finish it.
+			log.Printf("Worker %d gave up job %s: %v", workerID, job.ID, err)
+		case err != nil:
+			w.failedJobs.Add(1)
+			log.Printf("Worker %d job failed: %v", workerID, err)
+			w.ackJob(job)
+		default:
+			w.completedJobs.Add(1)
+			w.ackJob(job)
+		}
+		w.untrackJob(job.ID)
 	}
 }
 
-// processJob processes a single job
-func (w *Worker) processJob(workerID int, job Job) {
-	start := time.Now()
-	log.Printf("Worker %d processing job with %d poems", workerID, len(job.Poems))
+// ackJob removes a finished job from the queue. A job that cannot be
+// acknowledged is not processed again, since its record is already final.
+func (w *Worker) ackJob(job *Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	// Convert poems to documents
-	var documents []interface{}
-	for _, poem := range job.Poems {
-		documents = append(documents, poem)
+	if err := w.queue.Ack(ctx, job); err != nil {
+		log.Printf("Failed to acknowledge job %s: %v", job.ID, err)
 	}
+}
 
-	// Get collection and insert documents
-	collection, err := db.GetCollection("poetry", "poems", w.connection)
+// renewLease keeps extending the queue lease on job until the returned
+// function is called, so that a long job is not handed to another worker
+// while it is still running. Queues without leases need no renewal.
+func (w *Worker) renewLease(workerID int, job *Job) (stop func()) {
+	queue, ok := w.queue.(leaser)
+	if !ok || job.Lease == "" {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(queue.RenewInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := queue.Renew(ctx, job)
+			cancel()
+			if errors.Is(err, ErrLeaseLost) {
+				log.Printf("Worker %d lost the lease of job %s", workerID, job.ID)
+				return
+			}
+			if err != nil {
+				log.Printf("Worker %d failed to renew the lease of job %s: %v", workerID, job.ID, err)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// saveJob records the job's progress, logging failures since the job itself
+// carries on regardless. Only a lost lease is returned, as the job must then
+// be left to the worker holding it.
+func (w *Worker) saveJob(job *Job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := w.store.Save(ctx, *job)
+	if errors.Is(err, ErrLeaseLost) {
+		return fmt.Errorf("job %s: %w", job.ID, err)
+	}
 	if err != nil {
-		log.Printf("Worker %d error getting collection: %v", workerID, err)
-		return
+		log.Printf("Failed to record state %s of job %s: %v", job.State, job.ID, err)
 	}
+	return nil
+}
+
+// processJob processes a single job in batches, recording its progress in
+// the store after each one. A failing batch does not stop the others;
+// batches that still fail after their retries are dead-lettered together.
+func (w *Worker) processJob(workerID int, job *Job) error {
+	start := time.Now()
+	log.Printf("Worker %d processing job %s with %d poems", workerID, job.ID, len(job.Poems))
+
+	job.State = JobRunning
+	job.StartedAt = &start
+	job.Result = db.UpsertResult{}
+	job.Batches = nil
+	if err := w.saveJob(job); err != nil {
+		return err
+	}
+
+	var unsaved []db.Poem
+	var lastErr error
+	failedBatches, attempts := 0, 0
+	for index, batch := range splitBatches(job.Poems, w.batchSize) {
+		result, tries, err := w.saveWithRetry(workerID, job, index, batch)
+		if errors.Is(err, ErrLeaseLost) {
+			return err
+		}
+		job.Result.Add(result)
+
+		batchResult := BatchResult{Index: index, Size: len(batch), Result: result}
+		if err != nil {
+			failedBatches++
+			lastErr = err
+			batchResult.Error = err.Error()
+			job.Errors = append(job.Errors, fmt.Sprintf("batch %d: %v", index, err))
 
-	db.InsertManyIntoDB(*collection, documents)
+			// Rejected poems would be rejected again, so only batches that
+			// ran out of retries are worth requeueing.
+			var rejected *db.PoemWriteError
+			if !errors.As(err, &rejected) {
+				unsaved = append(unsaved, batch...)
+				attempts = max(attempts, tries)
+			}
+		}
+		job.Batches = append(job.Batches, batchResult)
+		if err := w.saveJob(job); err != nil {
+			return err
+		}
+	}
 
-	duration := time.Since(start)
-	log.Printf("Worker %d completed job in %v", workerID, duration)
+	finished := time.Now()
+	job.FinishedAt = &finished
+	switch {
+	case failedBatches == 0:
+		job.State = JobSucceeded
+	case job.Result.Saved() > 0:
+		job.State = JobPartial
+	default:
+		job.State = JobFailed
+	}
+	// The final state is saved first, so a worker that lost the job does
+	// not dead-letter poems its new holder is still saving.
+	if err := w.saveJob(job); err != nil {
+		return err
+	}
+	if len(unsaved) > 0 {
+		w.deadLetter(job, unsaved, attempts, lastErr)
+	}
+
+	result := job.Result
+	if failedBatches > 0 {
+		return fmt.Errorf("%d of %d batches of job %s failed, last error: %v", failedBatches, len(job.Batches), job.ID, lastErr)
+	}
+
+	log.Printf("Worker %d completed job %s in %v: %d new, %d updated, %d skipped",
+		workerID, job.ID, finished.Sub(start), result.New, result.Updated, result.Skipped)
+	return nil
+}
+
+// splitBatches cuts poems into consecutive batches of at most size poems
+func splitBatches(poems []db.Poem, size int) [][]db.Poem {
+	if size < 1 {
+		size = len(poems)
+	}
+
+	var batches [][]db.Poem
+	for start := 0; start < len(poems); start += size {
+		end := min(start+size, len(poems))
+		batches = append(batches, poems[start:end])
+	}
+	return batches
 }
@@ -1,7 +1,11 @@
 package worker
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"poetry/db"
 	"sync"
 	"testing"
@@ -23,8 +27,8 @@ func TestNewWorker(t *testing.T) {
 		t.Error("Worker connection not set correctly")
 	}
 
-	if cap(worker.jobChan) != bufferSize {
-		t.Errorf("Expected job channel buffer size %d, got %d", bufferSize, cap(worker.jobChan))
+	if cap(worker.queue.(*channelQueue).jobs) != bufferSize {
+		t.Errorf("Expected job channel buffer size %d, got %d", bufferSize, cap(worker.queue.(*channelQueue).jobs))
 	}
 
 	if worker.maxWorkers != maxWorkers {
@@ -300,3 +304,129 @@ func TestWorkerStressTest(t *testing.T) {
 		t.Errorf("Expected queue size %d, got %d", successCount, worker.GetQueueSize())
 	}
 }
+
+// blockingUpsert returns an upsert that waits for release before saving
+func blockingUpsert(started chan<- string, release <-chan struct{}) func(context.Context, []db.Poem, db.DuplicateMode) (db.UpsertResult, error) {
+	return func(ctx context.Context, poems []db.Poem, mode db.DuplicateMode) (db.UpsertResult, error) {
+		started <- poems[0].Title
+		<-release
+		return db.UpsertResult{New: int64(len(poems))}, nil
+	}
+}
+
+func TestWorkerStopWaitsForInFlightJob(t *testing.T) {
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	worker := NewWorker(&db.MongoDBConnection{}, 2, 1, WithShutdownTimeout(5*time.Second))
+	worker.upsert = blockingUpsert(started, release)
+	worker.Start()
+
+	job, err := worker.Submit(Job{Poems: []db.Poem{{Title: "In flight"}}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	<-started
+
+	reports := make(chan StopReport)
+	go func() { reports <- worker.Stop() }()
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	report := <-reports
+
+	if !report.Drained || len(report.InFlight) != 0 || len(report.Dropped) != 0 {
+		t.Errorf("Expected a clean stop, got %+v", report)
+	}
+	stored, _ := worker.GetJob(context.Background(), job.ID)
+	if stored.State != JobSucceeded {
+		t.Errorf("Expected the in-flight job to finish, got state %s", stored.State)
+	}
+}
+
+func TestWorkerStopDeadline(t *testing.T) {
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	defer close(release)
+	worker := NewWorker(&db.MongoDBConnection{}, 2, 1, WithShutdownTimeout(20*time.Millisecond))
+	worker.upsert = blockingUpsert(started, release)
+	worker.Start()
+
+	stuck, _ := worker.Submit(Job{Poems: []db.Poem{{Title: "Stuck"}}})
+	<-started
+	queued, _ := worker.Submit(Job{Poems: []db.Poem{{Title: "Queued"}}})
+
+	report := worker.Stop()
+
+	if report.Drained {
+		t.Error("Expected the stop to report undone work")
+	}
+	if len(report.InFlight) != 1 || report.InFlight[0] != stuck.ID {
+		t.Errorf("Expected job %s in flight, got %v", stuck.ID, report.InFlight)
+	}
+	if len(report.Dropped) != 1 || report.Dropped[0] != queued.ID {
+		t.Errorf("Expected job %s dropped, got %v", queued.ID, report.Dropped)
+	}
+
+	stored, _ := worker.GetJob(context.Background(), queued.ID)
+	if stored.State != JobFailed || len(stored.Errors) == 0 {
+		t.Errorf("Expected the dropped job to be recorded as failed, got %+v", stored)
+	}
+}
+
+func TestWorkerStopDrainsQueue(t *testing.T) {
+	worker := NewWorker(&db.MongoDBConnection{}, 5, 1, WithDrainQueue(true), WithShutdownTimeout(5*time.Second))
+	worker.upsert = func(ctx context.Context, poems []db.Poem, mode db.DuplicateMode) (db.UpsertResult, error) {
+		time.Sleep(5 * time.Millisecond)
+		return db.UpsertResult{New: int64(len(poems))}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := worker.AddJob([]db.Poem{{Title: fmt.Sprintf("Poem %d", i)}}); err != nil {
+			t.Fatalf("Job %d should succeed, got error: %v", i, err)
+		}
+	}
+	worker.Start()
+	report := worker.Stop()
+
+	if !report.Drained || len(report.Dropped) != 0 {
+		t.Errorf("Expected every queued job to run, got %+v", report)
+	}
+	if worker.GetCompletedJobs() != 3 {
+		t.Errorf("Expected 3 completed jobs, got %d", worker.GetCompletedJobs())
+	}
+}
+
+func TestWorkerRejectsJobsAfterStop(t *testing.T) {
+	worker := NewWorker(&db.MongoDBConnection{}, 2, 1)
+	worker.Start()
+	worker.Stop()
+
+	if err := worker.AddJob([]db.Poem{{Title: "Late"}}); !errors.Is(err, ErrWorkerStopped) {
+		t.Errorf("Expected ErrWorkerStopped, got %v", err)
+	}
+	// A second Stop is a no-op.
+	worker.Stop()
+}
+
+func TestWorkerStopShutsDownHTTPServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+
+	worker := NewWorker(&db.MongoDBConnection{}, 2, 1, WithHTTPServer(server))
+	worker.Start()
+	worker.Stop()
+
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("Expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("HTTP server was not shut down")
+	}
+}